@@ -2,11 +2,12 @@ package main
 
 import (
 	"github.com/danielepagano/teleport-int-load-balancer/internal"
+	"github.com/danielepagano/teleport-int-load-balancer/internal/cluster"
 	"github.com/danielepagano/teleport-int-load-balancer/internal/security"
-	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
 	"log"
 	"os"
 	"os/signal"
+	"time"
 )
 
 func main() {
@@ -19,12 +20,123 @@ func main() {
 		// Ok to panic if security was requested, but could not be configured, as we can't do anything
 		log.Panicln("PANIC: error configuring security", err)
 	}
-	authz := security.NewAuthorizer(config.Clients)
+	var authz security.Authorizer
+	if config.AuthorizationWebhook != nil {
+		authz, err = security.NewWebhookAuthorizer(*config.AuthorizationWebhook)
+	} else {
+		authz, err = security.NewAuthorizer(security.AuthorizationPolicy{
+			Clients:     config.Clients,
+			Roles:       config.Roles,
+			ClientRoles: config.ClientRoles,
+			GroupRoles:  config.GroupRoles,
+		})
+	}
+	if err != nil {
+		log.Panicln("PANIC: error configuring authorization", err)
+	}
+
+	var identities *security.IdentityMapper
+	if len(config.IdentityRules) > 0 || config.StrictIdentityRules {
+		identities, err = security.NewIdentityMapper(config.IdentityRules, config.StrictIdentityRules)
+		if err != nil {
+			log.Panicln("PANIC: error configuring identity rules", err)
+		}
+	}
+
+	var bans security.BanManager
+	if config.BanConfig != nil {
+		bans, err = security.NewBanManager(*config.BanConfig)
+		if err != nil {
+			log.Panicln("PANIC: error configuring bans", err)
+		}
+	}
+
+	var stateFile *internal.RateLimitStateFile
+	stopSaving := make(chan struct{})
+	if config.RateLimitStatePath != "" {
+		stateFile, err = internal.LoadRateLimitStateFile(config.RateLimitStatePath)
+		if err != nil {
+			// Starting with empty windows would let clients get around rate limits by forcing a restart
+			log.Panicln("PANIC: error loading rate-limit state", err)
+		}
+		if config.RateLimitStateSaveSeconds > 0 {
+			go stateFile.AutoSave(time.Duration(config.RateLimitStateSaveSeconds)*time.Second, stopSaving)
+		}
+	}
+
+	var quotas *internal.ClientQuotas
+	if config.Quotas != nil {
+		quotas, err = internal.NewClientQuotas(*config.Quotas)
+		if err != nil {
+			log.Panicln("PANIC: error configuring quotas", err)
+		}
+		if stateFile != nil {
+			stateFile.RegisterQuotas(quotas)
+		}
+	}
+
+	var admission *internal.AdmissionController
+	if config.Admission != nil {
+		admission, err = internal.NewAdmissionController(*config.Admission)
+		if err != nil {
+			log.Panicln("PANIC: error configuring admission controller", err)
+		}
+		// Samples until the process exits
+		go admission.Start(nil)
+	}
+
+	// Settings shared by all apps
+	serverConfig := internal.ProxyServerConfig{
+		RateLimitConfig:         config.DefaultRateLimitConfig,
+		SourceRateLimitConfig:   config.SourceRateLimitConfig,
+		MaxConcurrentHandshakes: config.MaxConcurrentHandshakes,
+		HandshakeTimeoutSeconds: config.HandshakeTimeoutSeconds,
+		Authn:                   authn,
+		Authz:                   authz,
+		Identities:              identities,
+		Bans:                    bans,
+		StateFile:               stateFile,
+		Quotas:                  quotas,
+		ClientPriorities:        config.ClientPriorities,
+		Admission:               admission,
+	}
+
+	if config.Cluster != nil {
+		node, err := startClusterNode(*config.Cluster, authn)
+		if err != nil {
+			// Running standalone would multiply the effective limits by the number of instances
+			log.Panicln("PANIC: error configuring cluster", err)
+		}
+		serverConfig.RateLimitStore = cluster.NewRateLimitStore(node)
+		serverConfig.UpstreamLoadStore = cluster.NewUpstreamLoadStore(node)
+		serverConfig.ClusterMembers = node.Members()
+	}
 
+	servers := map[string]*internal.ProxyServer{}
 	for _, app := range config.Apps {
+		// Initialize and check configuration
+		serverConfig.App = app
+		server, err := internal.NewProxyServer(serverConfig)
+		if err != nil {
+			log.Println("ERROR - could not initialise server for", app.AppId, "ERROR:", err)
+			continue
+		}
+		servers[app.AppId] = server
 		// Async start each app; server will not panic if some apps fail to start (usually port busy)
 		// This would be a pretty loud alert in a real system
-		go startAppServer(app, config.DefaultRateLimitConfig, authn, authz)
+		go startAppServer(server)
+	}
+
+	if config.AdminAddress != "" {
+		go startAdminServer(internal.AdminServerConfig{
+			Address:    config.AdminAddress,
+			Authn:      authn,
+			Authz:      authz,
+			Identities: identities,
+			Bans:       bans,
+			Members:    serverConfig.ClusterMembers,
+			Servers:    servers,
+		})
 	}
 
 	// Wait until Ctrl-C or equivalent
@@ -32,28 +144,53 @@ func main() {
 	signal.Notify(sigInt, os.Interrupt)
 	<-sigInt
 
+	if stateFile != nil {
+		close(stopSaving)
+		if err = stateFile.Save(); err != nil {
+			log.Println("ERROR - could not save rate-limit state", "ERROR:", err)
+		}
+	}
+
 	log.Println("bye.")
 }
 
-func startAppServer(app internal.AppConfig, rateLimitConfig lbproxy.RateLimitManagerConfig,
-	authn security.Authenticator, authz security.Authorizer) {
-	serverConfig := internal.ProxyServerConfig{
-		App:             app,
-		RateLimitConfig: rateLimitConfig,
-		Authn:           authn,
-		Authz:           authz,
+func startAppServer(server *internal.ProxyServer) {
+	// Try and start server
+	err := server.Start()
+	if err != nil {
+		log.Println("ERROR - server failed to start for", server.App.AppId, "ERROR:", err)
 	}
+}
 
-	// Initialize and check configuration
-	server, err := internal.NewProxyServer(serverConfig)
+func startAdminServer(config internal.AdminServerConfig) {
+	server, err := internal.NewAdminServer(config)
 	if err != nil {
-		log.Println("ERROR - could not initialise server for", app.AppId, "ERROR:", err)
+		log.Println("ERROR - could not initialise admin server", "ERROR:", err)
 		return
 	}
-
-	// Try and start server
 	err = server.Start()
 	if err != nil {
-		log.Println("ERROR - server failed to start for", app.AppId, "ERROR:", err)
+		log.Println("ERROR - admin server failed to start", "ERROR:", err)
+	}
+}
+
+func startClusterNode(config cluster.Config, authn security.Authenticator) (*cluster.Node, error) {
+	serverTLS, clientTLS, err := security.NewPeerTLSConfigs(authn, config.AllowedPeerNames)
+	if err != nil {
+		return nil, err
+	}
+	node, err := cluster.NewNode(config, serverTLS, clientTLS)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := node.Listen()
+	if err != nil {
+		return nil, err
 	}
+	go func() {
+		// Going on without the cluster would multiply the effective limits, as for a failure to start
+		err := node.Serve(listener)
+		log.Panicln("PANIC: cluster node stopped", err)
+	}()
+	return node, nil
 }
@@ -1,3 +1,5 @@
 module github.com/danielepagano/teleport-int-load-balancer
 
 go 1.19
+
+require golang.org/x/crypto v0.9.0
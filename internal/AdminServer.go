@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/danielepagano/teleport-int-load-balancer/internal/cluster"
+	"github.com/danielepagano/teleport-int-load-balancer/internal/security"
+	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// AdminAppId is the app id clients must be authorized for to use the admin endpoints
+const AdminAppId = "admin"
+
+type AdminServerConfig struct {
+	Address    string // Address to listen on, e.g. "localhost:9900"
+	Authn      security.Authenticator
+	Authz      security.Authorizer
+	Identities *security.IdentityMapper // nil to keep authenticated ids
+	Bans       security.BanManager      // nil if bans are disabled
+	Members    *cluster.Membership      // nil for a standalone instance
+	Servers    map[string]*ProxyServer  // By app id
+}
+
+// AdminServer exposes operational endpoints over HTTPS, using the same mTLS setup as the proxied apps
+type AdminServer struct {
+	AdminServerConfig
+	mux *http.ServeMux
+}
+
+func NewAdminServer(config AdminServerConfig) (*AdminServer, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("admin server requires an address")
+	}
+	a := &AdminServer{
+		AdminServerConfig: config,
+		mux:               http.NewServeMux(),
+	}
+	// Counters published with expvar, e.g. shadow rate-limit denials
+	a.mux.Handle("/debug/vars", expvar.Handler())
+	if config.Bans != nil {
+		a.mux.HandleFunc("/bans", a.handleBans)
+	}
+	if len(config.Servers) > 0 {
+		a.mux.HandleFunc("/ratelimits", a.handleRateLimits)
+	}
+	if config.Members != nil {
+		a.mux.HandleFunc("/peers", a.handlePeers)
+	}
+	return a, nil
+}
+
+func (a *AdminServer) Start() error {
+	server := &http.Server{
+		Addr:              a.Address,
+		Handler:           a.authorized(a.mux),
+		TLSConfig:         a.Authn.GetCurrentTlsConfig(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	log.Println("STARTED ADMIN on", a.Address)
+	// Certificates come from TLSConfig
+	return server.ListenAndServeTLS("", "")
+}
+
+// authorized only lets through clients that are allowed to access AdminAppId
+func (a *AdminServer) authorized(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			http.Error(w, "connection was not TLS", http.StatusUnauthorized)
+			return
+		}
+		clientId, err := a.Authn.AuthenticateState(*r.TLS)
+		if err != nil {
+			log.Println("ADMIN Could not authenticate request from", r.RemoteAddr, "ERROR:", err)
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		identity, err := security.IdentifyClient(a.Identities, clientId, *r.TLS)
+		if err != nil {
+			log.Println("ADMIN Could not identify request from", r.RemoteAddr, "ERROR:", err)
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		// Unparseable addresses are outside any network, so they are only allowed by unrestricted grants
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		identity.SourceIP = net.ParseIP(host)
+		grant, err := a.Authz.AuthorizeClient(identity, AdminAppId)
+		if err == nil {
+			err = grant.CheckSource(identity.SourceIP)
+		}
+		if err != nil {
+			log.Println("ADMIN Could not authorize request from", r.RemoteAddr, "ERROR:", err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		log.Println("ADMIN", identity.ClientId, r.Method, r.URL)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleBans lists bans on GET, and clears them on DELETE; use ?kind=ip&key=<ip> to clear a single ban
+func (a *AdminServer) handleBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, a.Bans.ListBans())
+	case http.MethodDelete:
+		kind := security.BanKind(r.URL.Query().Get("kind"))
+		key := r.URL.Query().Get("key")
+		if kind == "" && key == "" {
+			a.Bans.ClearAll()
+		} else if !a.Bans.ClearBan(kind, key) {
+			http.Error(w, "ban not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRateLimits lists the client limits of each app on GET, and replaces those of one app on PUT ?app=<app id>,
+// with the new RateLimitManagerConfig as body; windows and open connections are kept
+// Add &policy=shadow or &policy=source to list or replace the shadow policy, or the limits of each source network
+func (a *AdminServer) handleRateLimits(w http.ResponseWriter, r *http.Request) {
+	policy := r.URL.Query().Get("policy")
+	if policy != "" && policy != "shadow" && policy != "source" {
+		http.Error(w, "unknown rate-limit policy", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		configs := map[string]lbproxy.RateLimitManagerConfig{}
+		for appId, server := range a.Servers {
+			switch policy {
+			case "shadow":
+				if config := server.CurrentShadowRateLimitConfig(); config != nil {
+					configs[appId] = *config
+				}
+			case "source":
+				if config := server.CurrentSourceRateLimitConfig(); config != nil {
+					configs[appId] = *config
+				}
+			default:
+				configs[appId] = server.CurrentRateLimitConfig()
+			}
+		}
+		writeJSON(w, configs)
+	case http.MethodPut:
+		server, found := a.Servers[r.URL.Query().Get("app")]
+		if !found {
+			http.Error(w, "app not found", http.StatusNotFound)
+			return
+		}
+		var config lbproxy.RateLimitManagerConfig
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			http.Error(w, "invalid rate-limit config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		update := server.UpdateRateLimitConfig
+		switch policy {
+		case "shadow":
+			update = server.UpdateShadowRateLimitConfig
+		case "source":
+			update = server.UpdateSourceRateLimitConfig
+		}
+		if err := update(config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePeers lists the other instances of the cluster; use ?all=true to include failed ones
+func (a *AdminServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Query().Get("all") == "true" {
+		writeJSON(w, a.Members.Members())
+	} else {
+		writeJSON(w, a.Members.LiveMembers())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println("ADMIN Failed to write response", "ERROR:", err)
+	}
+}
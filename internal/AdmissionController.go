@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"expvar"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// loadShed counts, by the resource under pressure, the connections rejected by the admission controller
+var loadShed = expvar.NewMap("lbproxy_load_shed")
+
+// AdmissionConfig sets the process resource thresholds past which new connections are rejected
+type AdmissionConfig struct {
+	MaxOpenFilesPercent int    // Share of the open files limit (RLIMIT_NOFILE) in use; 0 to disable
+	MaxGoroutines       int    // Goroutines running in the process; 0 to disable
+	MaxHeapBytes        uint64 // Bytes allocated on the heap; 0 to disable
+	LowPriorityPercent  int    // Pressure, as a share of the thresholds, at which clients of priority 0 or less are shed; 0 to disable
+	SampleMillis        int64  // How often heap and open files are sampled, as they are too costly to check on every connection
+}
+
+// resourceSample is the resource usage of the process at some point in time
+type resourceSample struct {
+	OpenFiles    int // -1 if not supported on this platform
+	MaxOpenFiles int // -1 if not supported on this platform
+	Goroutines   int
+	HeapBytes    uint64
+}
+
+// AdmissionController rejects new connections early when the process is running out of resources,
+// rather than accepting connections it cannot serve. It is shared by all apps, as they share the process
+type AdmissionController struct {
+	config  AdmissionConfig
+	sample  atomic.Pointer[resourceSample] // Latest sample
+	sampler func() resourceSample
+}
+
+func NewAdmissionController(config AdmissionConfig) (*AdmissionController, error) {
+	if config.MaxOpenFilesPercent < 0 || config.MaxOpenFilesPercent > 100 ||
+		config.LowPriorityPercent < 0 || config.LowPriorityPercent > 100 {
+		return nil, fmt.Errorf("admission thresholds must be between 0 and 100 percent")
+	}
+	if config.SampleMillis <= 0 {
+		return nil, fmt.Errorf("admission controller requires a positive sample interval")
+	}
+	a := &AdmissionController{config: config, sampler: sampleResources}
+	a.Sample()
+	return a, nil
+}
+
+// Start samples resource usage every SampleMillis until stop is closed
+func (a *AdmissionController) Start(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(a.config.SampleMillis) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.Sample()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Sample refreshes the resource usage the controller decides on
+func (a *AdmissionController) Sample() {
+	sample := a.sampler()
+	a.sample.Store(&sample)
+}
+
+// Admit checks the pressure on the process before the handshake, where the client is unknown,
+// so it only rejects connections when a threshold is crossed
+func (a *AdmissionController) Admit() error {
+	return a.admit(100)
+}
+
+// AdmitClient checks the pressure on the process once the client is known; clients of priority 0 or less
+// are rejected from LowPriorityPercent of the thresholds, so that they are shed before the others
+func (a *AdmissionController) AdmitClient(priority ClientPriority) error {
+	if priority.Priority <= 0 && a.config.LowPriorityPercent > 0 {
+		return a.admit(a.config.LowPriorityPercent)
+	}
+	return a.admit(100)
+}
+
+// admit rejects connections when any resource is at percent or more of its threshold
+func (a *AdmissionController) admit(percent int) error {
+	resource, pressure := a.pressure()
+	if pressure < percent {
+		return nil
+	}
+	loadShed.Add(resource, 1)
+	return fmt.Errorf("shedding load, %s at %d%% of threshold", resource, pressure)
+}
+
+// pressure returns the resource closest to (or furthest past) its threshold, and how close as a percentage
+func (a *AdmissionController) pressure() (string, int) {
+	sample := *a.sample.Load()
+	// Goroutines change quickly and are cheap to count, so they are always current
+	sample.Goroutines = runtime.NumGoroutine()
+
+	resource, pressure := "", 0
+	check := func(name string, used, threshold uint64) {
+		if threshold == 0 {
+			return
+		}
+		if p := int(used * 100 / threshold); p > pressure || resource == "" {
+			resource, pressure = name, p
+		}
+	}
+	if a.config.MaxOpenFilesPercent > 0 && sample.MaxOpenFiles > 0 && sample.OpenFiles >= 0 {
+		check("open-files", uint64(sample.OpenFiles)*100, uint64(sample.MaxOpenFiles*a.config.MaxOpenFilesPercent))
+	}
+	if a.config.MaxGoroutines > 0 {
+		check("goroutines", uint64(sample.Goroutines), uint64(a.config.MaxGoroutines))
+	}
+	check("heap", sample.HeapBytes, a.config.MaxHeapBytes)
+	return resource, pressure
+}
+
+func sampleResources() resourceSample {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	openFiles, maxOpenFiles := countOpenFiles()
+	return resourceSample{
+		OpenFiles:    openFiles,
+		MaxOpenFiles: maxOpenFiles,
+		Goroutines:   runtime.NumGoroutine(),
+		HeapBytes:    mem.HeapAlloc,
+	}
+}
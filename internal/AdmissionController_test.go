@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"runtime"
+	"testing"
+)
+
+func Test_AdmissionController(t *testing.T) {
+	a, err := NewAdmissionController(AdmissionConfig{
+		MaxOpenFilesPercent: 50,
+		MaxHeapBytes:        1000,
+		LowPriorityPercent:  80,
+		SampleMillis:        1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	high := ClientPriority{Priority: 1}
+	low := ClientPriority{}
+
+	tests := []struct {
+		name      string
+		sample    resourceSample
+		wantAdmit bool
+		wantHigh  bool
+		wantLow   bool
+	}{
+		{"idle", resourceSample{OpenFiles: 10, MaxOpenFiles: 1000, HeapBytes: 100}, true, true, true},
+		// 85% of the heap threshold: only low-priority clients are shed
+		{"heapPressure", resourceSample{OpenFiles: 10, MaxOpenFiles: 1000, HeapBytes: 850}, true, true, false},
+		// 450 of 1000 files is 90% of the 50% threshold
+		{"filePressure", resourceSample{OpenFiles: 450, MaxOpenFiles: 1000, HeapBytes: 100}, true, true, false},
+		{"filesExhausted", resourceSample{OpenFiles: 500, MaxOpenFiles: 1000, HeapBytes: 100}, false, false, false},
+		{"filesUnsupported", resourceSample{OpenFiles: -1, MaxOpenFiles: -1, HeapBytes: 100}, true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sample := tt.sample
+			a.sampler = func() resourceSample { return sample }
+			a.Sample()
+			if err := a.Admit(); (err == nil) != tt.wantAdmit {
+				t.Errorf("Admit() = %v, want admitted %v", err, tt.wantAdmit)
+			}
+			if err := a.AdmitClient(high); (err == nil) != tt.wantHigh {
+				t.Errorf("AdmitClient(high) = %v, want admitted %v", err, tt.wantHigh)
+			}
+			if err := a.AdmitClient(low); (err == nil) != tt.wantLow {
+				t.Errorf("AdmitClient(low) = %v, want admitted %v", err, tt.wantLow)
+			}
+		})
+	}
+
+	t.Run("goroutines", func(t *testing.T) {
+		a, _ := NewAdmissionController(AdmissionConfig{MaxGoroutines: runtime.NumGoroutine(), SampleMillis: 1000})
+		if err := a.Admit(); err == nil {
+			t.Errorf("Admit() with goroutines at threshold = nil, want error")
+		}
+	})
+}
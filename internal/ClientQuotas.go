@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
+	"log"
+	"sync"
+)
+
+// quotaWarnings counts, by client id, the quota warnings fired
+var quotaWarnings = expvar.NewMap("lbproxy_quota_warnings")
+
+// QuotaConfig sets the long-period quotas of clients, e.g. for billing
+type QuotaConfig struct {
+	Default *lbproxy.QuotaConfig           // Quota of clients without one of their own; nil for no quota
+	Clients map[string]lbproxy.QuotaConfig // Quotas by client id
+}
+
+// ClientQuotas holds one quota manager per client, shared by all apps, so that quotas cover total usage
+type ClientQuotas struct {
+	QuotaConfig
+	lock     sync.Mutex
+	managers map[string]lbproxy.PersistentRateLimitManager
+	restored map[string]lbproxy.RateLimitSnapshot // State loaded at startup, handed to each manager when created
+}
+
+func NewClientQuotas(config QuotaConfig) (*ClientQuotas, error) {
+	// Catch configuration errors at startup, rather than on the first connection of a client
+	if config.Default != nil {
+		if _, err := lbproxy.CreateQuotaManager("default", *config.Default, nil); err != nil {
+			return nil, err
+		}
+	}
+	for clientId, clientConfig := range config.Clients {
+		if _, err := lbproxy.CreateQuotaManager(clientId, clientConfig, nil); err != nil {
+			return nil, fmt.Errorf("invalid quota for client %s. %w", clientId, err)
+		}
+	}
+	return &ClientQuotas{
+		QuotaConfig: config,
+		managers:    map[string]lbproxy.PersistentRateLimitManager{},
+		restored:    map[string]lbproxy.RateLimitSnapshot{},
+	}, nil
+}
+
+// sharedQuota is the quota manager of a client as stacked by each app: the usage is saved and restored once,
+// by ClientQuotas, so it is not persisted with the rate limits of every app
+type sharedQuota struct {
+	lbproxy.CancelableRateLimitManager
+}
+
+// Get returns the quota manager of a client, or nil if the client has no quota
+func (q *ClientQuotas) Get(clientId string) lbproxy.RateLimitManager {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if qm, found := q.managers[clientId]; found {
+		return sharedQuota{qm.(lbproxy.CancelableRateLimitManager)}
+	}
+	config, found := q.Clients[clientId]
+	if !found {
+		if q.Default == nil {
+			return nil
+		}
+		config = *q.Default
+	}
+	qm, err := lbproxy.CreateQuotaManager(clientId, config, onQuotaWarning)
+	if err != nil {
+		// Unreachable, as configurations were validated on creation
+		log.Panicln("PANIC: invalid quota for client", clientId, err)
+	}
+	if snapshot, found := q.restored[clientId]; found {
+		qm.Restore(snapshot)
+		delete(q.restored, clientId)
+	}
+	q.managers[clientId] = qm
+	return sharedQuota{qm}
+}
+
+func (q *ClientQuotas) snapshot() map[string]lbproxy.RateLimitSnapshot {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	snapshots := map[string]lbproxy.RateLimitSnapshot{}
+	// Clients that have not connected (yet) keep their restored usage
+	for clientId, snapshot := range q.restored {
+		snapshots[clientId] = snapshot
+	}
+	for clientId, qm := range q.managers {
+		snapshots[clientId] = qm.Snapshot()
+	}
+	return snapshots
+}
+
+func (q *ClientQuotas) restore(snapshots map[string]lbproxy.RateLimitSnapshot) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for clientId, snapshot := range snapshots {
+		if qm, found := q.managers[clientId]; found {
+			qm.Restore(snapshot)
+		} else {
+			q.restored[clientId] = snapshot
+		}
+	}
+}
+
+// onQuotaWarning publishes quota warnings; lbproxy already logs them
+func onQuotaWarning(clientId string, _ lbproxy.RateLimitTrigger, _ lbproxy.QuotaUsage, _ lbproxy.QuotaConfig) {
+	quotaWarnings.Add(clientId, 1)
+}
@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"container/list"
+	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
+	"log"
+	"sync"
+	"time"
+)
+
+// CapacityConfig caps the connections of an app across all of its clients
+type CapacityConfig struct {
+	MaxOpenConnections int   // How many connections the app keeps open across all clients
+	MaxQueueDepth      int   // How many connections can wait for capacity across all clients, shared fairly; 0 to deny right away
+	MaxQueueWaitMillis int64 // How long a queued connection waits for capacity before being denied
+}
+
+// ClientPriority sets how a client competes with others for shared capacity
+type ClientPriority struct {
+	Priority int // Clients of a higher priority are admitted first, and shed last; 0 by default
+	Weight   int // Share of capacity relative to other clients of the same priority; 1 by default
+}
+
+// defaultClientPriority applies to clients without a configured priority
+var defaultClientPriority = ClientPriority{Weight: 1}
+
+// fairAdmission shares the capacity of an app between clients: when the app is full, connections wait in
+// per-client queues, and each freed slot goes to the waiting client of the highest priority that holds the
+// smallest share of open connections relative to its weight. This way a client that reconnects quickly
+// cannot starve the others, as it only competes for its own share; when the queue is full, it also gives up
+// its waiting connections to clients holding a smaller share
+type fairAdmission struct {
+	lock       sync.Mutex
+	tag        string
+	config     CapacityConfig
+	priorities map[string]ClientPriority
+	open       map[string]int        // Open connections by client
+	totalOpen  int                   // Open connections across all clients
+	waiting    map[string]*list.List // FIFO of *fairWaiter by client
+	queued     int                   // Waiting connections across all clients
+	arrivals   uint64                // Sequence number of the last waiter, to break ties in arrival order
+}
+
+// fairWaiter is a connection waiting for capacity
+type fairWaiter struct {
+	arrival  uint64
+	ready    chan struct{} // Closed when admitted or evicted
+	admitted bool          // Guarded by the fairAdmission lock
+	evicted  bool          // Removed from the full queue to make room for another client; guarded by the fairAdmission lock
+}
+
+func newFairAdmission(tag string, config CapacityConfig, priorities map[string]ClientPriority) *fairAdmission {
+	return &fairAdmission{
+		tag:        tag,
+		config:     config,
+		priorities: priorities,
+		open:       map[string]int{},
+		waiting:    map[string]*list.List{},
+	}
+}
+
+// forClient returns a RateLimitManager that admits the connections of one client, to be stacked with its own limits
+func (f *fairAdmission) forClient(clientId string) lbproxy.RateLimitManager {
+	return &clientAdmission{f, clientId}
+}
+
+type clientAdmission struct {
+	admission *fairAdmission
+	clientId  string
+}
+
+func (c *clientAdmission) AddConnection() lbproxy.RateLimitDecision {
+	return c.admission.acquire(c.clientId)
+}
+
+func (c *clientAdmission) ReleaseConnection() {
+	c.admission.release(c.clientId)
+}
+
+// RecordTransfer is a no-op, as capacity is only shared by connections
+func (c *clientAdmission) RecordTransfer(int64) {}
+
+func (f *fairAdmission) acquire(clientId string) lbproxy.RateLimitDecision {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// Waiting connections go first, so only admit right away when nobody is queued
+	if f.queued == 0 && f.totalOpen < f.config.MaxOpenConnections {
+		f.admit(clientId)
+		return f.decision(lbproxy.RateLimitAllowed, lbproxy.TriggerNone, 0)
+	}
+	if f.config.MaxQueueDepth <= 0 {
+		decision := f.decision(lbproxy.RateLimitDenied, lbproxy.TriggerMaxOpen, f.config.MaxOpenConnections)
+		log.Println("CAPACITY", f.tag, "DENIED", clientId, decision)
+		return decision
+	}
+	if f.queued >= f.config.MaxQueueDepth && !f.evict(clientId) {
+		decision := f.decision(lbproxy.RateLimitDenied, lbproxy.TriggerQueueFull, f.config.MaxQueueDepth)
+		log.Println("CAPACITY", f.tag, "DENIED", clientId, decision)
+		return decision
+	}
+
+	f.arrivals++
+	waiter := &fairWaiter{arrival: f.arrivals, ready: make(chan struct{})}
+	queue, found := f.waiting[clientId]
+	if !found {
+		queue = list.New()
+		f.waiting[clientId] = queue
+	}
+	element := queue.PushBack(waiter)
+	f.queued++
+
+	started := time.Now()
+	deadline := time.NewTimer(time.Duration(f.config.MaxQueueWaitMillis) * time.Millisecond)
+	defer deadline.Stop()
+	f.lock.Unlock()
+	select {
+	case <-waiter.ready:
+	case <-deadline.C:
+	}
+	f.lock.Lock()
+
+	// The waiter may have been admitted right as the deadline fired
+	if waiter.admitted {
+		decision := f.decision(lbproxy.RateLimitAllowed, lbproxy.TriggerNone, 0)
+		decision.Waited = time.Since(started)
+		return decision
+	}
+	trigger, limit := lbproxy.TriggerQueueFull, f.config.MaxQueueDepth
+	if !waiter.evicted {
+		f.removeWaiter(clientId, queue, element)
+		trigger, limit = lbproxy.TriggerQueueTimeout, 0
+	}
+	decision := f.decision(lbproxy.RateLimitDenied, trigger, limit)
+	decision.Waited = time.Since(started)
+	log.Println("CAPACITY", f.tag, "DENIED", clientId, decision)
+	return decision
+}
+
+func (f *fairAdmission) release(clientId string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.open[clientId] > 0 {
+		f.open[clientId]--
+		f.totalOpen--
+	}
+	if f.open[clientId] == 0 {
+		delete(f.open, clientId)
+	}
+	f.dispatch()
+}
+
+// dispatch hands free slots to waiting connections, in fair order
+// Must be called holding the lock
+func (f *fairAdmission) dispatch() {
+	for f.queued > 0 && f.totalOpen < f.config.MaxOpenConnections {
+		clientId := f.nextClient()
+		queue := f.waiting[clientId]
+		element := queue.Front()
+		waiter := element.Value.(*fairWaiter)
+		f.removeWaiter(clientId, queue, element)
+		f.admit(clientId)
+		waiter.admitted = true
+		close(waiter.ready)
+	}
+}
+
+// nextClient picks the waiting client that should get the next slot
+// Must be called holding the lock, with at least one connection waiting
+func (f *fairAdmission) nextClient() string {
+	var next string
+	var nextPriority ClientPriority
+	var nextArrival uint64
+	for clientId, queue := range f.waiting {
+		priority := priorityOf(f.priorities, clientId)
+		arrival := queue.Front().Value.(*fairWaiter).arrival
+		if next == "" || priority.Priority > nextPriority.Priority {
+			next, nextPriority, nextArrival = clientId, priority, arrival
+			continue
+		}
+		if priority.Priority < nextPriority.Priority {
+			continue
+		}
+		// Compare open/weight shares without dividing: a/b < c/d <=> a*d < c*b for positive weights
+		share := f.open[clientId] * nextPriority.Weight
+		nextShare := f.open[next] * priority.Weight
+		if share < nextShare || (share == nextShare && arrival < nextArrival) {
+			next, nextPriority, nextArrival = clientId, priority, arrival
+		}
+	}
+	return next
+}
+
+// evict makes room in the full queue for a connection of clientId, by denying the newest waiting connection of
+// the client furthest over its share: of the lowest priority, and with the most connections, open or waiting,
+// relative to its weight. Returns false if that client would be clientId itself, counting the new connection
+// Must be called holding the lock, with at least one connection waiting
+func (f *fairAdmission) evict(clientId string) bool {
+	var victim string
+	var victimPriority ClientPriority
+	var victimShare int
+	for other, queue := range f.waiting {
+		priority := priorityOf(f.priorities, other)
+		share := f.open[other] + queue.Len()
+		// Compare shares without dividing, as in nextClient
+		if victim == "" || priority.Priority < victimPriority.Priority ||
+			(priority.Priority == victimPriority.Priority && share*victimPriority.Weight > victimShare*priority.Weight) {
+			victim, victimPriority, victimShare = other, priority, share
+		}
+	}
+	priority := priorityOf(f.priorities, clientId)
+	share := f.open[clientId] + 1
+	if queue, found := f.waiting[clientId]; found {
+		share += queue.Len()
+	}
+	if victim == clientId || victimPriority.Priority > priority.Priority ||
+		(victimPriority.Priority == priority.Priority && victimShare*priority.Weight <= share*victimPriority.Weight) {
+		return false
+	}
+	queue := f.waiting[victim]
+	element := queue.Back()
+	waiter := element.Value.(*fairWaiter)
+	f.removeWaiter(victim, queue, element)
+	waiter.evicted = true
+	close(waiter.ready)
+	log.Println("CAPACITY", f.tag, "EVICTED a waiting connection of", victim, "for", clientId)
+	return true
+}
+
+// Must be called holding the lock
+func (f *fairAdmission) admit(clientId string) {
+	f.open[clientId]++
+	f.totalOpen++
+}
+
+// Must be called holding the lock
+func (f *fairAdmission) removeWaiter(clientId string, queue *list.List, element *list.Element) {
+	queue.Remove(element)
+	f.queued--
+	if queue.Len() == 0 {
+		delete(f.waiting, clientId)
+	}
+}
+
+// priorityOf returns the configured priority of a client, with defaults applied
+func priorityOf(priorities map[string]ClientPriority, clientId string) ClientPriority {
+	priority, found := priorities[clientId]
+	if !found {
+		return defaultClientPriority
+	}
+	if priority.Weight <= 0 {
+		priority.Weight = defaultClientPriority.Weight
+	}
+	return priority
+}
+
+// Must be called holding the lock
+func (f *fairAdmission) decision(outcome lbproxy.RateLimitOutcome, trigger lbproxy.RateLimitTrigger, limit int) lbproxy.RateLimitDecision {
+	return lbproxy.RateLimitDecision{
+		Outcome:         outcome,
+		Trigger:         trigger,
+		OpenConnections: f.totalOpen,
+		Limit:           limit,
+	}
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
+	"testing"
+	"time"
+)
+
+func Test_fairAdmission(t *testing.T) {
+	t.Run("noisyClient", func(t *testing.T) {
+		f := newFairAdmission("ut", CapacityConfig{MaxOpenConnections: 2, MaxQueueDepth: 10, MaxQueueWaitMillis: 5000}, nil)
+		noisy, quiet := f.forClient("noisy"), f.forClient("quiet")
+		noisy.AddConnection()
+		noisy.AddConnection()
+
+		// The noisy client queues first, but the quiet one holds no connection, so it goes first
+		admitted := make(chan string, 4)
+		for i := 0; i < 3; i++ {
+			go addAndReport(noisy, "noisy", admitted)
+		}
+		waitForQueued(t, f, 3)
+		go addAndReport(quiet, "quiet", admitted)
+		waitForQueued(t, f, 4)
+
+		noisy.ReleaseConnection()
+		if got := <-admitted; got != "quiet" {
+			t.Errorf("first admitted = %v, want quiet", got)
+		}
+		noisy.ReleaseConnection()
+		if got := <-admitted; got != "noisy" {
+			t.Errorf("second admitted = %v, want noisy", got)
+		}
+	})
+
+	t.Run("priorityAndWeight", func(t *testing.T) {
+		priorities := map[string]ClientPriority{"gold": {Priority: 1}, "heavy": {Weight: 3}}
+		f := newFairAdmission("ut", CapacityConfig{MaxOpenConnections: 4, MaxQueueDepth: 10, MaxQueueWaitMillis: 5000}, priorities)
+		light, heavy := f.forClient("light"), f.forClient("heavy")
+		light.AddConnection()
+		heavy.AddConnection()
+		heavy.AddConnection()
+		heavy.AddConnection()
+
+		admitted := make(chan string, 4)
+		go addAndReport(light, "light", admitted)
+		waitForQueued(t, f, 1)
+		go addAndReport(heavy, "heavy", admitted)
+		waitForQueued(t, f, 2)
+		go addAndReport(f.forClient("gold"), "gold", admitted)
+		waitForQueued(t, f, 3)
+
+		// Gold has a higher priority; then heavy holds less than its share (1 of 3, against 1 of 1 for light),
+		// so it goes before light, although it queued later
+		want := []string{"gold", "heavy", "light"}
+		for _, w := range want {
+			heavy.ReleaseConnection()
+			if got := <-admitted; got != w {
+				t.Errorf("admitted = %v, want %v", got, w)
+			}
+		}
+	})
+
+	t.Run("queueFull", func(t *testing.T) {
+		f := newFairAdmission("ut", CapacityConfig{MaxOpenConnections: 1}, nil)
+		rlm := f.forClient("one")
+		if !rlm.AddConnection().Allowed() {
+			t.Fatalf("first connection denied")
+		}
+		if d := rlm.AddConnection(); d.Allowed() || d.Trigger != lbproxy.TriggerMaxOpen {
+			t.Errorf("second decision = %v, want denied by %v", d, lbproxy.TriggerMaxOpen)
+		}
+	})
+
+	t.Run("noisyClientFillsQueue", func(t *testing.T) {
+		f := newFairAdmission("ut", CapacityConfig{MaxOpenConnections: 2, MaxQueueDepth: 3, MaxQueueWaitMillis: 5000}, nil)
+		noisy, quiet := f.forClient("noisy"), f.forClient("quiet")
+		noisy.AddConnection()
+		noisy.AddConnection()
+
+		// The noisy client takes every slot of the queue, and cannot push itself further
+		admitted := make(chan string, 4)
+		for i := 0; i < 3; i++ {
+			go addAndReport(noisy, "noisy", admitted)
+		}
+		waitForQueued(t, f, 3)
+		if d := noisy.AddConnection(); d.Allowed() || d.Trigger != lbproxy.TriggerQueueFull {
+			t.Errorf("noisy decision with a full queue = %v, want denied by %v", d, lbproxy.TriggerQueueFull)
+		}
+
+		// The quiet client takes the place of the newest noisy connection, which is denied
+		go addAndReport(quiet, "quiet", admitted)
+		for i := 0; i < 1000 && queuedOf(f, "quiet") == 0; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if n := queuedOf(f, "noisy"); n != 2 {
+			t.Fatalf("noisy connections queued = %v, want 2 after one made room for quiet", n)
+		}
+		noisy.ReleaseConnection()
+		if got := <-admitted; got != "quiet" {
+			t.Errorf("first admitted = %v, want quiet", got)
+		}
+		quiet.ReleaseConnection()
+		noisy.ReleaseConnection()
+		for i := 0; i < 2; i++ {
+			if got := <-admitted; got != "noisy" {
+				t.Errorf("admitted = %v, want noisy", got)
+			}
+		}
+		if queued(f) != 0 {
+			t.Errorf("queued after admitting all = %v, want 0", queued(f))
+		}
+	})
+
+	t.Run("queueTimeout", func(t *testing.T) {
+		f := newFairAdmission("ut", CapacityConfig{MaxOpenConnections: 1, MaxQueueDepth: 1, MaxQueueWaitMillis: 10}, nil)
+		rlm := f.forClient("one")
+		rlm.AddConnection()
+		if d := rlm.AddConnection(); d.Allowed() || d.Trigger != lbproxy.TriggerQueueTimeout {
+			t.Errorf("queued decision = %v, want denied by %v", d, lbproxy.TriggerQueueTimeout)
+		}
+		if queued(f) != 0 {
+			t.Errorf("queued after timeout = %v, want 0", queued(f))
+		}
+	})
+}
+
+func addAndReport(rlm lbproxy.RateLimitManager, name string, admitted chan<- string) {
+	if rlm.AddConnection().Allowed() {
+		admitted <- name
+	}
+}
+
+func queued(f *fairAdmission) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.queued
+}
+
+func queuedOf(f *fairAdmission, clientId string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if queue, found := f.waiting[clientId]; found {
+		return queue.Len()
+	}
+	return 0
+}
+
+func waitForQueued(t *testing.T, f *fairAdmission, count int) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		if queued(f) == count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("queued connections did not reach %v", count)
+}
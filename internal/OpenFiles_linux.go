@@ -0,0 +1,28 @@
+//go:build linux
+
+package internal
+
+import (
+	"math"
+	"os"
+	"syscall"
+)
+
+// countOpenFiles returns the number of file descriptors open in the process, and the limit (RLIMIT_NOFILE)
+func countOpenFiles() (int, int) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return -1, -1
+	}
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1, -1
+	}
+	// The directory itself was open while reading it
+	openFiles := len(entries) - 1
+	if limit.Cur > math.MaxInt32 {
+		// Unlimited, for all intents and purposes
+		return openFiles, -1
+	}
+	return openFiles, int(limit.Cur)
+}
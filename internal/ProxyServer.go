@@ -4,41 +4,105 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"github.com/danielepagano/teleport-int-load-balancer/internal/cluster"
 	"github.com/danielepagano/teleport-int-load-balancer/internal/security"
 	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
 	"log"
 	"net"
+	"reflect"
 	"sync"
+	"time"
 )
 
 const localServerPrefix = ":"
 
+// minSourceSweep is the number of source networks tracked before idle ones are first evicted
+const minSourceSweep = 1024
+
 type ProxyServerConfig struct {
-	App             AppConfig
-	RateLimitConfig lbproxy.RateLimitManagerConfig
-	Authn           security.Authenticator
-	Authz           security.Authorizer
+	App                     AppConfig
+	RateLimitConfig         lbproxy.RateLimitManagerConfig
+	SourceRateLimitConfig   *SourceRateLimitConfig // nil to remove checks
+	MaxConcurrentHandshakes int                    // -1 to remove checks
+	HandshakeTimeoutSeconds int64                  // 0 for no timeout
+	Authn                   security.Authenticator
+	Authz                   security.Authorizer
+	Identities              *security.IdentityMapper  // Maps certificates to logical client ids and groups; nil to keep authenticated ids
+	Bans                    security.BanManager       // Shared across apps; nil to disable bans
+	StateFile               *RateLimitStateFile       // Shared across apps; nil to not persist rate limits
+	RateLimitStore          lbproxy.RateLimitStore    // Store for client rate limits, e.g. shared by a cluster; nil for in-memory
+	UpstreamLoadStore       lbproxy.UpstreamLoadStore // Upstream connections of other instances; nil for standalone
+	ClusterMembers          *cluster.Membership       // Other instances of the cluster; nil for standalone
+	Quotas                  *ClientQuotas             // Shared across apps; nil to disable quotas
+	ClientPriorities        map[string]ClientPriority // How clients compete for the capacity of the app, by client id
+	Admission               *AdmissionController      // Sheds load under resource pressure; shared across apps, nil to disable
 }
 
 type ProxyServer struct {
 	ProxyServerConfig
-	rateManagersLock sync.RWMutex
-	rateManagers     map[string]lbproxy.RateLimitManager
+	rateManagersLock   sync.RWMutex
+	rateManagers       map[string]lbproxy.RateLimitManager
+	clientLimits       map[string]lbproxy.ConfigurableRateLimitManager // Enforced client limits, within rateManagers
+	shadowLimits       map[string]lbproxy.ConfigurableRateLimitManager // Shadow policies of clients, within rateManagers
+	rateLimitOverrides map[string]lbproxy.RateLimitManagerConfig       // Client limits set by grants, by client id; guarded by rateManagersLock
+	sourceRateManagers map[string]lbproxy.RateLimitManager             // Guarded by rateManagersLock as well
+	sourceSweepAt      int                                             // Number of source managers at which idle ones are evicted
+	handshakeSlots     chan struct{}                                   // Semaphore capping concurrent handshakes; nil if uncapped
+	capacity           *fairAdmission                                  // Shares the capacity of the app between clients; nil if uncapped
+	liveConnsLock      sync.Mutex
+	liveConns          map[*tls.Conn]string // Client id of proxied connections, to terminate them on revocation
+	sourceNetworks     []*net.IPNet         // Networks clients may connect from; empty for anywhere
 }
 
 func NewProxyServer(config ProxyServerConfig) (*ProxyServer, error) {
-	if config.RateLimitConfig.MaxOpenConnections == 0 ||
-		config.RateLimitConfig.MaxRateAmount == 0 {
-		return nil, fmt.Errorf("application has zero allowed rate")
+	if err := validateRateLimitConfig(config.RateLimitConfig); err != nil {
+		return nil, err
+	}
+	if shadow := config.App.ShadowRateLimitConfig; shadow != nil {
+		if err := lbproxy.ValidateLimits(*shadow); err != nil {
+			return nil, fmt.Errorf("shadow rate limit: %w", err)
+		}
 	}
 	if len(config.App.Upstreams) == 0 {
 		return nil, fmt.Errorf("at least one upstream per app is required")
 	}
+	if src := config.SourceRateLimitConfig; src != nil {
+		if err := validateSourceRateLimitConfig(src.RateLimit); err != nil {
+			return nil, err
+		}
+		if src.IPv4PrefixLen < 0 || src.IPv4PrefixLen > 32 || src.IPv6PrefixLen < 0 || src.IPv6PrefixLen > 128 {
+			return nil, fmt.Errorf("invalid source network prefix length")
+		}
+	}
+	if config.MaxConcurrentHandshakes == 0 {
+		return nil, fmt.Errorf("application allows zero concurrent handshakes")
+	}
+	if capacity := config.App.Capacity; capacity != nil && capacity.MaxOpenConnections <= 0 {
+		return nil, fmt.Errorf("application has zero capacity")
+	}
+	sourceNetworks, err := security.ParseNetworks(config.App.SourceNetworks)
+	if err != nil {
+		return nil, err
+	}
 
-	return &ProxyServer{
-		ProxyServerConfig: config,
-		rateManagers:      make(map[string]lbproxy.RateLimitManager),
-	}, nil
+	server := &ProxyServer{
+		ProxyServerConfig:  config,
+		rateManagers:       make(map[string]lbproxy.RateLimitManager),
+		clientLimits:       make(map[string]lbproxy.ConfigurableRateLimitManager),
+		shadowLimits:       make(map[string]lbproxy.ConfigurableRateLimitManager),
+		rateLimitOverrides: make(map[string]lbproxy.RateLimitManagerConfig),
+		sourceRateManagers: make(map[string]lbproxy.RateLimitManager),
+		sourceSweepAt:      minSourceSweep,
+		liveConns:          make(map[*tls.Conn]string),
+		sourceNetworks:     sourceNetworks,
+	}
+	if config.MaxConcurrentHandshakes > 0 {
+		server.handshakeSlots = make(chan struct{}, config.MaxConcurrentHandshakes)
+	}
+	if config.App.Capacity != nil {
+		server.capacity = newFairAdmission(config.App.AppId, *config.App.Capacity, config.ClientPriorities)
+	}
+	return server, nil
 }
 
 func (s *ProxyServer) Start() error {
@@ -49,12 +113,23 @@ func (s *ProxyServer) Start() error {
 	defer s.closeListener(listener)
 
 	// Creates the application that will proxy and load-balance the incoming traffic
-	lbProxyApp := lbproxy.InitApplication(s.App.ToApplicationConfig())
+	appConfig := s.App.ToApplicationConfig()
+	appConfig.LoadStore = s.UpstreamLoadStore
+	lbProxyApp := lbproxy.InitApplication(appConfig)
 	log.Println("STARTED APP", s.App.AppId, "on port", s.App.ProxyPort)
+	if s.ClusterMembers != nil {
+		log.Println("APP", s.App.AppId, "is part of a cluster; live peers:", len(s.ClusterMembers.LiveMembers()))
+	}
+
+	s.Authn.OnRevocationsChanged(s.closeRevokedConnections)
+
+	// Pick up rate-limit windows saved before a restart, and keep them saved from now on
+	if s.StateFile != nil {
+		s.StateFile.Register(s)
+	}
 
 	// Listen loop
-	// Currently we accept connections from a single thread per app,
-	// so no need worry about concurrent access to the rateManagers map
+	// Currently we accept connections from a single thread per app
 	// A possible optimization could be to perform some of this work in a goroutine
 	for {
 		conn, err := listener.Accept()
@@ -65,52 +140,505 @@ func (s *ProxyServer) Start() error {
 			if errors.Is(err, net.ErrClosed) {
 				return err
 			}
+		} else if sourceRlm, admitted := s.admitConnection(conn); admitted {
+			go s.authorizeAndHandoffConnection(lbProxyApp, conn, sourceRlm)
 		} else {
-			go s.authorizeAndHandoffConnection(lbProxyApp, conn)
+			s.closeDeniedConnection(conn)
 		}
 	}
 }
 
-func (s *ProxyServer) authorizeAndHandoffConnection(lbProxyApp lbproxy.Application, conn net.Conn) {
-	clientId, err := s.ensureSecured(conn)
+// admitConnection runs the cheap checks that happen before the TLS handshake, so that unauthenticated clients
+// cannot burn CPU. If admitted, the connection holds a handshake slot and the returned source RateLimitManager (if any)
+func (s *ProxyServer) admitConnection(conn net.Conn) (lbproxy.RateLimitManager, bool) {
+	if s.Admission != nil {
+		if err := s.Admission.Admit(); err != nil {
+			log.Println("APP", s.App.AppId, "SHED connection from", conn.RemoteAddr(), "ERROR:", err)
+			return nil, false
+		}
+	}
+	if s.Bans != nil {
+		if ip, err := sourceIP(conn.RemoteAddr()); err == nil {
+			if ban, banned := s.Bans.SourceBan(ip); banned {
+				log.Println("APP", s.App.AppId, "Denied connection from banned source", conn.RemoteAddr(), "until", ban.Until)
+				return nil, false
+			}
+		}
+	}
+	sourceRlm, admitted := s.admitSource(conn)
+	if !admitted {
+		return nil, false
+	}
+	if !s.acquireHandshakeSlot() {
+		log.Println("APP", s.App.AppId, "Too many concurrent handshakes, denied connection from", conn.RemoteAddr())
+		if sourceRlm != nil {
+			sourceRlm.ReleaseConnection()
+		}
+		return nil, false
+	}
+	return sourceRlm, true
+}
+
+// admitSource applies the rate limit of the source network of a connection; it returns the RateLimitManager
+// that admitted the connection, which must be released when the connection ends, or nil if there are no source limits
+func (s *ProxyServer) admitSource(conn net.Conn) (lbproxy.RateLimitManager, bool) {
+	src := s.SourceRateLimitConfig
+	if src == nil {
+		return nil, true
+	}
+	ip, err := sourceIP(conn.RemoteAddr())
+	if err != nil {
+		log.Println("APP", s.App.AppId, "Could not determine source of connection from", conn.RemoteAddr(), "ERROR:", err)
+		return nil, false
+	}
+	network := sourceNetwork(ip, src.IPv4PrefixLen, src.IPv6PrefixLen)
+	// Source limits have no wait queue, so adding never blocks; holding the lock meanwhile makes sure
+	// the manager is not evicted as idle between being looked up and taking the connection
+	s.rateManagersLock.Lock()
+	rlm := s.sourceRateLimitManager(network)
+	decision := rlm.AddConnection()
+	s.rateManagersLock.Unlock()
+	if !decision.Allowed() {
+		log.Println("APP", s.App.AppId, "Source rate limit exceeded for", network, decision)
+		return nil, false
+	}
+	return rlm, true
+}
+
+func (s *ProxyServer) acquireHandshakeSlot() bool {
+	if s.handshakeSlots == nil {
+		return true
+	}
+	select {
+	case s.handshakeSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *ProxyServer) releaseHandshakeSlot() {
+	if s.handshakeSlots != nil {
+		<-s.handshakeSlots
+	}
+}
+
+func (s *ProxyServer) authorizeAndHandoffConnection(lbProxyApp lbproxy.Application, conn net.Conn,
+	sourceRlm lbproxy.RateLimitManager) {
+	if sourceRlm != nil {
+		defer sourceRlm.ReleaseConnection()
+	}
+
+	clientId, grant, err := s.ensureSecuredWithTimeout(conn)
+	s.releaseHandshakeSlot()
 	if err != nil {
 		if err != nil {
 			log.Println("APP", s.App.AppId, "Could not authorize client connection", "ERROR", err)
 		}
-		err := conn.Close()
-		if err != nil {
-			log.Println("APP", s.App.AppId, "Failed to close denied client connection from", conn.RemoteAddr(), "ERROR", err)
-		}
+		s.closeDeniedConnection(conn)
+	} else if err = s.admitClient(clientId); err != nil {
+		log.Println("APP", s.App.AppId, "SHED connection of", clientId, "from", conn.RemoteAddr(), "ERROR:", err)
+		s.closeDeniedConnection(conn)
 	} else {
-		rlm := s.getRateLimitManager(clientId)
-		go lbProxyApp.SubmitConnection(conn, rlm)
+		// Proxy in this goroutine, so that the source limit is released only once the connection ends
+		rlm := s.getRateLimitManager(clientId, grant.RateLimits)
+		limits := s.App.ConnectionLimits
+		if grant.ConnectionLimits != nil {
+			limits = *grant.ConnectionLimits
+		}
+		s.trackLiveConnection(conn, clientId)
+		defer s.untrackLiveConnection(conn)
+		if timer := s.closeOnGrantExpiry(conn, clientId, grant); timer != nil {
+			defer timer.Stop()
+		}
+		lbProxyApp.SubmitConnection(conn, rlm, limits)
+	}
+}
+
+func (s *ProxyServer) trackLiveConnection(conn net.Conn, clientId string) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		s.liveConnsLock.Lock()
+		s.liveConns[tlsConn] = clientId
+		s.liveConnsLock.Unlock()
+	}
+}
+
+func (s *ProxyServer) untrackLiveConnection(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		s.liveConnsLock.Lock()
+		delete(s.liveConns, tlsConn)
+		s.liveConnsLock.Unlock()
 	}
 }
 
-func (s *ProxyServer) ensureSecured(conn net.Conn) (string, error) {
+// closeRevokedConnections terminates proxied connections whose client certificate has been revoked since the handshake
+func (s *ProxyServer) closeRevokedConnections() {
+	// Closing ends proxying, which untracks the connection, so connections are only collected under the lock
+	s.liveConnsLock.Lock()
+	liveConns := make(map[*tls.Conn]string, len(s.liveConns))
+	for conn, clientId := range s.liveConns {
+		liveConns[conn] = clientId
+	}
+	s.liveConnsLock.Unlock()
+
+	for conn, clientId := range liveConns {
+		if s.Authn.IsRevoked(conn.ConnectionState()) {
+			log.Println("APP", s.App.AppId, "Closing connection of", clientId, "from", conn.RemoteAddr(), "REASON: certificate revoked")
+			// The pipes fail on the closed connection, which ends proxying and untracks it
+			if err := conn.Close(); err != nil {
+				log.Println("APP", s.App.AppId, "Failed to close revoked connection", "ERROR", err)
+			}
+		}
+	}
+}
+
+// closeOnGrantExpiry schedules closing conn when its grant stops being active, if the grant asks for it;
+// returns the timer to stop once the connection ends, or nil if nothing was scheduled
+func (s *ProxyServer) closeOnGrantExpiry(conn net.Conn, clientId string, grant security.AppGrant) *time.Timer {
+	if !grant.CloseOnExpiry {
+		return nil
+	}
+	until := grant.ActiveUntil(time.Now())
+	if until.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(until), func() {
+		log.Println("APP", s.App.AppId, "Closing connection of", clientId, "from", conn.RemoteAddr(), "REASON: grant expired")
+		// The pipes fail on the closed connection, which ends proxying
+		if err := conn.Close(); err != nil {
+			log.Println("APP", s.App.AppId, "Failed to close expired connection", "ERROR", err)
+		}
+	})
+}
+
+// admitClient sheds the connections of low-priority clients first under resource pressure
+func (s *ProxyServer) admitClient(clientId string) error {
+	if s.Admission == nil {
+		return nil
+	}
+	return s.Admission.AdmitClient(priorityOf(s.ClientPriorities, clientId))
+}
+
+func (s *ProxyServer) closeDeniedConnection(conn net.Conn) {
+	err := conn.Close()
+	if err != nil {
+		log.Println("APP", s.App.AppId, "Failed to close denied client connection from", conn.RemoteAddr(), "ERROR", err)
+	}
+}
+
+// ensureSecuredWithTimeout runs ensureSecured, making sure a slow client cannot hold a handshake slot indefinitely
+func (s *ProxyServer) ensureSecuredWithTimeout(conn net.Conn) (string, security.AppGrant, error) {
+	if s.HandshakeTimeoutSeconds <= 0 {
+		return s.ensureSecured(conn)
+	}
+	err := conn.SetDeadline(time.Now().Add(time.Duration(s.HandshakeTimeoutSeconds) * time.Second))
+	if err != nil {
+		return "", security.AppGrant{}, err
+	}
+	clientId, grant, err := s.ensureSecured(conn)
+	if err != nil {
+		return "", security.AppGrant{}, err
+	}
+	// Clear the deadline, as proxied connections can be long-lived
+	return clientId, grant, conn.SetDeadline(time.Time{})
+}
+
+// ensureSecured authenticates the client, and returns its grant to the app
+func (s *ProxyServer) ensureSecured(conn net.Conn) (string, security.AppGrant, error) {
 	app := s.App
-	clientId, err := s.Authn.AuthenticateConnection(conn)
+	authenticatedId, err := s.Authn.AuthenticateConnection(conn)
 	if err != nil {
-		return "", fmt.Errorf("failed to authenticate client connection from %v. %w", conn.RemoteAddr(), err)
+		// The client id is only known if the certificate was verified; unverified certificates could name any client
+		s.recordSecurityFailure(conn, authenticatedId, err)
+		return "", security.AppGrant{}, fmt.Errorf("failed to authenticate client connection from %v. %w", conn.RemoteAddr(), err)
+	}
+	// AuthenticateConnection only succeeds on TLS connections
+	identity, err := security.IdentifyClient(s.Identities, authenticatedId, conn.(*tls.Conn).ConnectionState())
+	if err != nil {
+		s.recordSecurityFailure(conn, authenticatedId, err)
+		return "", security.AppGrant{}, fmt.Errorf("failed to identify client connection from %v. %w", conn.RemoteAddr(), err)
+	}
+	clientId := identity.ClientId
+	// Authorizers may restrict where clients connect from; without an IP address, they can only deny
+	identity.SourceIP, _ = sourceIP(conn.RemoteAddr())
+
+	if s.Bans != nil {
+		if ban, banned := s.Bans.ClientBan(clientId); banned {
+			return "", security.AppGrant{}, fmt.Errorf("client %s is banned until %v", clientId, ban.Until)
+		}
 	}
 
-	err = s.Authz.AuthorizeClient(clientId, app.AppId)
-	return clientId, err
+	grant, err := s.Authz.AuthorizeClient(identity, app.AppId)
+	if err == nil {
+		err = s.checkSourceNetworks(conn.RemoteAddr(), clientId, grant)
+	}
+	if err != nil {
+		s.recordSecurityFailure(conn, clientId, err)
+	}
+	return clientId, grant, err
 }
 
-func (s *ProxyServer) getRateLimitManager(clientId string) lbproxy.RateLimitManager {
+// recordSecurityFailure counts a failed authentication or authorization towards a ban of the source IP and,
+// if known, of the client id claimed by the certificate; checks that could not be completed do not count
+func (s *ProxyServer) recordSecurityFailure(conn net.Conn, clientId string, err error) {
+	if s.Bans == nil || !security.IsSecurityFailure(err) {
+		return
+	}
+	ip, err := sourceIP(conn.RemoteAddr())
+	if err != nil {
+		ip = nil
+	}
+	s.Bans.RecordFailure(ip, clientId)
+}
+
+// getRateLimitManager returns the rate-limit manager of a client, with the client limits of the app replaced
+// by override if not nil, e.g. from the grant of the client
+func (s *ProxyServer) getRateLimitManager(clientId string, override *lbproxy.RateLimitManagerConfig) lbproxy.RateLimitManager {
 	// Creates one rate-limit manager per (app,clientId)
 	s.rateManagersLock.Lock()
 	defer s.rateManagersLock.Unlock()
 	var rlm lbproxy.RateLimitManager
 	var found bool
-	if rlm, found = s.rateManagers[clientId]; !found {
-		rlm = lbproxy.CreateRateLimitManager(clientId+"@"+s.App.AppId, s.RateLimitConfig)
+	if rlm, found = s.rateManagers[clientId]; found {
+		s.applyRateLimitOverride(clientId, override)
+	} else {
+		limits := s.createRateLimitManager(clientId+"@"+s.App.AppId, s.clientRateLimitConfig(override))
+		s.clientLimits[clientId] = limits
+		if override != nil {
+			s.rateLimitOverrides[clientId] = *override
+		}
+		rlm = limits
+		if s.App.ShadowRateLimitConfig != nil {
+			shadowConfig := *s.App.ShadowRateLimitConfig
+			shadowConfig.Shadow = true
+			shadowRlm := s.createRateLimitManager(clientId+"@"+s.App.AppId+"/shadow", shadowConfig)
+			s.shadowLimits[clientId] = shadowRlm
+			rlm = lbproxy.CreateCompositeRateLimitManager(rlm, shadowRlm)
+		}
+		if s.capacity != nil {
+			// Only connections within the limits of the client compete for the capacity of the app
+			rlm = lbproxy.CreateCompositeRateLimitManager(rlm, s.capacity.forClient(clientId))
+		}
+		if s.Quotas != nil {
+			// The quota goes last, so that connections denied by the rate limits do not use it up
+			if quota := s.Quotas.Get(clientId); quota != nil {
+				rlm = lbproxy.CreateCompositeRateLimitManager(rlm, quota)
+			}
+		}
 		s.rateManagers[clientId] = rlm
 	}
 	return rlm
 }
 
+// applyRateLimitOverride updates the client limits of a client whose override changed since its last connection
+// Must be called holding rateManagersLock
+func (s *ProxyServer) applyRateLimitOverride(clientId string, override *lbproxy.RateLimitManagerConfig) {
+	current, overridden := s.rateLimitOverrides[clientId]
+	switch {
+	case override != nil && (!overridden || !reflect.DeepEqual(current, *override)):
+		s.rateLimitOverrides[clientId] = *override
+		s.clientLimits[clientId].UpdateConfig(s.clientRateLimitConfig(override))
+	case override == nil && overridden:
+		delete(s.rateLimitOverrides, clientId)
+		s.clientLimits[clientId].UpdateConfig(s.clientRateLimitConfig(nil))
+	}
+}
+
+// clientRateLimitConfig returns the client limits to enforce: override if not nil, or else those of the app
+// Must be called holding rateManagersLock
+func (s *ProxyServer) clientRateLimitConfig(override *lbproxy.RateLimitManagerConfig) lbproxy.RateLimitManagerConfig {
+	config := s.RateLimitConfig
+	if override != nil {
+		config = *override
+	}
+	if s.App.ShadowRateLimits {
+		config.Shadow = true
+	}
+	return config
+}
+
+// CurrentRateLimitConfig returns the client limits the app currently enforces
+func (s *ProxyServer) CurrentRateLimitConfig() lbproxy.RateLimitManagerConfig {
+	s.rateManagersLock.RLock()
+	defer s.rateManagersLock.RUnlock()
+	return s.RateLimitConfig
+}
+
+// UpdateRateLimitConfig changes the client limits of the app at runtime; windows and open connections are kept,
+// so the new limits apply to the current usage of each client from its next connection.
+// Windows only hold timestamps within the previous period, so a longer period fills up over time
+func (s *ProxyServer) UpdateRateLimitConfig(config lbproxy.RateLimitManagerConfig) error {
+	if err := validateRateLimitConfig(config); err != nil {
+		return err
+	}
+	s.rateManagersLock.Lock()
+	defer s.rateManagersLock.Unlock()
+	s.RateLimitConfig = config
+	if s.App.ShadowRateLimits {
+		config.Shadow = true
+	}
+	for clientId, limits := range s.clientLimits {
+		// Limits set by the grant of a client take precedence over those of the app
+		if _, overridden := s.rateLimitOverrides[clientId]; !overridden {
+			limits.UpdateConfig(config)
+		}
+	}
+	log.Println("APP", s.App.AppId, "updated client rate limits for", len(s.clientLimits), "clients")
+	return nil
+}
+
+// CurrentShadowRateLimitConfig returns the shadow policy of the app, or nil if it has none
+func (s *ProxyServer) CurrentShadowRateLimitConfig() *lbproxy.RateLimitManagerConfig {
+	s.rateManagersLock.RLock()
+	defer s.rateManagersLock.RUnlock()
+	return s.App.ShadowRateLimitConfig
+}
+
+// UpdateShadowRateLimitConfig changes the shadow policy of the app at runtime, like UpdateRateLimitConfig does
+// the client limits; an app without a shadow policy cannot get one at runtime
+func (s *ProxyServer) UpdateShadowRateLimitConfig(config lbproxy.RateLimitManagerConfig) error {
+	if err := lbproxy.ValidateLimits(config); err != nil {
+		return fmt.Errorf("shadow rate limit: %w", err)
+	}
+	s.rateManagersLock.Lock()
+	defer s.rateManagersLock.Unlock()
+	if s.App.ShadowRateLimitConfig == nil {
+		return fmt.Errorf("appId %s has no shadow rate limit", s.App.AppId)
+	}
+	// The config may be shared with other apps, so it is replaced rather than changed
+	updated := config
+	s.App.ShadowRateLimitConfig = &updated
+	config.Shadow = true
+	for _, shadow := range s.shadowLimits {
+		shadow.UpdateConfig(config)
+	}
+	log.Println("APP", s.App.AppId, "updated shadow rate limits for", len(s.shadowLimits), "clients")
+	return nil
+}
+
+// CurrentSourceRateLimitConfig returns the limits of each source network, or nil if sources are not limited
+func (s *ProxyServer) CurrentSourceRateLimitConfig() *lbproxy.RateLimitManagerConfig {
+	s.rateManagersLock.RLock()
+	defer s.rateManagersLock.RUnlock()
+	if s.SourceRateLimitConfig == nil {
+		return nil
+	}
+	config := s.SourceRateLimitConfig.RateLimit
+	return &config
+}
+
+// UpdateSourceRateLimitConfig changes the limits of each source network at runtime, like UpdateRateLimitConfig does
+// the client limits; an app without source limits cannot get them at runtime, and prefix lengths cannot change
+func (s *ProxyServer) UpdateSourceRateLimitConfig(config lbproxy.RateLimitManagerConfig) error {
+	if err := validateSourceRateLimitConfig(config); err != nil {
+		return err
+	}
+	s.rateManagersLock.Lock()
+	defer s.rateManagersLock.Unlock()
+	if s.SourceRateLimitConfig == nil {
+		return fmt.Errorf("appId %s has no source rate limit", s.App.AppId)
+	}
+	// The config is shared with other apps, so it is replaced rather than changed
+	updated := *s.SourceRateLimitConfig
+	updated.RateLimit = config
+	s.SourceRateLimitConfig = &updated
+	for _, rlm := range s.sourceRateManagers {
+		rlm.(lbproxy.ConfigurableRateLimitManager).UpdateConfig(config)
+	}
+	log.Println("APP", s.App.AppId, "updated source rate limits for", len(s.sourceRateManagers), "source networks")
+	return nil
+}
+
+func validateRateLimitConfig(config lbproxy.RateLimitManagerConfig) error {
+	if config.MaxOpenConnections == 0 || config.MaxRateAmount == 0 {
+		return fmt.Errorf("application has zero allowed rate")
+	}
+	return lbproxy.ValidateLimits(config)
+}
+
+func validateSourceRateLimitConfig(config lbproxy.RateLimitManagerConfig) error {
+	if config.MaxOpenConnections == 0 || config.MaxRateAmount == 0 {
+		return fmt.Errorf("source rate limit has zero allowed rate")
+	}
+	if err := lbproxy.ValidateLimits(config); err != nil {
+		return fmt.Errorf("source rate limit: %w", err)
+	}
+	if config.MaxQueueDepth > 0 {
+		// Source limits are checked in the accept loop, which must never block
+		return fmt.Errorf("source rate limit does not support wait queues")
+	}
+	return nil
+}
+
+// createRateLimitManager creates a client rate-limit manager, in the shared store if there is one
+func (s *ProxyServer) createRateLimitManager(tag string, config lbproxy.RateLimitManagerConfig) lbproxy.ConfigurableRateLimitManager {
+	if s.RateLimitStore == nil {
+		return lbproxy.CreateRateLimitManager(tag, config)
+	}
+	return lbproxy.CreateSharedRateLimitManager(tag, config, s.RateLimitStore)
+}
+
+// getSourceRateLimitManager returns the manager of a source network; source limits are checked before the handshake
+// and protect this instance in particular, so they are always kept in memory rather than in a shared store
+func (s *ProxyServer) getSourceRateLimitManager(network string) lbproxy.RateLimitManager {
+	s.rateManagersLock.Lock()
+	defer s.rateManagersLock.Unlock()
+	return s.sourceRateLimitManager(network)
+}
+
+// sourceRateLimitManager returns the manager of a source network, creating it if needed
+// Must be called holding the write lock of rateManagersLock
+func (s *ProxyServer) sourceRateLimitManager(network string) lbproxy.RateLimitManager {
+	rlm, found := s.sourceRateManagers[network]
+	if !found {
+		// Source networks are chosen by whoever connects, so managers that hold nothing are dropped
+		// before the map grows too large; sweeping only when it doubles keeps the cost per connection constant
+		if len(s.sourceRateManagers) >= s.sourceSweepAt {
+			s.evictIdleSourceRateLimitManagers()
+		}
+		rlm = lbproxy.CreateRateLimitManager(network+"@"+s.App.AppId, s.SourceRateLimitConfig.RateLimit)
+		s.sourceRateManagers[network] = rlm
+	}
+	return rlm
+}
+
+// evictIdleSourceRateLimitManagers drops the managers of source networks with nothing open and an empty window
+// Must be called holding the write lock of rateManagersLock
+func (s *ProxyServer) evictIdleSourceRateLimitManagers() {
+	for network, rlm := range s.sourceRateManagers {
+		if idle, ok := rlm.(lbproxy.IdleRateLimitManager); ok && idle.Idle() {
+			delete(s.sourceRateManagers, network)
+		}
+	}
+	s.sourceSweepAt = 2 * len(s.sourceRateManagers)
+	if s.sourceSweepAt < minSourceSweep {
+		s.sourceSweepAt = minSourceSweep
+	}
+	log.Println("APP", s.App.AppId, "Tracking", len(s.sourceRateManagers), "source networks after evicting idle ones")
+}
+
+// snapshotRateLimits captures the persistent state of all rate-limit managers of this app
+func (s *ProxyServer) snapshotRateLimits() appRateLimitState {
+	s.rateManagersLock.RLock()
+	defer s.rateManagersLock.RUnlock()
+	return appRateLimitState{
+		Clients: snapshotManagers(s.rateManagers),
+		Sources: snapshotManagers(s.sourceRateManagers),
+	}
+}
+
+// restoreRateLimits recreates rate-limit managers from a snapshot; must be called before accepting connections
+func (s *ProxyServer) restoreRateLimits(state appRateLimitState) {
+	for clientId, snapshot := range state.Clients {
+		restoreManager(s.getRateLimitManager(clientId, nil), snapshot)
+	}
+	if s.SourceRateLimitConfig != nil {
+		for network, snapshot := range state.Sources {
+			restoreManager(s.getSourceRateLimitManager(network), snapshot)
+		}
+	}
+}
+
 func (s *ProxyServer) startListener() (net.Listener, error) {
 	address := localServerPrefix + s.App.ProxyPort
 	tlsConfig := s.Authn.GetCurrentTlsConfig()
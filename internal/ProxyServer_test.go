@@ -0,0 +1,376 @@
+package internal
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"github.com/danielepagano/teleport-int-load-balancer/internal/security"
+	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestProxyServerConfig returns the settings of a server proxying the echo app without any limits,
+// for tests to change only those they are about
+func newTestProxyServerConfig() ProxyServerConfig {
+	return ProxyServerConfig{
+		App:                     AppConfig{AppId: "echo", Upstreams: []lbproxy.UpstreamServer{{Address: "localhost:1"}}},
+		RateLimitConfig:         lbproxy.RateLimitManagerConfig{MaxOpenConnections: -1, MaxRateAmount: -1},
+		MaxConcurrentHandshakes: -1,
+	}
+}
+
+// newTestProxyServer creates a server with the settings of newTestProxyServerConfig, changed by configure if not nil
+func newTestProxyServer(t *testing.T, configure func(config *ProxyServerConfig)) *ProxyServer {
+	t.Helper()
+	config := newTestProxyServerConfig()
+	if configure != nil {
+		configure(&config)
+	}
+	server, err := NewProxyServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// newTestSourceRateLimitConfig limits open connections from each source address
+func newTestSourceRateLimitConfig(maxOpen int) *SourceRateLimitConfig {
+	return &SourceRateLimitConfig{
+		RateLimit:     lbproxy.RateLimitManagerConfig{MaxOpenConnections: maxOpen, MaxRateAmount: -1},
+		IPv4PrefixLen: 32,
+		IPv6PrefixLen: 128,
+	}
+}
+
+func TestProxyServer_closeOnGrantExpiry(t *testing.T) {
+	server := newTestProxyServer(t, nil)
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+
+	grant := security.AppGrant{NotAfter: time.Now().Add(50 * time.Millisecond)}
+	if timer := server.closeOnGrantExpiry(serverSide, "contractor", grant); timer != nil {
+		t.Errorf("closeOnGrantExpiry() scheduled closing without CloseOnExpiry")
+	}
+
+	grant.CloseOnExpiry = true
+	timer := server.closeOnGrantExpiry(serverSide, "contractor", grant)
+	if timer == nil {
+		t.Fatalf("closeOnGrantExpiry() did not schedule closing")
+	}
+	defer timer.Stop()
+	_ = clientSide.SetReadDeadline(time.Now().Add(5 * time.Second))
+	started := time.Now()
+	if _, err := clientSide.Read(make([]byte, 1)); err == nil || time.Since(started) > 2*time.Second {
+		t.Errorf("connection still open after the grant expired, read error = %v", err)
+	}
+}
+
+func TestProxyServer_getRateLimitManagerOverride(t *testing.T) {
+	server := newTestProxyServer(t, func(config *ProxyServerConfig) {
+		config.RateLimitConfig.MaxOpenConnections = 2
+	})
+	override := &lbproxy.RateLimitManagerConfig{MaxOpenConnections: 1, MaxRateAmount: -1}
+
+	rlm := server.getRateLimitManager("one.com", override)
+	if d := rlm.AddConnection(); !d.Allowed() {
+		t.Fatalf("first connection denied: %v", d)
+	}
+	if d := rlm.AddConnection(); d.Allowed() || d.Limit != 1 {
+		t.Errorf("second connection = %v, want denied by the limit of the grant", d)
+	}
+	// App-wide updates do not replace the limits of the grant
+	if err := server.UpdateRateLimitConfig(lbproxy.RateLimitManagerConfig{MaxOpenConnections: 3, MaxRateAmount: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if d := server.getRateLimitManager("one.com", override).AddConnection(); d.Allowed() {
+		t.Errorf("connection after app update = %v, want still denied by the limit of the grant", d)
+	}
+	// Without an override, the client gets the limits of the app back
+	if d := server.getRateLimitManager("one.com", nil).AddConnection(); !d.Allowed() {
+		t.Errorf("connection without override = %v, want allowed by the limits of the app", d)
+	}
+}
+
+func TestProxyServer_webhookOutageKeepsOverride(t *testing.T) {
+	// The endpoint is down while maxOpen is 0
+	var maxOpen atomic.Int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxOpen.Load() == 0 {
+			http.Error(w, "policy store unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(security.WebhookResponse{
+			Allow:      true,
+			RateLimits: &lbproxy.RateLimitManagerConfig{MaxOpenConnections: int(maxOpen.Load()), MaxRateAmount: -1},
+		})
+	}))
+	defer endpoint.Close()
+	authz, err := security.NewWebhookAuthorizer(security.WebhookConfig{URL: endpoint.URL, FailOpen: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestProxyServer(t, func(config *ProxyServerConfig) {
+		config.Authz = authz
+	})
+	// Like authorizeAndHandoffConnection, each connection applies the limits of its grant
+	connect := func(ip string) lbproxy.RateLimitDecision {
+		grant, err := server.Authz.AuthorizeClient(security.ClientIdentity{ClientId: "one.com", SourceIP: net.ParseIP(ip)}, "echo")
+		if err != nil {
+			t.Fatalf("AuthorizeClient() error = %v, want allowed", err)
+		}
+		return server.getRateLimitManager("one.com", grant.RateLimits).AddConnection()
+	}
+
+	maxOpen.Store(1)
+	if d := connect("10.0.0.1"); !d.Allowed() {
+		t.Fatalf("first connection = %v, want allowed", d)
+	}
+	maxOpen.Store(0)
+	if d := connect("10.0.0.2"); d.Allowed() || d.Limit != 1 {
+		t.Errorf("connection during the outage = %v, want denied by the last limits of the webhook", d)
+	}
+	maxOpen.Store(2)
+	if d := connect("10.0.0.3"); !d.Allowed() {
+		t.Errorf("connection after recovery = %v, want allowed by the new limits of the webhook", d)
+	}
+	if d := connect("10.0.0.1"); d.Allowed() || d.Limit != 2 {
+		t.Errorf("connection over the new limits = %v, want denied with limit 2", d)
+	}
+}
+
+// remoteConn is a connection that appears to come from a given address
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func connFrom(ip string) net.Conn {
+	return remoteConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+}
+
+func TestProxyServer_admitSource(t *testing.T) {
+	server := newTestProxyServer(t, func(config *ProxyServerConfig) {
+		config.SourceRateLimitConfig = newTestSourceRateLimitConfig(1)
+		config.SourceRateLimitConfig.IPv4PrefixLen = 24
+		config.SourceRateLimitConfig.IPv6PrefixLen = 64
+	})
+
+	first, admitted := server.admitSource(connFrom("10.0.0.1"))
+	if !admitted || first == nil {
+		t.Fatalf("admitSource() denied the first connection of a network")
+	}
+	if _, admitted = server.admitSource(connFrom("10.0.0.2")); admitted {
+		t.Errorf("admitSource() admitted a second connection from the same network")
+	}
+	if _, admitted = server.admitSource(connFrom("2001:db8::1")); !admitted {
+		t.Errorf("admitSource() denied a connection from another network")
+	}
+	if _, admitted = server.admitSource(connFrom("2001:db8::2")); admitted {
+		t.Errorf("admitSource() admitted a second connection from the same IPv6 network")
+	}
+	first.ReleaseConnection()
+	if _, admitted = server.admitSource(connFrom("10.0.0.2")); !admitted {
+		t.Errorf("admitSource() denied a connection after the network released its slot")
+	}
+}
+
+func TestProxyServer_updateShadowAndSourceRateLimits(t *testing.T) {
+	source := newTestSourceRateLimitConfig(1)
+	server := newTestProxyServer(t, func(config *ProxyServerConfig) {
+		config.App.ShadowRateLimitConfig = &lbproxy.RateLimitManagerConfig{MaxOpenConnections: 1, MaxRateAmount: -1}
+		config.SourceRateLimitConfig = source
+	})
+
+	rlm := server.getRateLimitManager("one.com", nil)
+	rlm.AddConnection()
+	if d := server.shadowLimits["one.com"].AddConnection(); !d.ShadowDenied {
+		t.Errorf("shadow decision over the limit = %v, want shadow denied", d)
+	}
+	if err := server.UpdateShadowRateLimitConfig(lbproxy.RateLimitManagerConfig{MaxOpenConnections: 5, MaxRateAmount: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if d := server.shadowLimits["one.com"].AddConnection(); d.ShadowDenied || !d.Allowed() {
+		t.Errorf("shadow decision after the update = %v, want allowed by the new shadow limits", d)
+	}
+	if d := server.shadowLimits["two.com"]; d != nil {
+		t.Errorf("shadow manager of a client that never connected = %v, want none", d)
+	}
+	if config := server.CurrentShadowRateLimitConfig(); config == nil || config.MaxOpenConnections != 5 {
+		t.Errorf("CurrentShadowRateLimitConfig() = %+v, want the updated limits", config)
+	}
+
+	if _, admitted := server.admitSource(connFrom("10.0.0.1")); !admitted {
+		t.Fatalf("admitSource() denied the first connection")
+	}
+	if _, admitted := server.admitSource(connFrom("10.0.0.1")); admitted {
+		t.Errorf("admitSource() admitted a connection over the source limit")
+	}
+	if err := server.UpdateSourceRateLimitConfig(lbproxy.RateLimitManagerConfig{MaxOpenConnections: 2, MaxRateAmount: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, admitted := server.admitSource(connFrom("10.0.0.1")); !admitted {
+		t.Errorf("admitSource() denied a connection within the updated source limit")
+	}
+	if source.RateLimit.MaxOpenConnections != 1 {
+		t.Errorf("source config shared with other apps changed to %+v", source.RateLimit)
+	}
+	if err := server.UpdateSourceRateLimitConfig(lbproxy.RateLimitManagerConfig{MaxOpenConnections: 2, MaxRateAmount: -1, MaxQueueDepth: 1}); err == nil {
+		t.Errorf("UpdateSourceRateLimitConfig() with a wait queue succeeded, want error")
+	}
+
+	server.App.ShadowRateLimitConfig = nil
+	if err := server.UpdateShadowRateLimitConfig(lbproxy.RateLimitManagerConfig{MaxOpenConnections: 5, MaxRateAmount: -1}); err == nil {
+		t.Errorf("UpdateShadowRateLimitConfig() without a shadow policy succeeded, want error")
+	}
+}
+
+func TestProxyServer_evictIdleSourceRateLimitManagers(t *testing.T) {
+	server := newTestProxyServer(t, func(config *ProxyServerConfig) {
+		config.SourceRateLimitConfig = newTestSourceRateLimitConfig(1)
+	})
+
+	// One network keeps its connection open, all others come and go
+	held, admitted := server.admitSource(connFrom("10.0.0.1"))
+	if !admitted {
+		t.Fatalf("admitSource() denied the first connection")
+	}
+	for i := 1; i < minSourceSweep; i++ {
+		rlm, admitted := server.admitSource(connFrom(net.IPv4(10, 1, byte(i>>8), byte(i)).String()))
+		if !admitted {
+			t.Fatalf("admitSource() denied connection %d", i)
+		}
+		rlm.ReleaseConnection()
+	}
+	if got := len(server.sourceRateManagers); got != minSourceSweep {
+		t.Fatalf("tracking %d source networks before the sweep, want %d", got, minSourceSweep)
+	}
+
+	if _, admitted = server.admitSource(connFrom("10.2.0.1")); !admitted {
+		t.Fatalf("admitSource() denied the connection that triggers the sweep")
+	}
+	if got := len(server.sourceRateManagers); got != 2 {
+		t.Errorf("tracking %d source networks after the sweep, want the open one and the new one", got)
+	}
+	// The network with an open connection kept its limit
+	if _, admitted = server.admitSource(connFrom("10.0.0.1")); admitted {
+		t.Errorf("admitSource() admitted a connection over the limit of a network that was not idle")
+	}
+	held.ReleaseConnection()
+}
+
+func TestProxyServer_admitConnectionHandshakeSlots(t *testing.T) {
+	server := newTestProxyServer(t, func(config *ProxyServerConfig) {
+		config.SourceRateLimitConfig = newTestSourceRateLimitConfig(1)
+		config.MaxConcurrentHandshakes = 1
+	})
+
+	if _, admitted := server.admitConnection(connFrom("10.0.0.1")); !admitted {
+		t.Fatalf("admitConnection() denied the first handshake")
+	}
+	if _, admitted := server.admitConnection(connFrom("10.0.0.2")); admitted {
+		t.Errorf("admitConnection() admitted a handshake over the cap")
+	}
+	// The denied connection gave back its source slot
+	server.releaseHandshakeSlot()
+	if _, admitted := server.admitConnection(connFrom("10.0.0.2")); !admitted {
+		t.Errorf("admitConnection() denied a handshake after a slot was released")
+	}
+}
+
+// stalledAuthn waits for the client to send something, like a TLS handshake waiting for the client hello
+type stalledAuthn struct {
+	security.Authenticator
+}
+
+func (stalledAuthn) AuthenticateConnection(conn net.Conn) (string, error) {
+	_, err := conn.Read(make([]byte, 1))
+	return "", &security.UnavailableError{Err: err}
+}
+
+func TestProxyServer_ensureSecuredWithTimeout(t *testing.T) {
+	bans, err := security.NewBanManager(security.BanConfig{MaxFailures: 1, FailureWindowSeconds: 60, BanSeconds: 60, MaxBanSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestProxyServer(t, func(config *ProxyServerConfig) {
+		config.Authn = stalledAuthn{}
+		config.Bans = bans
+		config.HandshakeTimeoutSeconds = 1
+	})
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+
+	started := time.Now()
+	if _, _, err = server.ensureSecuredWithTimeout(serverSide); err == nil {
+		t.Fatalf("ensureSecuredWithTimeout() succeeded for a client that never sent anything")
+	}
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Errorf("ensureSecuredWithTimeout() took %v, want about the handshake timeout", elapsed)
+	}
+	// A slow client did not fail any check, so it is not banned
+	if banned := bans.ListBans(); len(banned) != 0 {
+		t.Errorf("bans after a handshake timeout = %v, want none", banned)
+	}
+}
+
+// revokedAuthn considers every certificate revoked
+type revokedAuthn struct {
+	security.Authenticator
+}
+
+func (revokedAuthn) IsRevoked(tls.ConnectionState) bool {
+	return true
+}
+
+// untrackingConn runs onClose when closed, like the end of proxying does
+type untrackingConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c untrackingConn) Close() error {
+	c.onClose()
+	return c.Conn.Close()
+}
+
+func TestProxyServer_closeRevokedConnections(t *testing.T) {
+	server := newTestProxyServer(t, func(config *ProxyServerConfig) {
+		config.Authn = revokedAuthn{}
+	})
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	var conn *tls.Conn
+	conn = tls.Server(untrackingConn{serverSide, func() {
+		server.liveConnsLock.Lock()
+		defer server.liveConnsLock.Unlock()
+		delete(server.liveConns, conn)
+	}}, &tls.Config{})
+	server.liveConns[conn] = "one.com"
+
+	done := make(chan struct{})
+	go func() {
+		server.closeRevokedConnections()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("closeRevokedConnections() did not return, closing connections that untrack themselves")
+	}
+	if len(server.liveConns) != 0 {
+		t.Errorf("live connections after revocation = %v, want none", server.liveConns)
+	}
+	_ = clientSide.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clientSide.Read(make([]byte, 1)); err == nil {
+		t.Errorf("revoked connection still open")
+	}
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RateLimitStateFile persists the rate-limit windows of all apps to a local file,
+// so that restarting the server cannot be used to get around rate limits
+type RateLimitStateFile struct {
+	path           string
+	lock           sync.Mutex
+	restored       map[string]appRateLimitState // State loaded at startup, handed to each app when it registers
+	servers        []*ProxyServer
+	quotas         *ClientQuotas // nil until registered
+	restoredQuotas map[string]lbproxy.RateLimitSnapshot
+}
+
+// rateLimitState is the content of the state file
+type rateLimitState struct {
+	SavedAt int64                                // Unix time of the save, for diagnostics
+	Apps    map[string]appRateLimitState         // By app id
+	Quotas  map[string]lbproxy.RateLimitSnapshot `json:",omitempty"` // By client id
+}
+
+type appRateLimitState struct {
+	Clients map[string]lbproxy.RateLimitSnapshot // By client id
+	Sources map[string]lbproxy.RateLimitSnapshot // By source network
+}
+
+// LoadRateLimitStateFile reads the state saved at path, if any; a missing file is not an error
+func LoadRateLimitStateFile(path string) (*RateLimitStateFile, error) {
+	f := &RateLimitStateFile{
+		path:     path,
+		restored: map[string]appRateLimitState{},
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Println("No rate-limit state found at", path)
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state rateLimitState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("could not parse rate-limit state %s. %w", path, err)
+	}
+	if state.Apps != nil {
+		f.restored = state.Apps
+	}
+	f.restoredQuotas = state.Quotas
+	log.Println("Loaded rate-limit state from", path, "saved at", time.Unix(state.SavedAt, 0))
+	return f, nil
+}
+
+// Register restores the saved state of a server's app, and includes the server in future saves
+func (f *RateLimitStateFile) Register(server *ProxyServer) {
+	f.lock.Lock()
+	state, found := f.restored[server.App.AppId]
+	delete(f.restored, server.App.AppId)
+	f.servers = append(f.servers, server)
+	f.lock.Unlock()
+
+	if found {
+		server.restoreRateLimits(state)
+	}
+}
+
+// RegisterQuotas restores the saved usage of client quotas, and includes them in future saves
+func (f *RateLimitStateFile) RegisterQuotas(quotas *ClientQuotas) {
+	f.lock.Lock()
+	restored := f.restoredQuotas
+	f.restoredQuotas = nil
+	f.quotas = quotas
+	f.lock.Unlock()
+
+	quotas.restore(restored)
+}
+
+// Save writes the state of all registered servers; it writes to a temporary file first,
+// so that a crash while saving cannot leave a truncated file behind
+func (f *RateLimitStateFile) Save() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	state := rateLimitState{
+		SavedAt: time.Now().Unix(),
+		Apps:    map[string]appRateLimitState{},
+	}
+	// Apps that have not started (yet) keep their restored state
+	for appId, appState := range f.restored {
+		state.Apps[appId] = appState
+	}
+	for _, server := range f.servers {
+		state.Apps[server.App.AppId] = server.snapshotRateLimits()
+	}
+	if f.quotas != nil {
+		state.Quotas = f.quotas.snapshot()
+	} else {
+		state.Quotas = f.restoredQuotas
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// AutoSave saves the state every interval until stop is closed
+func (f *RateLimitStateFile) AutoSave(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.Save(); err != nil {
+				log.Println("Failed to save rate-limit state to", f.path, "ERROR:", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func snapshotManagers(managers map[string]lbproxy.RateLimitManager) map[string]lbproxy.RateLimitSnapshot {
+	snapshots := map[string]lbproxy.RateLimitSnapshot{}
+	for key, rlm := range managers {
+		if persistent, ok := rlm.(lbproxy.PersistentRateLimitManager); ok {
+			snapshots[key] = persistent.Snapshot()
+		}
+	}
+	return snapshots
+}
+
+func restoreManager(rlm lbproxy.RateLimitManager, snapshot lbproxy.RateLimitSnapshot) {
+	if persistent, ok := rlm.(lbproxy.PersistentRateLimitManager); ok {
+		persistent.Restore(snapshot)
+	}
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRateLimitStateFile_roundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	newServer := func() *ProxyServer {
+		return newTestProxyServer(t, func(config *ProxyServerConfig) {
+			config.RateLimitConfig = lbproxy.RateLimitManagerConfig{MaxOpenConnections: -1, MaxRateAmount: 2, MaxRatePeriodSeconds: 3600}
+			config.SourceRateLimitConfig = newTestSourceRateLimitConfig(-1)
+			config.SourceRateLimitConfig.RateLimit = config.RateLimitConfig
+		})
+	}
+
+	// Use up the windows of one client and one source before a restart
+	stateFile, err := LoadRateLimitStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := newServer()
+	stateFile.Register(before)
+	for i := 0; i < 2; i++ {
+		if d := before.getRateLimitManager("one.com", nil).AddConnection(); !d.Allowed() {
+			t.Fatalf("client connection %d denied: %v", i, d)
+		}
+		if _, admitted := before.admitSource(connFrom("10.0.0.1")); !admitted {
+			t.Fatalf("source connection %d denied", i)
+		}
+	}
+	if err = stateFile.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	stateFile, err = LoadRateLimitStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := newServer()
+	stateFile.Register(after)
+	if d := after.getRateLimitManager("one.com", nil).AddConnection(); d.Allowed() || d.Trigger != lbproxy.TriggerMaxRate {
+		t.Errorf("client connection after restart = %v, want denied by %v", d, lbproxy.TriggerMaxRate)
+	}
+	if _, admitted := after.admitSource(connFrom("10.0.0.1")); admitted {
+		t.Errorf("source connection after restart admitted, want denied by the restored window")
+	}
+	// Clients and sources without saved state start afresh
+	if d := after.getRateLimitManager("two.com", nil).AddConnection(); !d.Allowed() {
+		t.Errorf("connection of another client after restart = %v, want allowed", d)
+	}
+	if _, admitted := after.admitSource(connFrom("10.0.0.2")); !admitted {
+		t.Errorf("connection from another source after restart denied, want admitted")
+	}
+}
+
+func TestRateLimitStateFile_sharedQuotaRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	// Both apps stack the same quota of the client, which must be saved and restored once
+	start := func() (*RateLimitStateFile, []*ProxyServer) {
+		stateFile, err := LoadRateLimitStateFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		quotas, err := NewClientQuotas(QuotaConfig{Default: &lbproxy.QuotaConfig{
+			Period: lbproxy.QuotaMonthly, MaxConnections: 10, MaxBytes: -1,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stateFile.RegisterQuotas(quotas)
+		var servers []*ProxyServer
+		for _, appId := range []string{"echo", "httpbin"} {
+			server := newTestProxyServer(t, func(config *ProxyServerConfig) {
+				config.App.AppId = appId
+				config.Quotas = quotas
+			})
+			stateFile.Register(server)
+			servers = append(servers, server)
+		}
+		return stateFile, servers
+	}
+	savedConnections := func() int64 {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state rateLimitState
+		if err = json.Unmarshal(data, &state); err != nil {
+			t.Fatal(err)
+		}
+		return state.Quotas["one.com"].Quota.Connections
+	}
+
+	stateFile, servers := start()
+	for _, server := range servers {
+		if d := server.getRateLimitManager("one.com", nil).AddConnection(); !d.Allowed() {
+			t.Fatalf("connection to %s denied: %v", server.App.AppId, d)
+		}
+	}
+	if err := stateFile.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if got := savedConnections(); got != 2 {
+		t.Fatalf("saved quota connections = %d, want 2", got)
+	}
+
+	// Restarting, and saving again, keeps the usage as it was
+	stateFile, servers = start()
+	for _, server := range servers {
+		server.getRateLimitManager("one.com", nil)
+	}
+	if err := stateFile.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if got := savedConnections(); got != 2 {
+		t.Errorf("quota connections saved after a restart = %d, want 2", got)
+	}
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"github.com/danielepagano/teleport-int-load-balancer/internal/cluster"
 	"github.com/danielepagano/teleport-int-load-balancer/internal/security"
 	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
 )
@@ -17,6 +18,7 @@ func GetStaticConfig() *ServerConfig {
 					{Address: "eu.httpbin.org:80"},
 					{Address: "httpbin.org:80"},
 				},
+				// Set ConnectionLimits to cap the bytes and duration of each connection, e.g. as requests are short-lived
 			},
 			// Open an echo server for each upstream, e.g. `ncat -l 9098 --keep-open --exec "/bin/cat"`;
 			// you can then use `nc localhost 9002` to send data through proxy, and you should see echos
@@ -28,18 +30,59 @@ func GetStaticConfig() *ServerConfig {
 					{Address: ":9098"},
 					{Address: ":9099"},
 				},
+				// Set Capacity to cap the connections of the app, shared fairly by its clients
 			},
 		},
+		// Set IdentityRules to write permissions against logical ids derived from certificate fields, e.g. OU,
+		// and StrictIdentityRules so that clients the rules do not map cannot use such ids
+		// Grants can be time-bounded with NotBefore, NotAfter and a recurring Schedule, e.g. for contractors
+		// Set AuthorizationWebhook to have a central policy service decide access instead of Clients and Roles
 		Clients: security.ClientPermissions{
-			"one.com":   {"httpbin": {}},
-			"two.com":   {"echo": {}},
+			"one.com": {"httpbin": {}},
+			"two.com": {"echo": {}},
+			// Grants can set ConnectionLimits replacing those of the app, e.g. so local tests may download more,
+			// and SourceNetworks restricting where the client connects from, e.g. only from this machine
 			"localhost": {"httpbin": {}, "echo": {}},
 		},
+		// Roles grant apps by id or glob pattern, to clients directly or to groups set by IdentityRules
+		Roles: map[string]security.Role{
+			"operators": {Apps: []string{AdminAppId}},
+		},
+		ClientRoles: map[string][]string{
+			"localhost": {"operators"},
+		},
+		// Set ClientPriorities to have some clients go first, or get a larger share, when an app is at capacity
+		// Set Admission to shed connections, low-priority clients first, when open files, goroutines or heap run high
 		DefaultRateLimitConfig: lbproxy.RateLimitManagerConfig{
 			MaxOpenConnections:   5,
 			MaxRateAmount:        5,
 			MaxRatePeriodSeconds: 10,
+			// Set Schedule to replace these limits at times of day, e.g. looser ones at night for batch jobs
+		},
+		// Checked before the TLS handshake, so it should be looser than the per-client limits above
+		SourceRateLimitConfig: &SourceRateLimitConfig{
+			RateLimit: lbproxy.RateLimitManagerConfig{
+				MaxOpenConnections:   20,
+				MaxRateAmount:        20,
+				MaxRatePeriodSeconds: 10,
+			},
+			IPv4PrefixLen: 32,
+			IPv6PrefixLen: 64,
 		},
+		MaxConcurrentHandshakes: 32,
+		HandshakeTimeoutSeconds: 5,
+		BanConfig: &security.BanConfig{
+			MaxFailures:          5,
+			FailureWindowSeconds: 60,
+			BanSeconds:           60,
+			MaxBanSeconds:        24 * 60 * 60,
+			ForgetAfterSeconds:   24 * 60 * 60,
+		},
+		// Set Quotas to cap the usage of each client across all apps over a long period, e.g. daily connections and bytes,
+		// saved with the rate-limit state
+		AdminAddress:              "localhost:9900",
+		RateLimitStatePath:        "ratelimits.json",
+		RateLimitStateSaveSeconds: 30,
 		SecurityConfig: security.ServerSecurityConfig{
 			ClientsCertPath:   "certs/clients",
 			ClientCertFileExt: ".crt",
@@ -47,6 +90,13 @@ func GetStaticConfig() *ServerConfig {
 			CaCert:            "certs/ca.crt",
 			ServerCert:        "certs/server.crt",
 			ServerKey:         "certs/server.key",
+			// Set ReloadSeconds to pick up rotated certificates, and new CRLs, without restarting
+			// Set CrlFile to a CRL issued by the CA to reject revoked client certificates
+			// Set OcspPolicy to also check client certificates with the OCSP responder named in them, or OcspResponder
+			// Set IdentitySource to identify clients by a SAN, e.g. their SPIFFE ID, rather than the common name
+			// Set ClientVerification to "ca" and ClientCaBundle to trust any client certificate issued by those CAs,
+			// rather than those in ClientsCertPath
+			TerminateRevoked: true,
 		},
 	}
 }
@@ -59,14 +109,43 @@ func (c *AppConfig) ToApplicationConfig() lbproxy.ApplicationConfig {
 }
 
 type ServerConfig struct {
-	Apps                   []AppConfig
-	Clients                security.ClientPermissions
-	DefaultRateLimitConfig lbproxy.RateLimitManagerConfig
-	SecurityConfig         security.ServerSecurityConfig
+	Apps                      []AppConfig
+	Clients                   security.ClientPermissions
+	Roles                     map[string]security.Role // Roles by name, granting apps to clients and groups
+	ClientRoles               map[string][]string      // Names of the roles of each client, by client id
+	GroupRoles                map[string][]string      // Names of the roles of each group, by group from IdentityRules
+	IdentityRules             []security.IdentityRule  // Map certificate fields to logical client ids and groups; empty to keep authenticated ids
+	StrictIdentityRules       bool                     // Reject clients that no identity rule maps to a client id, so raw ids cannot pass for logical ones
+	AuthorizationWebhook      *security.WebhookConfig  // Policy service deciding access instead of Clients and Roles; nil to use them
+	DefaultRateLimitConfig    lbproxy.RateLimitManagerConfig
+	SourceRateLimitConfig     *SourceRateLimitConfig    // Limits by source network before the handshake; nil to remove checks
+	MaxConcurrentHandshakes   int                       // How many TLS handshakes each app runs at once; -1 to remove checks
+	HandshakeTimeoutSeconds   int64                     // How long a client has to complete the handshake; 0 for no timeout
+	BanConfig                 *security.BanConfig       // Bans after repeated security failures; nil to disable
+	AdminAddress              string                    // Address of the admin endpoints; empty to disable
+	RateLimitStatePath        string                    // File where rate-limit windows are saved; empty to not persist them
+	RateLimitStateSaveSeconds int64                     // How often rate-limit windows are saved, besides on shutdown
+	Cluster                   *cluster.Config           // Other instances sharing client rate limits; nil for standalone
+	Quotas                    *QuotaConfig              // Long-period quotas of clients across all apps; nil to disable
+	ClientPriorities          map[string]ClientPriority // How clients compete for app capacity, by client id
+	Admission                 *AdmissionConfig          // Load shedding under resource pressure; nil to disable
+	SecurityConfig            security.ServerSecurityConfig
+}
+
+// SourceRateLimitConfig rate-limits incoming connections by source network, right after they are accepted
+type SourceRateLimitConfig struct {
+	RateLimit     lbproxy.RateLimitManagerConfig // Limits for each source network; wait queues are not supported
+	IPv4PrefixLen int                            // Size of IPv4 networks sharing one limit, e.g. 32 for single addresses
+	IPv6PrefixLen int                            // Size of IPv6 networks sharing one limit, e.g. 64 for one subnet
 }
 
 type AppConfig struct {
-	AppId     string
-	ProxyPort string
-	Upstreams []lbproxy.UpstreamServer
+	AppId                 string
+	ProxyPort             string
+	Upstreams             []lbproxy.UpstreamServer
+	ShadowRateLimits      bool                            // Run the rate limits of this app in shadow mode
+	ShadowRateLimitConfig *lbproxy.RateLimitManagerConfig // Shadow policy evaluated next to the enforced one; nil for none
+	Capacity              *CapacityConfig                 // Connections shared fairly by all clients; nil for no cap
+	ConnectionLimits      lbproxy.ConnectionLimits        // Caps of each connection, unless the client grant overrides them
+	SourceNetworks        []string                        // CIDRs clients may connect from, IPv4 or IPv6; empty for anywhere
 }
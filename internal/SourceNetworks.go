@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/danielepagano/teleport-int-load-balancer/internal/security"
+	"net"
+)
+
+// sourceIP extracts the IP address of the remote side of a connection
+func sourceIP(addr net.Addr) (net.IP, error) {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP, nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("not an IP address: %s", host)
+	}
+	return ip, nil
+}
+
+// checkSourceNetworks returns an error if a client connects from outside the networks allowed by the app or its grant
+func (s *ProxyServer) checkSourceNetworks(addr net.Addr, clientId string, grant security.AppGrant) error {
+	ip, err := sourceIP(addr)
+	if err != nil {
+		return fmt.Errorf("could not check source of client %s. %w", clientId, err)
+	}
+	if !security.NetworksContain(s.sourceNetworks, ip) {
+		return fmt.Errorf("client %s connecting from %v is outside the source networks %v of appId %s",
+			clientId, ip, s.App.SourceNetworks, s.App.AppId)
+	}
+	if err = grant.CheckSource(ip); err != nil {
+		return fmt.Errorf("client %s not allowed to access appId %s. %w", clientId, s.App.AppId, err)
+	}
+	return nil
+}
+
+// sourceNetwork returns the network, in CIDR notation, that an IP belongs to given the prefix length for its family
+// It is used to group clients by source, so that e.g. a whole IPv6 subnet shares a single rate limit
+func sourceNetwork(ip net.IP, ipv4PrefixLen int, ipv6PrefixLen int) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		mask := net.CIDRMask(ipv4PrefixLen, 8*net.IPv4len)
+		return (&net.IPNet{IP: ipv4.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(ipv6PrefixLen, 8*net.IPv6len)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"github.com/danielepagano/teleport-int-load-balancer/internal/security"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestProxyServer_checkSourceNetworks(t *testing.T) {
+	server := newTestProxyServer(t, func(config *ProxyServerConfig) {
+		config.App.SourceNetworks = []string{"10.0.0.0/8", "2001:db8::/32"}
+	})
+	office := security.AppGrant{SourceNetworks: []string{"10.1.0.0/16"}}
+
+	tests := []struct {
+		name    string
+		ip      string
+		grant   security.AppGrant
+		wantErr string // Part of the denial reason; empty if allowed
+	}{
+		{name: "IPv4 in app networks", ip: "10.2.3.4"},
+		{name: "IPv6 in app networks", ip: "2001:db8::1"},
+		{name: "IPv4-mapped IPv6", ip: "::ffff:10.2.3.4"},
+		{name: "outside app networks", ip: "192.168.1.1", wantErr: "outside the source networks [10.0.0.0/8 2001:db8::/32] of appId echo"},
+		{name: "IPv6 outside app networks", ip: "2001:db9::1", wantErr: "outside the source networks"},
+		{name: "in grant networks", ip: "10.1.2.3", grant: office},
+		{name: "outside grant networks", ip: "10.2.3.4", grant: office, wantErr: "outside the source networks [10.1.0.0/16] of the grant"},
+		{name: "unparsable grant networks", ip: "10.1.2.3", grant: security.AppGrant{SourceNetworks: []string{"10.1.0.0"}}, wantErr: "invalid source network"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 40000}
+			err := server.checkSourceNetworks(addr, "one.com", tt.grant)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkSourceNetworks() error = %v, want allowed", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkSourceNetworks() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	config := newTestProxyServerConfig()
+	config.App.SourceNetworks = []string{"10.0.0.0"}
+	if _, err := NewProxyServer(config); err == nil {
+		t.Errorf("NewProxyServer() with a source network without prefix length succeeded, want error")
+	}
+}
@@ -0,0 +1,13 @@
+package cluster
+
+// Config describes how a proxy instance finds and talks to the other instances of its cluster
+type Config struct {
+	NodeId             string   // Unique name of this instance
+	ListenAddress      string   // Address for traffic from other instances, e.g. ":9950"
+	AdvertiseAddress   string   // Address other instances use to reach this one, e.g. "proxy1.internal:9950"
+	Seeds              []string // Addresses of some other instances, used to join the cluster
+	AllowedPeerNames   []string // Node ids other instances may present, as an lb-peer://<node id> URI SAN of their peer certificate
+	SyncIntervalMillis int64    // How often this instance sends a heartbeat and pushes its state to the others
+	StaleAfterSeconds  int64    // An instance not heard from within this time is considered failed and its state ignored
+	MaxWindowSeconds   int64    // Largest rate-limit window in use; older timestamps are not exchanged
+}
@@ -0,0 +1,158 @@
+package cluster
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const membersKind = "members"
+
+// Member is an instance of the cluster, as seen by this instance
+type Member struct {
+	NodeId    string
+	Address   string
+	Heartbeat uint64    // Incremented by the member at every sync; a higher value means more recent news
+	LastSeen  time.Time // When this instance last saw the heartbeat increase
+	Alive     bool
+}
+
+// Membership tracks the instances of the cluster with gossip-style failure detection
+// At every sync, each instance increments its own heartbeat and pushes its whole member list to its peers,
+// which keep the highest heartbeat they hear of for each member, directly or through others.
+// A member whose heartbeat has not increased within StaleAfterSeconds is considered failed,
+// and is forgotten after as long again, unless it comes back in the meantime
+type Membership struct {
+	config    Config
+	lock      sync.RWMutex
+	heartbeat uint64
+	members   map[string]*Member // By node id, excluding this instance
+	now       func() time.Time   // Current time, can be changed for testing
+}
+
+// gossipMember is how a member is described to other instances
+type gossipMember struct {
+	NodeId    string
+	Address   string
+	Heartbeat uint64
+}
+
+func newMembership(config Config) *Membership {
+	return &Membership{
+		config:  config,
+		members: map[string]*Member{},
+		now:     time.Now,
+	}
+}
+
+// LiveMembers returns the other instances currently considered alive, sorted by node id
+func (m *Membership) LiveMembers() []Member {
+	return m.list(true)
+}
+
+// Members returns all other instances this instance knows about, including failed ones, sorted by node id
+func (m *Membership) Members() []Member {
+	return m.list(false)
+}
+
+func (m *Membership) list(liveOnly bool) []Member {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.detectFailures()
+	members := []Member{}
+	for _, member := range m.members {
+		if member.Alive || !liveOnly {
+			members = append(members, *member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].NodeId < members[j].NodeId })
+	return members
+}
+
+// peerAddresses returns the addresses to sync with: live members, plus seeds that are not live members,
+// so that this instance can join the cluster, or rejoin it after a partition; seeds of failed members
+// are dialed again at every sync, so that they are found as soon as they are back
+func (m *Membership) peerAddresses() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.detectFailures()
+	known := map[string]bool{}
+	addresses := []string{}
+	for _, member := range m.members {
+		if member.Alive && !known[member.Address] {
+			known[member.Address] = true
+			addresses = append(addresses, member.Address)
+		}
+	}
+	for _, seed := range m.config.Seeds {
+		if !known[seed] && seed != m.config.AdvertiseAddress {
+			addresses = append(addresses, seed)
+			known[seed] = true
+		}
+	}
+	return addresses
+}
+
+// publish increments the heartbeat of this instance, and returns the member list to gossip
+func (m *Membership) publish() any {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.heartbeat += 1
+	gossip := []gossipMember{{NodeId: m.config.NodeId, Address: m.config.AdvertiseAddress, Heartbeat: m.heartbeat}}
+	for _, member := range m.members {
+		if member.Alive {
+			gossip = append(gossip, gossipMember{NodeId: member.NodeId, Address: member.Address, Heartbeat: member.Heartbeat})
+		}
+	}
+	return gossip
+}
+
+// receive merges the member list gossiped by a peer
+func (m *Membership) receive(from string, payload json.RawMessage) {
+	var gossip []gossipMember
+	if err := json.Unmarshal(payload, &gossip); err != nil {
+		log.Println("CLUSTER Invalid member list from", from, "ERROR:", err)
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := m.now()
+	for _, g := range gossip {
+		if g.NodeId == m.config.NodeId {
+			continue
+		}
+		member, found := m.members[g.NodeId]
+		if !found {
+			member = &Member{NodeId: g.NodeId}
+			m.members[g.NodeId] = member
+		} else if g.Heartbeat <= member.Heartbeat {
+			continue // Old news
+		}
+		if !member.Alive {
+			log.Println("CLUSTER Member", g.NodeId, "is alive at", g.Address)
+		}
+		member.Address = g.Address
+		member.Heartbeat = g.Heartbeat
+		member.LastSeen = now
+		member.Alive = true
+	}
+}
+
+// detectFailures marks members that have not been heard from as failed, and forgets them after a while
+// Must be called holding the write lock
+func (m *Membership) detectFailures() {
+	timeout := time.Duration(m.config.StaleAfterSeconds) * time.Second
+	now := m.now()
+	for nodeId, member := range m.members {
+		silence := now.Sub(member.LastSeen)
+		if member.Alive && silence > timeout {
+			member.Alive = false
+			log.Println("CLUSTER Member", nodeId, "failed, not heard from for", silence)
+		}
+		if silence > 2*timeout {
+			delete(m.members, nodeId)
+		}
+	}
+}
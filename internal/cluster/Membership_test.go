@@ -0,0 +1,97 @@
+package cluster
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMembershipGossip(t *testing.T) {
+	members, now := newTestMembership(Config{
+		NodeId:            "a",
+		AdvertiseAddress:  "a:1",
+		Seeds:             []string{"a:1", "b:1", "c:1"},
+		StaleAfterSeconds: 10,
+	})
+
+	// Before hearing from anybody, we sync with the seeds, except ourselves
+	if got, want := members.peerAddresses(), []string{"b:1", "c:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("peerAddresses() = %v, want %v", got, want)
+	}
+
+	// b tells us about itself and d, which we learn about indirectly
+	gossip(t, members, "b", []gossipMember{{"b", "b:1", 5}, {"d", "d:1", 7}, {"a", "a:1", 100}})
+	if got := nodeIds(members.LiveMembers()); !reflect.DeepEqual(got, []string{"b", "d"}) {
+		t.Errorf("LiveMembers() = %v", got)
+	}
+
+	// Old news about d does not refresh it, so d fails once its timeout passes, while b keeps beating
+	*now = now.Add(6 * time.Second)
+	gossip(t, members, "b", []gossipMember{{"b", "b:1", 6}, {"d", "d:1", 7}})
+	*now = now.Add(6 * time.Second)
+	if got := nodeIds(members.LiveMembers()); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("LiveMembers() after d failed = %v", got)
+	}
+	if got := nodeIds(members.Members()); !reflect.DeepEqual(got, []string{"b", "d"}) {
+		t.Errorf("Members() after d failed = %v", got)
+	}
+	if got, want := members.peerAddresses(), []string{"b:1", "c:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("peerAddresses() after d failed = %v, want %v", got, want)
+	}
+
+	// Failed members are forgotten after twice the timeout, and come back when they beat again
+	*now = now.Add(9 * time.Second)
+	if got := nodeIds(members.Members()); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("Members() after d forgotten = %v", got)
+	}
+	gossip(t, members, "d", []gossipMember{{"d", "d:1", 8}})
+	if got := nodeIds(members.LiveMembers()); !reflect.DeepEqual(got, []string{"d"}) {
+		t.Errorf("LiveMembers() after d came back = %v", got)
+	}
+	// b failed but is still known; being a seed, it is dialed again until it comes back
+	if got := nodeIds(members.Members()); !reflect.DeepEqual(got, []string{"b", "d"}) {
+		t.Errorf("Members() after b failed = %v", got)
+	}
+	if got, want := members.peerAddresses(), []string{"d:1", "b:1", "c:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("peerAddresses() after b failed = %v, want %v", got, want)
+	}
+}
+
+func TestMembershipPublish(t *testing.T) {
+	members, _ := newTestMembership(Config{NodeId: "a", AdvertiseAddress: "a:1", StaleAfterSeconds: 10})
+	gossip(t, members, "b", []gossipMember{{"b", "b:1", 3}})
+
+	members.publish()
+	got := members.publish().([]gossipMember)
+	want := []gossipMember{{"a", "a:1", 2}, {"b", "b:1", 3}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("publish() = %v, want %v", got, want)
+	}
+}
+
+func newTestMembership(config Config) (*Membership, *time.Time) {
+	now := time.Unix(100, 0)
+	members := newMembership(config)
+	members.now = func() time.Time {
+		return now
+	}
+	return members, &now
+}
+
+func gossip(t *testing.T, members *Membership, from string, gossip []gossipMember) {
+	t.Helper()
+	payload, err := json.Marshal(gossip)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	members.receive(from, payload)
+}
+
+func nodeIds(members []Member) []string {
+	ids := []string{}
+	for _, m := range members {
+		ids = append(ids, m.NodeId)
+	}
+	return ids
+}
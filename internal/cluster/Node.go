@@ -0,0 +1,244 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/danielepagano/teleport-int-load-balancer/internal/security"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// MaxMessageBytes caps how much a peer can send in one push, to protect against misbehaving peers
+const MaxMessageBytes = 16 << 20
+
+// peerIOTimeout bounds how long a push to or from a peer can take
+const peerIOTimeout = 5 * time.Second
+
+// Node exchanges state with the other instances of a cluster over mTLS
+// Each kind of state has a publisher, which produces the local state pushed to peers at every sync,
+// and a handler, which receives the state pushed by each peer
+type Node struct {
+	config     Config
+	serverTLS  *tls.Config
+	clientTLS  *tls.Config
+	members    *Membership
+	lock       sync.RWMutex
+	publishers map[string]func() any
+	handlers   map[string]func(from string, payload json.RawMessage)
+}
+
+// message is the unit of exchange between nodes
+type message struct {
+	From    string
+	Kind    string
+	Payload json.RawMessage
+}
+
+func NewNode(config Config, serverTLS *tls.Config, clientTLS *tls.Config) (*Node, error) {
+	if config.NodeId == "" {
+		return nil, fmt.Errorf("cluster node requires an id")
+	}
+	if config.AdvertiseAddress == "" {
+		return nil, fmt.Errorf("cluster node requires an advertised address")
+	}
+	if config.SyncIntervalMillis <= 0 {
+		return nil, fmt.Errorf("cluster sync interval must be positive")
+	}
+	if config.StaleAfterSeconds <= 0 || config.MaxWindowSeconds <= 0 {
+		return nil, fmt.Errorf("cluster stale time and max window must be positive")
+	}
+	node := &Node{
+		config:     config,
+		serverTLS:  serverTLS,
+		clientTLS:  clientTLS,
+		members:    newMembership(config),
+		publishers: map[string]func() any{},
+		handlers:   map[string]func(from string, payload json.RawMessage){},
+	}
+	// Heartbeats and member lists travel with every sync
+	node.Publish(membersKind, node.members.publish)
+	node.Handle(membersKind, node.members.receive)
+	return node, nil
+}
+
+func (n *Node) Id() string {
+	return n.config.NodeId
+}
+
+// Publish registers a function producing the local state of a kind, which is pushed to peers at every sync
+func (n *Node) Publish(kind string, publisher func() any) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.publishers[kind] = publisher
+}
+
+// Handle registers a function receiving the state of a kind pushed by a peer
+func (n *Node) Handle(kind string, handler func(from string, payload json.RawMessage)) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.handlers[kind] = handler
+}
+
+// Peers returns the addresses of the other instances to sync with
+func (n *Node) Peers() []string {
+	return n.members.peerAddresses()
+}
+
+// Members returns the membership of the cluster, as seen by this instance
+func (n *Node) Members() *Membership {
+	return n.members
+}
+
+// Start listens for peers, and pushes state to them until the listener fails
+func (n *Node) Start() error {
+	listener, err := n.Listen()
+	if err != nil {
+		return err
+	}
+	return n.Serve(listener)
+}
+
+// Listen opens the listener for peers, so that a failure to do so can be reported before serving
+func (n *Node) Listen() (net.Listener, error) {
+	return tls.Listen("tcp", n.config.ListenAddress, n.serverTLS)
+}
+
+// Serve accepts peers on listener, and pushes state to them until the listener fails
+func (n *Node) Serve(listener net.Listener) error {
+	defer listener.Close()
+	log.Println("STARTED CLUSTER NODE", n.config.NodeId, "on", n.config.ListenAddress)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go n.syncLoop(stop)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Println("CLUSTER Failed to accept peer connection", "ERROR:", err)
+			continue
+		}
+		go n.receive(conn)
+	}
+}
+
+func (n *Node) syncLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(n.config.SyncIntervalMillis) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.sync()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sync pushes the current local state to every peer
+func (n *Node) sync() {
+	messages, err := n.collect()
+	if err != nil {
+		log.Println("CLUSTER Failed to collect local state", "ERROR:", err)
+		return
+	}
+	for _, peer := range n.Peers() {
+		go func(peer string) {
+			if err := n.send(peer, messages); err != nil {
+				log.Println("CLUSTER Failed to sync with peer", peer, "ERROR:", err)
+			}
+		}(peer)
+	}
+}
+
+func (n *Node) collect() ([]message, error) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	messages := make([]message, 0, len(n.publishers))
+	for kind, publish := range n.publishers {
+		payload, err := json.Marshal(publish())
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message{From: n.config.NodeId, Kind: kind, Payload: payload})
+	}
+	return messages, nil
+}
+
+// send pushes messages to a peer over a new connection
+func (n *Node) send(address string, messages []message) error {
+	dialer := &net.Dialer{Timeout: peerIOTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, n.clientTLS)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(peerIOTimeout)); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(conn)
+	for _, m := range messages {
+		if err = encoder.Encode(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receive dispatches the messages pushed by a peer to their handlers; a peer may only push its own state
+func (n *Node) receive(conn net.Conn) {
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(peerIOTimeout)); err != nil {
+		return
+	}
+	peerId, err := authenticatePeer(conn)
+	if err != nil {
+		log.Println("CLUSTER Failed to authenticate peer", conn.RemoteAddr(), "ERROR:", err)
+		return
+	}
+	decoder := json.NewDecoder(io.LimitReader(conn, MaxMessageBytes))
+	for {
+		var m message
+		err = decoder.Decode(&m)
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			log.Println("CLUSTER Failed to read from peer", conn.RemoteAddr(), "ERROR:", err)
+			return
+		}
+		if m.From == n.config.NodeId {
+			continue // Our own state, e.g. if we are listed among our peers
+		}
+		if m.From != peerId {
+			log.Println("CLUSTER Peer", peerId, "at", conn.RemoteAddr(), "sent state as", m.From)
+			return
+		}
+		n.lock.RLock()
+		handler, found := n.handlers[m.Kind]
+		n.lock.RUnlock()
+		if found {
+			handler(m.From, m.Payload)
+		}
+	}
+}
+
+// authenticatePeer completes the handshake of a peer connection, and returns the node id of its certificate
+func authenticatePeer(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", fmt.Errorf("not a TLS connection")
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	return security.PeerNodeId(tlsConn.ConnectionState())
+}
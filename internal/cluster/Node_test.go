@@ -0,0 +1,155 @@
+package cluster
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewNodeValidation(t *testing.T) {
+	valid := Config{NodeId: "a", AdvertiseAddress: "a:1", SyncIntervalMillis: 1000, StaleAfterSeconds: 10, MaxWindowSeconds: 60}
+	if _, err := NewNode(valid, nil, nil); err != nil {
+		t.Fatalf("NewNode() error = %v for a valid config", err)
+	}
+	tests := []struct {
+		name   string
+		modify func(config *Config)
+	}{
+		{name: "no id", modify: func(c *Config) { c.NodeId = "" }},
+		{name: "no address", modify: func(c *Config) { c.AdvertiseAddress = "" }},
+		{name: "no sync interval", modify: func(c *Config) { c.SyncIntervalMillis = 0 }},
+		{name: "no stale time", modify: func(c *Config) { c.StaleAfterSeconds = 0 }},
+		{name: "negative max window", modify: func(c *Config) { c.MaxWindowSeconds = -1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := valid
+			tt.modify(&config)
+			if _, err := NewNode(config, nil, nil); err == nil {
+				t.Errorf("NewNode(%+v) succeeded, want error", config)
+			}
+		})
+	}
+}
+
+func TestNode_receiveBindsSender(t *testing.T) {
+	serverTLS, peerTLS := testPeerTLS(t, "a", "b")
+	node, err := NewNode(Config{NodeId: "a", AdvertiseAddress: "a:1", SyncIntervalMillis: 1000, StaleAfterSeconds: 10,
+		MaxWindowSeconds: 60}, serverTLS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	var received []string
+	node.Handle("test", func(from string, _ json.RawMessage) {
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, from)
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err == nil {
+			node.receive(tls.Server(conn, serverTLS))
+		}
+	}()
+
+	// Peer b pushes its own state, then claims to be c
+	conn, err := tls.Dial("tcp", listener.Addr().String(), peerTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := json.NewEncoder(conn)
+	for _, from := range []string{"b", "c", "b"} {
+		if err = encoder.Encode(message{From: from, Kind: "test", Payload: json.RawMessage("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = conn.Close()
+	<-done
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(received) != 1 || received[0] != "b" {
+		t.Errorf("received state from %v, want only the first push of b", received)
+	}
+}
+
+// testPeerTLS creates a CA, and returns the server config of serverId and the client config of clientId,
+// whose certificates identify them as peers
+func testPeerTLS(t *testing.T, serverId string, clientId string) (*tls.Config, *tls.Config) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	issue := func(serial int64, nodeId string) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: nodeId},
+			URIs:         []*url.URL{{Scheme: "lb-peer", Host: nodeId}},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	serverTLS := &tls.Config{
+		Certificates: []tls.Certificate{issue(2, serverId)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS13,
+	}
+	clientTLS := &tls.Config{
+		Certificates:       []tls.Certificate{issue(3, clientId)},
+		RootCAs:            pool,
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true,
+	}
+	return serverTLS, clientTLS
+}
@@ -0,0 +1,96 @@
+package cluster
+
+import (
+	"encoding/json"
+	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
+	"log"
+	"sync"
+	"time"
+)
+
+const rateLimitsKind = "ratelimits"
+
+// RateLimitStore is a lbproxy.RateLimitStore shared by the instances of a cluster, so that together they enforce
+// one combined limit. Each instance keeps its own usage in memory and pushes it to the others at every sync;
+// the usage of a scope is the sum of the local usage and the latest usage received from each peer.
+// Limits are therefore eventually consistent: during a sync interval, the cluster may overshoot them
+type RateLimitStore struct {
+	*lbproxy.MemoryRateLimitStore // Usage of this instance
+	node                          *Node
+	lock                          sync.RWMutex
+	peers                         map[string]peerRateLimits // By node id
+	now                           func() time.Time          // Current time, can be changed for testing
+}
+
+type peerRateLimits struct {
+	received time.Time
+	scopes   map[string]lbproxy.RateLimitUsage
+}
+
+func NewRateLimitStore(node *Node) *RateLimitStore {
+	store := &RateLimitStore{
+		MemoryRateLimitStore: lbproxy.CreateMemoryRateLimitStore(),
+		node:                 node,
+		peers:                map[string]peerRateLimits{},
+		now:                  time.Now,
+	}
+	node.Publish(rateLimitsKind, store.publish)
+	node.Handle(rateLimitsKind, store.receive)
+	return store
+}
+
+// Usage combines the usage of this instance with the usage last received from each live peer
+func (s *RateLimitStore) Usage(scope string, windowStart int64) lbproxy.RateLimitUsage {
+	usage := s.MemoryRateLimitStore.Usage(scope, windowStart)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	staleBefore := s.now().Add(-time.Duration(s.node.config.StaleAfterSeconds) * time.Second)
+	combined := lbproxy.RateLimitUsage{OpenConnections: usage.OpenConnections, Timestamps: usage.Timestamps}
+	for _, peer := range s.peers {
+		if peer.received.Before(staleBefore) {
+			continue
+		}
+		peerUsage, found := peer.scopes[scope]
+		if !found {
+			continue
+		}
+		combined.OpenConnections += peerUsage.OpenConnections
+		combined.Timestamps = mergeWindow(combined.Timestamps, peerUsage.Timestamps, windowStart)
+	}
+	return combined
+}
+
+func (s *RateLimitStore) publish() any {
+	return s.Scopes(s.now().Unix() - s.node.config.MaxWindowSeconds)
+}
+
+func (s *RateLimitStore) receive(from string, payload json.RawMessage) {
+	var scopes map[string]lbproxy.RateLimitUsage
+	if err := json.Unmarshal(payload, &scopes); err != nil {
+		log.Println("CLUSTER Invalid rate limits from", from, "ERROR:", err)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.peers[from] = peerRateLimits{received: s.now(), scopes: scopes}
+}
+
+// mergeWindow returns a new sorted list with the elements of a, and the elements of b at or after windowStart
+func mergeWindow(a []int64, b []int64, windowStart int64) []int64 {
+	merged := make([]int64, 0, len(a)+len(b))
+	i, j := 0, 0
+	for j < len(b) && b[j] < windowStart {
+		j++
+	}
+	for i < len(a) || j < len(b) {
+		if j >= len(b) || (i < len(a) && a[i] <= b[j]) {
+			merged = append(merged, a[i])
+			i++
+		} else {
+			merged = append(merged, b[j])
+			j++
+		}
+	}
+	return merged
+}
@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"encoding/json"
+	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRateLimitStoreCombinesPeers(t *testing.T) {
+	store, now := newTestRateLimitStore(t)
+	store.AddConnection("one.com@echo", 100, true)
+	store.AddConnection("one.com@echo", 104, true)
+
+	receiveRateLimits(t, store, "b", map[string]lbproxy.RateLimitUsage{
+		"one.com@echo": {OpenConnections: 2, Timestamps: []int64{90, 101, 105}},
+		"two.com@echo": {OpenConnections: 1, Timestamps: []int64{103}},
+	})
+	receiveRateLimits(t, store, "c", map[string]lbproxy.RateLimitUsage{
+		"one.com@echo": {OpenConnections: 1, Timestamps: []int64{102}},
+	})
+
+	want := lbproxy.RateLimitUsage{OpenConnections: 5, Timestamps: []int64{100, 101, 102, 104, 105}}
+	if got := store.Usage("one.com@echo", 95); !reflect.DeepEqual(got, want) {
+		t.Errorf("Usage() = %v, want %v", got, want)
+	}
+
+	// Once peers stop syncing, e.g. because they crashed, their usage no longer counts
+	*now = now.Add(11 * time.Second)
+	want = lbproxy.RateLimitUsage{OpenConnections: 2, Timestamps: []int64{100, 104}}
+	if got := store.Usage("one.com@echo", 95); !reflect.DeepEqual(got, want) {
+		t.Errorf("Usage() after stale = %v, want %v", got, want)
+	}
+}
+
+func TestRateLimitStoreEnforcesCombinedLimit(t *testing.T) {
+	store, _ := newTestRateLimitStore(t)
+	receiveRateLimits(t, store, "b", map[string]lbproxy.RateLimitUsage{
+		"one.com@echo": {OpenConnections: 2, Timestamps: []int64{}},
+	})
+
+	rlm := lbproxy.CreateSharedRateLimitManager("one.com@echo", lbproxy.RateLimitManagerConfig{
+		MaxOpenConnections: 3,
+		MaxRateAmount:      -1,
+	}, store)
+	if !rlm.AddConnection().Allowed() {
+		t.Fatalf("AddConnection() denied below combined limit")
+	}
+	if d := rlm.AddConnection(); d.Trigger != lbproxy.TriggerMaxOpen || d.OpenConnections != 3 {
+		t.Errorf("AddConnection() = %v, want denied with 3 open across the cluster", d)
+	}
+}
+
+func newTestRateLimitStore(t *testing.T) (*RateLimitStore, *time.Time) {
+	t.Helper()
+	node, err := NewNode(Config{NodeId: "a", AdvertiseAddress: "a:1", SyncIntervalMillis: 1000, StaleAfterSeconds: 10, MaxWindowSeconds: 60}, nil, nil)
+	if err != nil {
+		t.Fatalf("NewNode() error = %v", err)
+	}
+	now := time.Unix(110, 0)
+	store := NewRateLimitStore(node)
+	store.now = func() time.Time {
+		return now
+	}
+	return store, &now
+}
+
+func receiveRateLimits(t *testing.T, store *RateLimitStore, from string, scopes map[string]lbproxy.RateLimitUsage) {
+	t.Helper()
+	payload, err := json.Marshal(scopes)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	store.receive(from, payload)
+}
@@ -0,0 +1,99 @@
+package cluster
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+const upstreamLoadsKind = "upstreams"
+
+// UpstreamLoadStore is a lbproxy.UpstreamLoadStore shared by the instances of a cluster
+// Each instance pushes its open connections per upstream at every sync, with a lease of StaleAfterSeconds;
+// the receiving instances hold those counts until the lease expires, unless the next sync renews it.
+// That way, the connections of an instance that crashed expire instead of being counted forever
+type UpstreamLoadStore struct {
+	node  *Node
+	lock  sync.RWMutex
+	local map[string]map[string]int // Open connections by app name and upstream address on this instance
+	peers map[string]peerLoads      // By node id
+	now   func() time.Time          // Current time, can be changed for testing
+}
+
+type peerLoads struct {
+	expires time.Time
+	apps    map[string]map[string]int
+}
+
+// upstreamLoads is the payload pushed to peers
+type upstreamLoads struct {
+	LeaseSeconds int64                     // How long the receiver can rely on these counts
+	Apps         map[string]map[string]int // Open connections by app name and upstream address
+}
+
+func NewUpstreamLoadStore(node *Node) *UpstreamLoadStore {
+	store := &UpstreamLoadStore{
+		node:  node,
+		local: map[string]map[string]int{},
+		peers: map[string]peerLoads{},
+		now:   time.Now,
+	}
+	node.Publish(upstreamLoadsKind, store.publish)
+	node.Handle(upstreamLoadsKind, store.receive)
+	return store
+}
+
+func (s *UpstreamLoadStore) PeerLoads(appName string) map[string]int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	now := s.now()
+	loads := map[string]int{}
+	for _, peer := range s.peers {
+		if !now.Before(peer.expires) {
+			continue
+		}
+		for upstream, count := range peer.apps[appName] {
+			loads[upstream] += count
+		}
+	}
+	return loads
+}
+
+func (s *UpstreamLoadStore) PublishLoads(appName string, loads map[string]int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.local[appName] = loads
+}
+
+func (s *UpstreamLoadStore) publish() any {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// Expired leases are dropped here, since this runs periodically
+	now := s.now()
+	for node, peer := range s.peers {
+		if !now.Before(peer.expires) {
+			delete(s.peers, node)
+		}
+	}
+	// Maps in local are replaced rather than modified, so they can be shared with the encoder
+	apps := make(map[string]map[string]int, len(s.local))
+	for app, loads := range s.local {
+		apps[app] = loads
+	}
+	return upstreamLoads{LeaseSeconds: s.node.config.StaleAfterSeconds, Apps: apps}
+}
+
+func (s *UpstreamLoadStore) receive(from string, payload json.RawMessage) {
+	var loads upstreamLoads
+	if err := json.Unmarshal(payload, &loads); err != nil {
+		log.Println("CLUSTER Invalid upstream loads from", from, "ERROR:", err)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.peers[from] = peerLoads{
+		expires: s.now().Add(time.Duration(loads.LeaseSeconds) * time.Second),
+		apps:    loads.Apps,
+	}
+}
@@ -0,0 +1,50 @@
+package cluster
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUpstreamLoadStoreLeases(t *testing.T) {
+	node, err := NewNode(Config{NodeId: "a", AdvertiseAddress: "a:1", SyncIntervalMillis: 1000, StaleAfterSeconds: 10, MaxWindowSeconds: 60}, nil, nil)
+	if err != nil {
+		t.Fatalf("NewNode() error = %v", err)
+	}
+	now := time.Unix(100, 0)
+	store := NewUpstreamLoadStore(node)
+	store.now = func() time.Time {
+		return now
+	}
+
+	receive := func(from string, leaseSeconds int64, apps map[string]map[string]int) {
+		payload, err := json.Marshal(upstreamLoads{LeaseSeconds: leaseSeconds, Apps: apps})
+		if err != nil {
+			t.Fatalf("Marshal() error = %v", err)
+		}
+		store.receive(from, payload)
+	}
+	receive("b", 10, map[string]map[string]int{"echo": {"x:1": 2, "y:1": 1}})
+	receive("c", 5, map[string]map[string]int{"echo": {"x:1": 1}, "httpbin": {"z:1": 4}})
+
+	if got, want := store.PeerLoads("echo"), map[string]int{"x:1": 3, "y:1": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PeerLoads() = %v, want %v", got, want)
+	}
+
+	// The lease of c expires first, e.g. because it crashed and stopped renewing it
+	now = now.Add(5 * time.Second)
+	if got, want := store.PeerLoads("echo"), map[string]int{"x:1": 2, "y:1": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PeerLoads() after c expired = %v, want %v", got, want)
+	}
+
+	// Publishing drops expired leases, and shares local loads with the lease of this node
+	store.PublishLoads("echo", map[string]int{"x:1": 1})
+	published := store.publish().(upstreamLoads)
+	if published.LeaseSeconds != 10 || !reflect.DeepEqual(published.Apps, map[string]map[string]int{"echo": {"x:1": 1}}) {
+		t.Errorf("publish() = %v", published)
+	}
+	if _, found := store.peers["c"]; found {
+		t.Errorf("publish() kept expired lease of c")
+	}
+}
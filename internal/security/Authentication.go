@@ -3,33 +3,93 @@ package security
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type Authenticator interface {
 	GetCurrentTlsConfig() *tls.Config
+	// AuthenticateConnection completes the handshake of conn, and returns the client id from the certificate field
+	// chosen by ServerSecurityConfig.IdentitySource; if a verified certificate is rejected, e.g. because it is revoked,
+	// the client id is returned along with the error, so that the failure can be counted against the client
 	AuthenticateConnection(conn net.Conn) (string, error)
+	// AuthenticateState extracts the client id from a completed handshake, e.g. from an HTTP request
+	AuthenticateState(state tls.ConnectionState) (string, error)
+	// IsRevoked returns true if the CRL currently loaded revokes the client certificate of a handshake
+	IsRevoked(state tls.ConnectionState) bool
+	// OnRevocationsChanged registers a callback run whenever the CRL is reloaded, if live connections
+	// of revoked certificates must be terminated; otherwise the callback is never run
+	OnRevocationsChanged(callback func())
 }
 
+// NewAuthenticator loads the certificates in config; if config.ReloadSeconds is set, they are watched for changes,
+// so that rotated certificates are used for new handshakes, while existing connections are left alone
 func NewAuthenticator(config ServerSecurityConfig) (Authenticator, error) {
-	tlsConfig, err := loadTLSConfig(config)
+	if err := validateIdentitySource(config); err != nil {
+		return nil, err
+	}
+	if err := validateClientVerification(config); err != nil {
+		return nil, err
+	}
+	if (config.PeerCert == "") != (config.PeerKey == "") {
+		return nil, fmt.Errorf("peer certificate and key must be set together")
+	}
+	ocspChecker, err := newOcspChecker(config)
 	if err != nil {
 		return nil, err
 	}
-	return &staticAuthN{config, tlsConfig}, nil
+	a := &fileAuthN{ServerSecurityConfig: config, ocsp: ocspChecker}
+	if err = a.reload(); err != nil {
+		return nil, err
+	}
+	// Listeners keep this config for their whole life, so it defers each handshake to the current material
+	a.tlsConfig = &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return a.current.Load().config, nil
+		},
+		// Not used for handshakes, as GetConfigForClient takes over, but marks the config as having a certificate
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &a.current.Load().config.Certificates[0], nil
+		},
+	}
+	if config.ReloadSeconds > 0 {
+		go a.watch(time.Duration(config.ReloadSeconds) * time.Second)
+	} else if config.CrlFile != "" {
+		log.Println("WARNING: CRL", config.CrlFile, "is never reloaded, as ReloadSeconds is 0; later revocations need a restart")
+	}
+	return a, nil
 }
 
-type staticAuthN struct {
+type fileAuthN struct {
 	ServerSecurityConfig
-	tlsConfig *tls.Config
+	tlsConfig     *tls.Config                 // Handed out to listeners
+	current       atomic.Pointer[tlsMaterial] // Loaded from the files of the latest version
+	version       string                      // Version of the files current was loaded from; only used while (re)loading
+	callbacks     []func()                    // Run when revocations change; guarded by callbacksLock
+	callbacksLock sync.Mutex
+	ocsp          *ocspChecker // nil if certificates are not checked with OCSP
+}
+
+// tlsMaterial is everything loaded from the files of ServerSecurityConfig, swapped as a whole on reload
+type tlsMaterial struct {
+	config  *tls.Config
+	peer    *tls.Certificate // Presented to other instances of the cluster
+	revoked revokedSerials
+	issuer  *x509.Certificate // CA certificate, to check OCSP responses; only loaded if OCSP is enabled
 }
 
-func (a *staticAuthN) AuthenticateConnection(conn net.Conn) (string, error) {
+func (a *fileAuthN) AuthenticateConnection(conn net.Conn) (string, error) {
 	tlsConn, ok := conn.(*tls.Conn)
 	if !ok {
 		return "", fmt.Errorf("connection was not TLS")
@@ -38,31 +98,203 @@ func (a *staticAuthN) AuthenticateConnection(conn net.Conn) (string, error) {
 	// Perform handshake as we may have not sent or received data yet
 	// In a production server we would use a context to enforce a handshake timeout
 	err := tlsConn.Handshake()
-	if err != nil {
+	if handshakeUnavailable(err) {
+		return "", &UnavailableError{err}
+	} else if err != nil {
 		return "", err // Handled by caller
 	}
 
-	state := tlsConn.ConnectionState()
+	return a.AuthenticateState(tlsConn.ConnectionState())
+}
+
+// handshakeUnavailable returns true if a handshake failed because the client went away or was too slow,
+// rather than because of anything it sent
+func handshakeUnavailable(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func (a *fileAuthN) AuthenticateState(state tls.ConnectionState) (string, error) {
 	if len(state.PeerCertificates) == 0 {
 		return "", fmt.Errorf("no peer certificates present in incoming connection")
 	}
-	return strings.ToLower(state.PeerCertificates[0].Subject.CommonName), nil
+	cert := state.PeerCertificates[0]
+	// Proxy instances may hold certificates of the same CA as clients, but must never act as one
+	for _, uri := range cert.URIs {
+		if uri.Scheme == PeerURIScheme {
+			return "", fmt.Errorf("certificate of %s identifies a proxy instance, not a client", cert.Subject.CommonName)
+		}
+	}
+	clientId, err := clientIdentity(cert, a.ServerSecurityConfig)
+	if err != nil {
+		return "", err
+	}
+	current := a.current.Load()
+	if current.revoked.contains(cert) {
+		return clientId, fmt.Errorf("certificate of %s with serial %v is revoked", cert.Subject.CommonName, cert.SerialNumber)
+	}
+	if a.ocsp != nil {
+		issuer := current.issuer
+		// With CA verification, the client certificate may be issued by an intermediate rather than the CA
+		if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 1 {
+			issuer = state.VerifiedChains[0][1]
+		}
+		if err = a.ocsp.check(cert, issuer); err != nil {
+			return clientId, err
+		}
+	}
+	return clientId, nil
+}
+
+func (a *fileAuthN) IsRevoked(state tls.ConnectionState) bool {
+	return len(state.PeerCertificates) > 0 && a.current.Load().revoked.contains(state.PeerCertificates[0])
 }
 
-func (a *staticAuthN) GetCurrentTlsConfig() *tls.Config {
+func (a *fileAuthN) OnRevocationsChanged(callback func()) {
+	if !a.TerminateRevoked {
+		return
+	}
+	a.callbacksLock.Lock()
+	defer a.callbacksLock.Unlock()
+	a.callbacks = append(a.callbacks, callback)
+}
+
+func (a *fileAuthN) GetCurrentTlsConfig() *tls.Config {
 	return a.tlsConfig
 }
 
+// watch reloads the certificates whenever their files change
+func (a *fileAuthN) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.checkReload()
+	}
+}
+
+// checkReload reloads the certificates if their files changed since the last load; if they cannot be loaded,
+// e.g. because the certificate was replaced but the key not yet, the current ones are kept and the next check retries
+func (a *fileAuthN) checkReload() {
+	version, err := tlsFilesVersion(a.ServerSecurityConfig)
+	if err != nil {
+		log.Println("Could not check certificates for changes", "ERROR:", err)
+		return
+	}
+	if version == a.version {
+		return
+	}
+	if err = a.reload(); err != nil {
+		log.Println("Could not reload certificates, keeping the current ones", "ERROR:", err)
+		return
+	}
+	log.Println("Reloaded certificates; new handshakes will use them")
+
+	if a.CrlFile == "" {
+		return
+	}
+	a.callbacksLock.Lock()
+	callbacks := a.callbacks
+	a.callbacksLock.Unlock()
+	for _, callback := range callbacks {
+		callback()
+	}
+}
+
+func (a *fileAuthN) reload() error {
+	// Take the version first, so that files changing while loading are picked up by the next check
+	version, err := tlsFilesVersion(a.ServerSecurityConfig)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := loadTLSConfig(a.ServerSecurityConfig)
+	if err != nil {
+		return err
+	}
+	revoked, err := loadRevocations(a.ServerSecurityConfig)
+	if err != nil {
+		return err
+	}
+	material := &tlsMaterial{config: tlsConfig, peer: &tlsConfig.Certificates[0], revoked: revoked}
+	if a.PeerCert != "" {
+		peerCert, err := tls.LoadX509KeyPair(a.PeerCert, a.PeerKey)
+		if err != nil {
+			return err
+		}
+		material.peer = &peerCert
+	}
+	if a.ocsp != nil {
+		if material.issuer, err = loadCACertificate(a.CaCert); err != nil {
+			return err
+		}
+	}
+	a.current.Store(material)
+	a.version = version
+	return nil
+}
+
+// tlsFilesVersion summarizes the size and modification time of all files loadTLSConfig and loadRevocations read
+func tlsFilesVersion(config ServerSecurityConfig) (string, error) {
+	paths := []string{config.CaCert, config.ServerCert, config.ServerKey}
+	if config.PeerCert != "" {
+		paths = append(paths, config.PeerCert, config.PeerKey)
+	}
+	if config.CrlFile != "" {
+		paths = append(paths, config.CrlFile)
+	}
+	clientPaths, err := clientCertPaths(config)
+	if err != nil {
+		return "", err
+	}
+	paths = append(paths, clientPaths...)
+	var version strings.Builder
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// Missing pinned client certs are skipped when loading
+			fmt.Fprintf(&version, "%s:missing;", path)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&version, "%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+	}
+	return version.String(), nil
+}
+
 func loadTLSConfig(config ServerSecurityConfig) (*tls.Config, error) {
+	caCertPool, serverCert, err := loadServerMaterial(config)
+	if err != nil {
+		return nil, err
+	}
+
+	clientCertPool, err := loadClientCAs(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates:     []tls.Certificate{serverCert},
+		RootCAs:          caCertPool,
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		ClientCAs:        clientCertPool,
+		MinVersion:       tls.VersionTLS13,
+		VerifyConnection: verifyClientIssuer(config),
+	}, nil
+}
+
+// loadServerMaterial loads the CA certificate pool and the server certificate
+func loadServerMaterial(config ServerSecurityConfig) (*x509.CertPool, tls.Certificate, error) {
 	// Load CA certificate.
 	caCrt := filepath.Join(config.CaCert)
 	caCert, err := os.ReadFile(caCrt)
 	if err != nil {
-		return nil, err
+		return nil, tls.Certificate{}, err
 	}
 	caCertPool := x509.NewCertPool()
 	if ok := caCertPool.AppendCertsFromPEM(caCert); !ok {
-		return nil, fmt.Errorf("could not append CA certificate to pool")
+		return nil, tls.Certificate{}, fmt.Errorf("could not append CA certificate to pool")
 	}
 
 	// Load Server certificate
@@ -70,35 +302,7 @@ func loadTLSConfig(config ServerSecurityConfig) (*tls.Config, error) {
 	serverKey := filepath.Join(config.ServerKey)
 	serverCert, err := tls.LoadX509KeyPair(serverCrt, serverKey)
 	if err != nil {
-		return nil, err
-	}
-
-	// Load Client certificates
-	entries, err := os.ReadDir(config.ClientsCertPath)
-	if err != nil {
-		return nil, err
+		return nil, tls.Certificate{}, err
 	}
-	clientCertPool := x509.NewCertPool()
-	for _, e := range entries {
-		if e.IsDir() {
-			clientCertPath := filepath.Join(config.ClientsCertPath, e.Name(), e.Name()+config.ClientCertFileExt)
-			clientCert, err := os.ReadFile(clientCertPath)
-			if err != nil {
-				// In this case, we can just log and continue
-				log.Println("Could not load client cert for", e.Name(), "ERROR:", err)
-			} else {
-				if ok := clientCertPool.AppendCertsFromPEM(clientCert); !ok {
-					log.Println("Could not append client cert for", e.Name(), "to pool.", "ERROR:", err)
-				}
-			}
-		}
-	}
-
-	return &tls.Config{
-		Certificates: []tls.Certificate{serverCert},
-		RootCAs:      caCertPool,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    clientCertPool,
-		MinVersion:   tls.VersionTLS13,
-	}, nil
+	return caCertPool, serverCert, nil
 }
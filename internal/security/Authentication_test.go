@@ -1,15 +1,28 @@
 package security
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
 	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
+	"golang.org/x/crypto/ocsp"
 	"io"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // Warning: these certs will expire after Sept 2022
@@ -116,3 +129,511 @@ func startTLSListener(t *testing.T) (Authenticator, net.Listener) {
 	t.Log("TLS Listener started on", tlsListener.Addr().String())
 	return auth, tlsListener
 }
+
+func TestAuthenticatorReload(t *testing.T) {
+	dir := t.TempDir()
+	pki := newTestPKI(t)
+	testConfig := pki.write(t, dir, clientId)
+
+	auth, err := NewAuthenticator(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenerConfig := auth.GetCurrentTlsConfig()
+	if id := handshakeTestClient(t, auth, pki.clientConfig(t, clientId)); id != clientId {
+		t.Fatalf("authenticated client = %v, want %v", id, clientId)
+	}
+
+	// Rotate the whole PKI; the files must look changed, whatever the resolution of modification times
+	rotated := newTestPKI(t)
+	rotated.write(t, dir, clientId)
+	future := time.Now().Add(time.Hour)
+	for _, path := range []string{testConfig.CaCert, testConfig.ServerCert, testConfig.ServerKey} {
+		if err = os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auth.(*fileAuthN).checkReload()
+
+	if auth.GetCurrentTlsConfig() != listenerConfig {
+		t.Errorf("GetCurrentTlsConfig() changed after reload, want listeners to keep their config")
+	}
+	if id := handshakeTestClient(t, auth, rotated.clientConfig(t, clientId)); id != clientId {
+		t.Errorf("authenticated client after rotation = %v, want %v", id, clientId)
+	}
+	if _, err = handshake(auth, pki.clientConfig(t, clientId)); err == nil {
+		t.Errorf("handshake with the previous PKI succeeded after rotation, want error")
+	}
+}
+
+func TestAuthenticatorRevocation(t *testing.T) {
+	dir := t.TempDir()
+	pki := newTestPKI(t)
+	testConfig := pki.write(t, dir, clientId, "other")
+	testConfig.CrlFile = filepath.Join(dir, "ca.crl")
+	testConfig.TerminateRevoked = true
+	pki.writeCRL(t, testConfig.CrlFile)
+
+	auth, err := NewAuthenticator(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshakeTestClient(t, auth, pki.clientConfig(t, clientId))
+	changed := 0
+	auth.OnRevocationsChanged(func() { changed++ })
+
+	pki.writeCRL(t, testConfig.CrlFile, clientId)
+	future := time.Now().Add(time.Hour)
+	if err = os.Chtimes(testConfig.CrlFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	auth.(*fileAuthN).checkReload()
+
+	if changed != 1 {
+		t.Errorf("revocation callbacks run %d times, want 1", changed)
+	}
+	leaf, err := x509.ParseCertificate(pki.clients[clientId].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !auth.IsRevoked(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}) {
+		t.Errorf("IsRevoked() = false for a revoked certificate, want true")
+	}
+	// The client is still named, so that the failure counts against it
+	if id, err := auth.AuthenticateState(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}); err == nil || id != clientId {
+		t.Errorf("AuthenticateState() of a revoked certificate = %q, %v, want %s and an error", id, err, clientId)
+	}
+	if _, err = handshake(auth, pki.clientConfig(t, clientId)); err == nil {
+		t.Errorf("handshake with a revoked certificate succeeded, want error")
+	}
+	if id := handshakeTestClient(t, auth, pki.clientConfig(t, "other")); id != "other" {
+		t.Errorf("authenticated client = %v, want other", id)
+	}
+}
+
+func TestAuthenticatorOcsp(t *testing.T) {
+	dir := t.TempDir()
+	pki := newTestPKI(t)
+	testConfig := pki.write(t, dir, clientId, "revoked")
+	revokedLeaf, err := x509.ParseCertificate(pki.clients["revoked"].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, queries := pki.startOcspResponder(t, revokedLeaf.SerialNumber)
+	testConfig.OcspResponder = responder.URL
+
+	for _, policy := range []OcspPolicy{OcspSoftFail, OcspHardFail} {
+		t.Run(string(policy), func(t *testing.T) {
+			testConfig.OcspPolicy = policy
+			auth, err := NewAuthenticator(testConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			queries.Store(0)
+			handshakeTestClient(t, auth, pki.clientConfig(t, clientId))
+			handshakeTestClient(t, auth, pki.clientConfig(t, clientId))
+			if n := queries.Load(); n != 1 {
+				t.Errorf("responder queried %d times for two connections, want 1 as the response is cached", n)
+			}
+			if _, err = handshake(auth, pki.clientConfig(t, "revoked")); !IsSecurityFailure(err) {
+				t.Errorf("handshake with a certificate revoked by OCSP: error = %v, want a security failure", err)
+			}
+		})
+	}
+
+	// When the responder is down, only hard-fail rejects certificates
+	testConfig.OcspResponder = "http://127.0.0.1:1"
+	for policy, wantErr := range map[OcspPolicy]bool{OcspSoftFail: false, OcspHardFail: true} {
+		testConfig.OcspPolicy = policy
+		auth, err := NewAuthenticator(testConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = handshake(auth, pki.clientConfig(t, clientId)); (err != nil) != wantErr {
+			t.Errorf("%s with the responder down: error = %v, wantErr %v", policy, err, wantErr)
+		}
+		if IsSecurityFailure(err) {
+			t.Errorf("%s with the responder down: error = %v is a security failure, want the check unavailable", policy, err)
+		}
+	}
+
+	testConfig.OcspPolicy = "sometimes"
+	if _, err = NewAuthenticator(testConfig); err == nil {
+		t.Errorf("NewAuthenticator() with an unknown OCSP policy succeeded, want error")
+	}
+}
+
+func TestAuthenticatorUnavailable(t *testing.T) {
+	dir := t.TempDir()
+	pki := newTestPKI(t)
+	auth, err := NewAuthenticator(pki.write(t, dir, clientId))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A client that goes away before the handshake did not fail anything
+	serverSide, clientSide, err := connectedPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverSide.Close()
+	_ = clientSide.Close()
+	_ = serverSide.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = auth.AuthenticateConnection(tls.Server(serverSide, auth.GetCurrentTlsConfig())); err == nil || IsSecurityFailure(err) {
+		t.Errorf("client gone before the handshake: error = %v, want the check unavailable", err)
+	}
+
+	// A certificate from another CA does
+	other := newTestPKI(t)
+	other.write(t, t.TempDir(), clientId)
+	if _, err = handshake(auth, other.clientConfig(t, clientId)); !IsSecurityFailure(err) {
+		t.Errorf("certificate from another CA: error = %v, want a security failure", err)
+	}
+}
+
+func TestAuthenticatorClientCA(t *testing.T) {
+	dir := t.TempDir()
+	pki := newTestPKI(t)
+	testConfig := pki.write(t, dir, clientId)
+	// Client certificates are not needed on the proxy in CA mode
+	if err := os.RemoveAll(testConfig.ClientsCertPath); err != nil {
+		t.Fatal(err)
+	}
+	testConfig.ClientsCertPath = ""
+	testConfig.ClientVerification = VerifyClientCA
+	// The CA of the server also issues the server certificate, so CA mode does not trust it by default
+	if _, err := NewAuthenticator(testConfig); err == nil {
+		t.Errorf("NewAuthenticator() in CA mode without a client CA bundle succeeded, want error")
+	}
+	testConfig.ClientCaBundle = testConfig.CaCert
+
+	tests := []struct {
+		name      string
+		issuerCN  string
+		issuerSKI string
+		wantErr   bool
+	}{
+		{name: "any issuer"},
+		{name: "issuer CN", issuerCN: "Test-CA"},
+		{name: "issuer SKI", issuerSKI: fmt.Sprintf("% x", pki.caCert.SubjectKeyId)},
+		{name: "wrong issuer CN", issuerCN: "other-ca", wantErr: true},
+		{name: "wrong issuer SKI", issuerSKI: "01:02:03", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig
+			c.ClientIssuerCN = tt.issuerCN
+			c.ClientIssuerSKI = strings.ReplaceAll(tt.issuerSKI, " ", ":")
+			auth, err := NewAuthenticator(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, err := handshake(auth, pki.clientConfig(t, clientId))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && id != clientId {
+				t.Errorf("authenticated client = %v, want %v", id, clientId)
+			}
+		})
+	}
+
+	// Clients of another CA are rejected
+	otherPKI := newTestPKI(t)
+	otherPKI.write(t, t.TempDir(), "stranger")
+	auth, err := NewAuthenticator(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = handshake(auth, otherPKI.clientConfig(t, "stranger")); err == nil {
+		t.Errorf("handshake with a certificate of another CA succeeded, want error")
+	}
+
+	// Peer certificates chain to the same CA, and may allow client authentication too
+	peerCert, err := tls.X509KeyPair(pki.issuePeer(t, "node-a", x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerConfig := pki.clientConfig(t, clientId)
+	peerConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &peerCert, nil
+	}
+	if _, err = handshake(auth, peerConfig); err == nil {
+		t.Errorf("handshake with a peer certificate succeeded, want error")
+	}
+
+	pinned := testConfig
+	pinned.ClientVerification = VerifyPinnedClients
+	pinned.ClientIssuerCN = "test-ca"
+	if _, err = NewAuthenticator(pinned); err == nil {
+		t.Errorf("NewAuthenticator() with issuer checks on pinned clients succeeded, want error")
+	}
+}
+
+// handshakeTestClient connects a client to a server using auth over an in-memory connection,
+// and returns the client id the server authenticated
+func handshakeTestClient(t *testing.T, auth Authenticator, clientConfig *tls.Config) string {
+	t.Helper()
+	id, err := handshake(auth, clientConfig)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	return id
+}
+
+func handshake(auth Authenticator, clientConfig *tls.Config) (string, error) {
+	serverSide, clientSide, err := connectedPair()
+	if err != nil {
+		return "", err
+	}
+	defer serverSide.Close()
+	defer clientSide.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	_ = serverSide.SetDeadline(deadline)
+	_ = clientSide.SetDeadline(deadline)
+
+	client := tls.Client(clientSide, clientConfig)
+	clientDone := make(chan error, 1)
+	go func() {
+		err := client.Handshake()
+		if err == nil {
+			// With TLS 1.3, the client only learns that the server rejected its certificate on the first read
+			_, err = client.Read(make([]byte, 1))
+		}
+		clientDone <- err
+	}()
+	id, err := auth.AuthenticateConnection(tls.Server(serverSide, auth.GetCurrentTlsConfig()))
+	if err != nil {
+		return "", err
+	}
+	_ = serverSide.Close()
+	<-clientDone
+	return id, nil
+}
+
+// connectedPair returns both ends of a loopback TCP connection; unlike net.Pipe, writes are buffered,
+// so that a server rejecting a client mid-handshake does not block on the client still writing
+func connectedPair() (net.Conn, net.Conn, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer listener.Close()
+	clientSide, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	serverSide, err := listener.Accept()
+	if err != nil {
+		_ = clientSide.Close()
+		return nil, nil, err
+	}
+	return serverSide, clientSide, nil
+}
+
+// testPKI is a CA with a server certificate, generated for each test so that it never expires
+type testPKI struct {
+	caCert    *x509.Certificate
+	caKey     *ecdsa.PrivateKey
+	caPEM     []byte
+	serverPEM []byte
+	serverKey []byte
+	clients   map[string]tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          randomSerial(t),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki := &testPKI{
+		caCert:  caCert,
+		caKey:   caKey,
+		caPEM:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		clients: map[string]tls.Certificate{},
+	}
+	pki.serverPEM, pki.serverKey = pki.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	return pki
+}
+
+// issue creates a certificate signed by the CA, and returns it with its key, PEM encoded
+func (p *testPKI) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	return p.sign(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		DNSNames:    []string{commonName},
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+	})
+}
+
+// sign completes template with a serial, validity and key, and returns the certificate signed by the CA
+// with its key, PEM encoded
+func (p *testPKI) sign(t *testing.T, template *x509.Certificate) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = randomSerial(t)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, p.caCert, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// write stores the PKI in dir, with a certificate for each client, laid out as ServerSecurityConfig expects
+func (p *testPKI) write(t *testing.T, dir string, clientIds ...string) ServerSecurityConfig {
+	t.Helper()
+	c := ServerSecurityConfig{
+		ClientsCertPath:   filepath.Join(dir, "clients"),
+		ClientCertFileExt: ".crt",
+		ClientCertKeyExt:  ".key",
+		CaCert:            filepath.Join(dir, "ca.crt"),
+		ServerCert:        filepath.Join(dir, "server.crt"),
+		ServerKey:         filepath.Join(dir, "server.key"),
+	}
+	writeTestFile(t, c.CaCert, p.caPEM)
+	writeTestFile(t, c.ServerCert, p.serverPEM)
+	writeTestFile(t, c.ServerKey, p.serverKey)
+	for _, id := range clientIds {
+		certPEM, keyPEM := p.issue(t, id, x509.ExtKeyUsageClientAuth)
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.clients[id] = cert
+		clientDir := filepath.Join(c.ClientsCertPath, id)
+		if err = os.MkdirAll(clientDir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, filepath.Join(clientDir, id+c.ClientCertFileExt), certPEM)
+		writeTestFile(t, filepath.Join(clientDir, id+c.ClientCertKeyExt), keyPEM)
+	}
+	return c
+}
+
+// writeCRL writes a CRL signed by the CA to path, revoking the certificates of clientIds
+func (p *testPKI) writeCRL(t *testing.T, path string, clientIds ...string) {
+	t.Helper()
+	var revoked []pkix.RevokedCertificate
+	for _, id := range clientIds {
+		leaf, err := x509.ParseCertificate(p.clients[id].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: leaf.SerialNumber, RevocationTime: time.Now()})
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              randomSerial(t),
+		ThisUpdate:          time.Now().Add(-time.Minute),
+		NextUpdate:          time.Now().Add(time.Hour),
+		RevokedCertificates: revoked,
+	}, p.caCert, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}))
+}
+
+// clientConfig returns the TLS config of a client written by write
+func (p *testPKI) clientConfig(t *testing.T, clientId string) *tls.Config {
+	t.Helper()
+	cert, found := p.clients[clientId]
+	if !found {
+		t.Fatalf("no certificate for client %s", clientId)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(p.caCert)
+	return &tls.Config{
+		RootCAs:    roots,
+		ServerName: "localhost",
+		// The server trusts client certificates individually, so the issuers it requests never match the CA
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		},
+	}
+}
+
+// startOcspResponder serves OCSP responses signed by the CA, reporting revoked serials as revoked and all others as good;
+// it returns the server, and a counter of the requests it received
+func (p *testPKI) startOcspResponder(t *testing.T, revoked ...*big.Int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	queries := new(atomic.Int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		template := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		for _, serial := range revoked {
+			if serial.Cmp(request.SerialNumber) == 0 {
+				template.Status = ocsp.Revoked
+				template.RevokedAt = time.Now().Add(-time.Minute)
+			}
+		}
+		response, err := ocsp.CreateResponse(p.caCert, p.caCert, template, p.caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(response)
+	}))
+	t.Cleanup(server.Close)
+	return server, queries
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func randomSerial(t *testing.T) *big.Int {
+	t.Helper()
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serial
+}
@@ -2,38 +2,291 @@ package security
 
 import (
 	"fmt"
+	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
+	"net"
+	"path"
+	"sort"
 	"strings"
+	"time"
 )
 
 type Authorizer interface {
-	AuthorizeClient(clientId string, appId string) error
+	// AuthorizeClient returns the grant of a client to an app, or an error naming the rule that denied access
+	AuthorizeClient(identity ClientIdentity, appId string) (AppGrant, error)
 }
 
 type ClientID string
 type AppID string
-type ClientPermissions map[ClientID]map[AppID]struct{}
 
-func NewAuthorizer(permissions ClientPermissions) Authorizer {
-	return &simpleAuthZ{ClientPermissions: permissions}
+// ClientPermissions lists the apps each client may access directly; app ids may be glob patterns, e.g. "billing-*"
+type ClientPermissions map[ClientID]map[AppID]AppGrant
+
+// AppGrant is the access of a client to an app, with any settings that apply to that client only
+type AppGrant struct {
+	ConnectionLimits *lbproxy.ConnectionLimits       // Replaces the connection limits of the app; nil to keep them
+	RateLimits       *lbproxy.RateLimitManagerConfig // Replaces the client rate limits of the app; nil to keep them
+	SourceNetworks   []string                        // CIDRs the client may connect from, IPv4 or IPv6; empty for anywhere
+	NotBefore        time.Time                       // When the grant becomes active; zero if active right away
+	NotAfter         time.Time                       // When the grant expires; zero if it never does
+	Schedule         []AccessWindow                  // Recurring windows in which the grant is active; empty for always
+	CloseOnExpiry    bool                            // Close open connections when the grant stops being active
+	sourceNetworks   []*net.IPNet                    // Parsed SourceNetworks; nil until the grant is prepared
+	schedule         []parsedAccessWindow            // Parsed Schedule; nil until the grant is prepared
+}
+
+// Role grants access to a set of apps, and can be given to clients directly or through their groups
+type Role struct {
+	Apps     []string // App ids or glob patterns the role grants access to
+	DenyApps []string // App ids or glob patterns the role denies access to, even if granted by other roles or permissions
+	Grant    AppGrant // Settings of clients accessing an app through this role
+}
+
+// AuthorizationPolicy sets which clients can access which apps
+type AuthorizationPolicy struct {
+	Clients     ClientPermissions   // Apps each client may access directly
+	Roles       map[string]Role     // Roles by name
+	ClientRoles map[string][]string // Names of the roles of each client, by client id
+	GroupRoles  map[string][]string // Names of the roles of each group, by group from IdentityRule
+}
+
+func NewAuthorizer(policy AuthorizationPolicy) (Authorizer, error) {
+	policy, err := normalizePolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	for name, role := range policy.Roles {
+		for _, pattern := range append(append([]string{}, role.Apps...), role.DenyApps...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("role %s has an invalid app pattern %q. %w", name, pattern, err)
+			}
+		}
+	}
+	for name, role := range policy.Roles {
+		if role.Grant, err = prepareGrant(role.Grant); err != nil {
+			return nil, fmt.Errorf("role %s: %w", name, err)
+		}
+		policy.Roles[name] = role
+	}
+	for clientId, apps := range policy.Clients {
+		for pattern, grant := range apps {
+			if _, err := path.Match(string(pattern), ""); err != nil {
+				return nil, fmt.Errorf("client %s has an invalid app pattern %q. %w", clientId, pattern, err)
+			}
+			if apps[pattern], err = prepareGrant(grant); err != nil {
+				return nil, fmt.Errorf("client %s grant to %s: %w", clientId, pattern, err)
+			}
+		}
+	}
+	for _, bindings := range []map[string][]string{policy.ClientRoles, policy.GroupRoles} {
+		for subject, roles := range bindings {
+			for _, role := range roles {
+				if _, found := policy.Roles[role]; !found {
+					return nil, fmt.Errorf("%s is bound to unknown role %s", subject, role)
+				}
+			}
+		}
+	}
+	return &policyAuthZ{AuthorizationPolicy: policy, timeSupplier: time.Now}, nil
+}
+
+// normalizePolicy returns a copy of policy with client ids, groups and app patterns in lowercase,
+// as they are matched against lowercase ids; ids that only differ by case would be ambiguous, so they are rejected
+func normalizePolicy(policy AuthorizationPolicy) (AuthorizationPolicy, error) {
+	normalized := AuthorizationPolicy{
+		Clients:     ClientPermissions{},
+		Roles:       map[string]Role{},
+		ClientRoles: map[string][]string{},
+		GroupRoles:  map[string][]string{},
+	}
+	for clientId, apps := range policy.Clients {
+		key := ClientID(strings.ToLower(string(clientId)))
+		if _, found := normalized.Clients[key]; found {
+			return AuthorizationPolicy{}, fmt.Errorf("client %s has permissions under several ids differing by case", key)
+		}
+		normalized.Clients[key] = map[AppID]AppGrant{}
+		for pattern, grant := range apps {
+			app := AppID(strings.ToLower(string(pattern)))
+			if _, found := normalized.Clients[key][app]; found {
+				return AuthorizationPolicy{}, fmt.Errorf("client %s has several grants to %s differing by case", key, app)
+			}
+			normalized.Clients[key][app] = grant
+		}
+	}
+	for name, role := range policy.Roles {
+		role.Apps = lowerAll(role.Apps)
+		role.DenyApps = lowerAll(role.DenyApps)
+		normalized.Roles[name] = role
+	}
+	for _, bindings := range []struct {
+		from map[string][]string
+		to   map[string][]string
+	}{{policy.ClientRoles, normalized.ClientRoles}, {policy.GroupRoles, normalized.GroupRoles}} {
+		for subject, roles := range bindings.from {
+			key := strings.ToLower(subject)
+			if _, found := bindings.to[key]; found {
+				return AuthorizationPolicy{}, fmt.Errorf("%s is bound to roles under several names differing by case", key)
+			}
+			bindings.to[key] = roles
+		}
+	}
+	return normalized, nil
+}
+
+func lowerAll(values []string) []string {
+	lowered := make([]string, 0, len(values))
+	for _, value := range values {
+		lowered = append(lowered, strings.ToLower(value))
+	}
+	return lowered
+}
+
+// prepareGrant checks that the settings of a grant can be applied, and returns it with them parsed,
+// so that they are not parsed again on every connection
+func prepareGrant(grant AppGrant) (AppGrant, error) {
+	var err error
+	if grant.sourceNetworks, err = ParseNetworks(grant.SourceNetworks); err != nil {
+		return AppGrant{}, err
+	}
+	if limits := grant.RateLimits; limits != nil {
+		if limits.MaxOpenConnections == 0 || limits.MaxRateAmount == 0 {
+			return AppGrant{}, fmt.Errorf("grant has zero allowed rate")
+		}
+		if err = lbproxy.ValidateLimits(*limits); err != nil {
+			return AppGrant{}, err
+		}
+	}
+	if !grant.NotBefore.IsZero() && !grant.NotAfter.IsZero() && !grant.NotBefore.Before(grant.NotAfter) {
+		return AppGrant{}, fmt.Errorf("grant is never active, as NotBefore %v is not before NotAfter %v", grant.NotBefore, grant.NotAfter)
+	}
+	grant.schedule = make([]parsedAccessWindow, len(grant.Schedule))
+	for i, w := range grant.Schedule {
+		if grant.schedule[i], err = parseAccessWindow(w); err != nil {
+			return AppGrant{}, fmt.Errorf("invalid access window %d. %w", i, err)
+		}
+	}
+	return grant, nil
+}
+
+type policyAuthZ struct {
+	AuthorizationPolicy
+	timeSupplier func() time.Time
 }
 
-type simpleAuthZ struct {
-	ClientPermissions ClientPermissions
+// boundRole is a role given to a client, with the reason it was given, for error messages
+type boundRole struct {
+	name string
+	via  string
 }
 
-func (a *simpleAuthZ) AuthorizeClient(clientId string, appId string) error {
+// candidateGrant is a grant matching an app, with the rule it comes from, for error messages
+type candidateGrant struct {
+	rule  string
+	grant AppGrant
+}
+
+// AuthorizeClient checks, in order: deny patterns of all roles of the client, its own permissions, then its roles
+// by name. Exact app ids take precedence over patterns within permissions, so that specific grants apply.
+// The first grant active at the time of the connection is returned
+func (a *policyAuthZ) AuthorizeClient(identity ClientIdentity, appId string) (AppGrant, error) {
 	// Let's normalize client ids to lowercase, since they are not case-sensitive
 	// This is to match with https://www.rfc-editor.org/rfc/rfc5280#section-4.2.1.6
 	// since we get client ids from X509 certificates
-	allowedApps, found := a.ClientPermissions[ClientID(strings.ToLower(clientId))]
-	if !found {
+	clientId := strings.ToLower(identity.ClientId)
+	app := strings.ToLower(appId)
+
+	roles := a.rolesOf(clientId, identity.Groups)
+	for _, bound := range roles {
+		if pattern, denied := matchApp(a.Roles[bound.name].DenyApps, app); denied {
+			return AppGrant{}, fmt.Errorf("client %s denied access to appId %s by role %s (%s) pattern %q",
+				clientId, appId, bound.name, bound.via, pattern)
+		}
+	}
+
+	allowedApps, found := a.Clients[ClientID(clientId)]
+	candidates := a.candidateGrants(allowedApps, roles, app)
+	now := a.timeSupplier()
+	for _, candidate := range candidates {
+		if candidate.grant.CheckActive(now) == nil {
+			return candidate.grant, nil
+		}
+	}
+	if len(candidates) > 0 {
+		// No grant is active at this time; report the first one, as it would apply otherwise
+		err := candidates[0].grant.CheckActive(now)
+		return AppGrant{}, fmt.Errorf("client %s not allowed to access appId %s at this time by %s. %w",
+			clientId, appId, candidates[0].rule, err)
+	}
+
+	if !found && len(roles) == 0 {
 		// Client could use false as normal not found, or raise an issue if we
 		// expect all incoming clients to be configured (or for better logging)
-		return fmt.Errorf("client not configured: %s", clientId)
+		return AppGrant{}, fmt.Errorf("client not configured: %s", clientId)
+	}
+	checked := make([]string, 0, len(roles))
+	for _, bound := range roles {
+		checked = append(checked, bound.name+" ("+bound.via+")")
+	}
+	return AppGrant{}, fmt.Errorf("client %s not allowed to access appId %s: no grant in its permissions or roles %v",
+		clientId, appId, checked)
+}
+
+// candidateGrants lists the grants of a client matching app, in the order they are tried
+func (a *policyAuthZ) candidateGrants(allowedApps map[AppID]AppGrant, roles []boundRole, app string) []candidateGrant {
+	var candidates []candidateGrant
+	if grant, allowed := allowedApps[AppID(app)]; allowed {
+		candidates = append(candidates, candidateGrant{rule: "permission " + app, grant: grant})
+	}
+	for _, pattern := range sortedAppPatterns(allowedApps) {
+		if matched, _ := path.Match(pattern, app); matched {
+			candidates = append(candidates, candidateGrant{rule: "permission " + pattern, grant: allowedApps[AppID(pattern)]})
+		}
+	}
+	for _, bound := range roles {
+		role := a.Roles[bound.name]
+		if _, allowed := matchApp(role.Apps, app); allowed {
+			candidates = append(candidates, candidateGrant{rule: "role " + bound.name + " (" + bound.via + ")", grant: role.Grant})
+		}
+	}
+	return candidates
+}
+
+// rolesOf returns the roles of a client, its own first, then those of its groups, each role once
+func (a *policyAuthZ) rolesOf(clientId string, groups []string) []boundRole {
+	var roles []boundRole
+	seen := map[string]bool{}
+	add := func(names []string, via string) {
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				roles = append(roles, boundRole{name: name, via: via})
+			}
+		}
 	}
-	_, allowed := allowedApps[AppID(strings.ToLower(appId))]
-	if !allowed {
-		return fmt.Errorf("client %s not allowed to access appId %s", clientId, appId)
+	add(a.ClientRoles[clientId], "client "+clientId)
+	for _, group := range groups {
+		add(a.GroupRoles[group], "group "+group)
+	}
+	return roles
+}
+
+// matchApp returns the first of patterns matching app
+func matchApp(patterns []string, app string) (string, bool) {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, app); matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// sortedAppPatterns returns the app ids of permissions that are glob patterns, sorted so that matching is deterministic
+func sortedAppPatterns(apps map[AppID]AppGrant) []string {
+	var patterns []string
+	for app := range apps {
+		if strings.ContainsAny(string(app), "*?[") {
+			patterns = append(patterns, string(app))
+		}
 	}
-	return nil
+	sort.Strings(patterns)
+	return patterns
 }
@@ -0,0 +1,237 @@
+package security
+
+import (
+	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyAuthorizer(t *testing.T) {
+	contractorLimits := &lbproxy.ConnectionLimits{MaxDurationSeconds: 60}
+	authz, err := NewAuthorizer(AuthorizationPolicy{
+		Clients: ClientPermissions{
+			"one.com": {"echo": {}, "billing-*": {}},
+		},
+		Roles: map[string]Role{
+			"readers":     {Apps: []string{"echo", "httpbin"}},
+			"contractors": {Apps: []string{"reports-*"}, Grant: AppGrant{ConnectionLimits: contractorLimits}},
+			"no-billing":  {DenyApps: []string{"billing-*"}},
+		},
+		ClientRoles: map[string][]string{"two.com": {"readers"}},
+		GroupRoles:  map[string][]string{"team-external": {"contractors", "no-billing"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		identity  ClientIdentity
+		appId     string
+		wantErr   string // Part of the error naming the rule; empty if allowed
+		wantLimit *lbproxy.ConnectionLimits
+	}{
+		{name: "own permission", identity: ClientIdentity{ClientId: "One.com"}, appId: "echo"},
+		{name: "own permission pattern", identity: ClientIdentity{ClientId: "one.com"}, appId: "billing-eu"},
+		{name: "client role", identity: ClientIdentity{ClientId: "two.com"}, appId: "HTTPBIN"},
+		{
+			name:      "group role",
+			identity:  ClientIdentity{ClientId: "acme", Groups: []string{"team-external"}},
+			appId:     "reports-q3",
+			wantLimit: contractorLimits,
+		},
+		{
+			name:     "denied by group role",
+			identity: ClientIdentity{ClientId: "one.com", Groups: []string{"team-external"}},
+			appId:    "billing-eu",
+			wantErr:  `role no-billing (group team-external) pattern "billing-*"`,
+		},
+		{
+			name:     "no grant",
+			identity: ClientIdentity{ClientId: "two.com"},
+			appId:    "billing-eu",
+			wantErr:  "no grant in its permissions or roles [readers (client two.com)]",
+		},
+		{name: "unknown client", identity: ClientIdentity{ClientId: "three.com"}, appId: "echo", wantErr: "client not configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grant, err := authz.AuthorizeClient(tt.identity, tt.appId)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("AuthorizeClient() error = %v, want allowed", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("AuthorizeClient() error = %v, want error containing %q", err, tt.wantErr)
+			}
+			if grant.ConnectionLimits != tt.wantLimit {
+				t.Errorf("AuthorizeClient() limits = %v, want %v", grant.ConnectionLimits, tt.wantLimit)
+			}
+		})
+	}
+
+	if _, err = NewAuthorizer(AuthorizationPolicy{ClientRoles: map[string][]string{"one.com": {"missing"}}}); err == nil {
+		t.Errorf("NewAuthorizer() with an unknown role succeeded, want error")
+	}
+	if _, err = NewAuthorizer(AuthorizationPolicy{Roles: map[string]Role{"bad": {Apps: []string{"["}}}}); err == nil {
+		t.Errorf("NewAuthorizer() with an invalid pattern succeeded, want error")
+	}
+	if _, err = NewAuthorizer(AuthorizationPolicy{Clients: ClientPermissions{"one.com": {"echo": {SourceNetworks: []string{"10.0.0.1"}}}}}); err == nil {
+		t.Errorf("NewAuthorizer() with an invalid source network succeeded, want error")
+	}
+}
+
+func TestPolicyAuthorizerIgnoresCase(t *testing.T) {
+	authz, err := NewAuthorizer(AuthorizationPolicy{
+		Clients: ClientPermissions{"One.com": {"Billing-*": {}}},
+		Roles: map[string]Role{
+			"readers":    {Apps: []string{"Echo"}},
+			"no-reports": {DenyApps: []string{"Reports-*"}},
+		},
+		ClientRoles: map[string][]string{"Two.COM": {"readers"}},
+		GroupRoles:  map[string][]string{"Team-External": {"readers", "no-reports"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		identity ClientIdentity
+		appId    string
+		allowed  bool
+	}{
+		{identity: ClientIdentity{ClientId: "one.com"}, appId: "billing-eu", allowed: true},
+		{identity: ClientIdentity{ClientId: "two.com"}, appId: "echo", allowed: true},
+		{identity: ClientIdentity{ClientId: "acme", Groups: []string{"team-external"}}, appId: "echo", allowed: true},
+		{identity: ClientIdentity{ClientId: "one.com", Groups: []string{"team-external"}}, appId: "reports-q3"},
+	} {
+		if _, err := authz.AuthorizeClient(tt.identity, tt.appId); (err == nil) != tt.allowed {
+			t.Errorf("AuthorizeClient(%+v, %s) error = %v, want allowed %v", tt.identity, tt.appId, err, tt.allowed)
+		}
+	}
+
+	// Ids differing only by case cannot be told apart once normalized
+	if _, err = NewAuthorizer(AuthorizationPolicy{Clients: ClientPermissions{"one.com": {"echo": {}}, "ONE.com": {"httpbin": {}}}}); err == nil {
+		t.Errorf("NewAuthorizer() with clients differing by case succeeded, want error")
+	}
+}
+
+func TestPolicyAuthorizerTimeBounds(t *testing.T) {
+	// A Monday
+	now := time.Date(2023, time.May, 15, 10, 0, 0, 0, time.UTC)
+	contract := AppGrant{NotBefore: now.Add(-24 * time.Hour), NotAfter: now.Add(time.Hour), CloseOnExpiry: true}
+	authz, err := NewAuthorizer(AuthorizationPolicy{
+		Clients: ClientPermissions{
+			"contractor": {"echo": contract},
+			"expired":    {"echo": {NotAfter: now.Add(-time.Minute)}},
+			"early":      {"echo": {NotBefore: now.Add(time.Minute)}},
+			// The expired permission does not hide the role granting access
+			"employee": {"echo": {NotAfter: now.Add(-time.Minute)}},
+		},
+		Roles: map[string]Role{
+			"office-hours": {Apps: []string{"*"}, Grant: AppGrant{Schedule: []AccessWindow{
+				{Days: []time.Weekday{time.Monday, time.Tuesday}, Start: "09:00", End: "17:00"},
+			}}},
+		},
+		ClientRoles: map[string][]string{"employee": {"office-hours"}, "staff": {"office-hours"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authz.(*policyAuthZ).timeSupplier = func() time.Time { return now }
+
+	for clientId, wantErr := range map[string]string{
+		"contractor": "",
+		"employee":   "",
+		"expired":    "grant expired at",
+		"early":      "grant is not active before",
+	} {
+		grant, err := authz.AuthorizeClient(ClientIdentity{ClientId: clientId}, "echo")
+		if wantErr == "" && err != nil {
+			t.Errorf("AuthorizeClient(%s) error = %v, want allowed", clientId, err)
+		}
+		if wantErr != "" && (err == nil || !strings.Contains(err.Error(), wantErr)) {
+			t.Errorf("AuthorizeClient(%s) error = %v, want error containing %q", clientId, err, wantErr)
+		}
+		// The client is allowed at other times, so it must not be banned for trying
+		if IsSecurityFailure(err) {
+			t.Errorf("AuthorizeClient(%s) error = %v is a security failure, want an inactive grant", clientId, err)
+		}
+		if clientId == "employee" && len(grant.Schedule) != 1 {
+			t.Errorf("AuthorizeClient(employee) = %+v, want the office-hours grant", grant)
+		}
+	}
+	if until := contract.ActiveUntil(now); !until.Equal(contract.NotAfter) {
+		t.Errorf("ActiveUntil() = %v, want NotAfter", until)
+	}
+
+	authz.(*policyAuthZ).timeSupplier = func() time.Time { return now.Add(8 * time.Hour) }
+	if _, err = authz.AuthorizeClient(ClientIdentity{ClientId: "staff"}, "echo"); err == nil ||
+		!strings.Contains(err.Error(), "by role office-hours (client staff). grant is outside its access schedule") {
+		t.Errorf("AuthorizeClient(staff) after hours error = %v, want outside the schedule of office-hours", err)
+	}
+	if _, err = authz.AuthorizeClient(ClientIdentity{ClientId: "stranger"}, "echo"); !IsSecurityFailure(err) {
+		t.Errorf("AuthorizeClient(stranger) error = %v, want a security failure", err)
+	}
+
+	if _, err = NewAuthorizer(AuthorizationPolicy{Clients: ClientPermissions{
+		"one.com": {"echo": {Schedule: []AccessWindow{{Start: "9am", End: "17:00"}}}},
+	}}); err == nil {
+		t.Errorf("NewAuthorizer() with an invalid access window succeeded, want error")
+	}
+	if _, err = NewAuthorizer(AuthorizationPolicy{Clients: ClientPermissions{
+		"one.com": {"echo": {Schedule: []AccessWindow{{Start: "09:00", End: "09:00"}}}},
+	}}); err == nil {
+		t.Errorf("NewAuthorizer() with an access window that starts when it ends succeeded, want error")
+	}
+}
+
+func TestAppGrantSchedule(t *testing.T) {
+	friday := time.Date(2023, time.May, 19, 0, 0, 0, 0, time.UTC)
+	nights := AppGrant{Schedule: []AccessWindow{{Days: []time.Weekday{time.Friday}, Start: "22:00", End: "06:00"}}}
+	backToBack := AppGrant{Schedule: []AccessWindow{{Start: "08:00", End: "12:00"}, {Start: "12:00", End: "18:00"}}}
+	rome, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Clocks in Rome go forward at 02:00 on this day, so the window lasts 7 hours
+	dstDay := time.Date(2023, time.March, 26, 0, 0, 0, 0, rome)
+	earlyHours := AppGrant{Schedule: []AccessWindow{{Start: "00:00", End: "08:00", Location: "Europe/Rome"}}}
+
+	tests := []struct {
+		name      string
+		grant     AppGrant
+		at        time.Time
+		wantUntil time.Time // Zero if the grant must not be active
+	}{
+		{name: "Friday night", grant: nights, at: friday.Add(23 * time.Hour), wantUntil: friday.Add(30 * time.Hour)},
+		{name: "past midnight", grant: nights, at: friday.Add(27 * time.Hour), wantUntil: friday.Add(30 * time.Hour)},
+		{name: "Saturday night", grant: nights, at: friday.Add(47 * time.Hour)},
+		{name: "Friday morning", grant: nights, at: friday.Add(3 * time.Hour)},
+		{name: "back to back", grant: backToBack, at: friday.Add(9 * time.Hour), wantUntil: friday.Add(18 * time.Hour)},
+		{name: "DST change", grant: earlyHours, at: dstDay.Add(time.Hour), wantUntil: dstDay.Add(7 * time.Hour)},
+		{
+			name:      "expiring within the window",
+			grant:     AppGrant{Schedule: backToBack.Schedule, NotAfter: friday.Add(10 * time.Hour)},
+			at:        friday.Add(9 * time.Hour),
+			wantUntil: friday.Add(10 * time.Hour),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.grant.CheckActive(tt.at)
+			if tt.wantUntil.IsZero() {
+				if err == nil {
+					t.Errorf("CheckActive() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckActive() error = %v, want active", err)
+			}
+			if until := tt.grant.ActiveUntil(tt.at); !until.Equal(tt.wantUntil) {
+				t.Errorf("ActiveUntil() = %v, want %v", until, tt.wantUntil)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package security
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BanManager counts authentication and authorization failures, and temporarily bans repeat offenders
+// Offenders are tracked by source IP and, when the certificate was readable, by the client id it claimed
+type BanManager interface {
+	// RecordFailure counts a failure for a source IP and, if not empty, a client id; returns true if that caused a ban
+	RecordFailure(sourceIP net.IP, clientId string) bool
+
+	// SourceBan returns the active ban on a source IP, if any
+	SourceBan(sourceIP net.IP) (Ban, bool)
+
+	// ClientBan returns the active ban on a client id, if any
+	ClientBan(clientId string) (Ban, bool)
+
+	// ListBans returns all active bans, sorted by kind and key
+	ListBans() []Ban
+
+	// ClearBan lifts the ban on an offender and forgets its history; returns false if there was nothing to clear
+	ClearBan(kind BanKind, key string) bool
+
+	// ClearAll lifts all bans and forgets all history
+	ClearAll()
+}
+
+// BanConfig controls how failures turn into bans
+type BanConfig struct {
+	MaxFailures          int   // How many failures within FailureWindowSeconds cause a ban
+	FailureWindowSeconds int64 // The size of the sliding window for MaxFailures
+	BanSeconds           int64 // Duration of the first ban; each further ban of the same offender doubles it
+	MaxBanSeconds        int64 // Cap for escalating ban durations
+	ForgetAfterSeconds   int64 // How long after its last ban expires an offender starts again from BanSeconds
+}
+
+// BanKind identifies what a ban applies to
+type BanKind string
+
+const (
+	BanSourceIP BanKind = "ip"     // Ban checked when a connection is accepted
+	BanClientID BanKind = "client" // Ban checked once the client certificate has been read
+)
+
+// Ban describes an active ban
+type Ban struct {
+	Kind     BanKind
+	Key      string    // Source IP or client id
+	Until    time.Time // When the ban expires
+	BanCount int       // How many times this offender has been banned, which drives the escalation
+}
+
+type banKey struct {
+	kind BanKind
+	key  string
+}
+
+// offender tracks failures and bans of a single source IP or client id
+type offender struct {
+	failures    []time.Time // Failures within the window, oldest first
+	banCount    int
+	bannedUntil time.Time
+}
+
+func NewBanManager(config BanConfig) (BanManager, error) {
+	if config.MaxFailures <= 0 || config.FailureWindowSeconds <= 0 {
+		return nil, fmt.Errorf("ban config must allow at least one failure within a positive window")
+	}
+	if config.BanSeconds <= 0 || config.MaxBanSeconds < config.BanSeconds {
+		return nil, fmt.Errorf("ban config must have a positive ban duration, capped at no less than itself")
+	}
+	if config.ForgetAfterSeconds < 0 {
+		return nil, fmt.Errorf("ban config has a negative forget time")
+	}
+	return &banManager{
+		config:    config,
+		offenders: map[banKey]*offender{},
+		now:       time.Now,
+	}, nil
+}
+
+type banManager struct {
+	sync.Mutex
+	config    BanConfig
+	offenders map[banKey]*offender
+	lastSweep time.Time
+	now       func() time.Time // Current time, can be changed for testing
+}
+
+func (b *banManager) RecordFailure(sourceIP net.IP, clientId string) bool {
+	b.Lock()
+	defer b.Unlock()
+	now := b.now()
+	b.sweep(now)
+
+	banned := false
+	if sourceIP != nil {
+		banned = b.recordFailure(banKey{BanSourceIP, sourceIP.String()}, now)
+	}
+	if clientId != "" {
+		banned = b.recordFailure(banKey{BanClientID, clientId}, now) || banned
+	}
+	return banned
+}
+
+func (b *banManager) recordFailure(key banKey, now time.Time) bool {
+	o, found := b.offenders[key]
+	if !found {
+		o = &offender{}
+		b.offenders[key] = o
+	}
+	o.failures = trimFailures(append(o.failures, now), now.Add(-b.window()))
+	if len(o.failures) < b.config.MaxFailures || now.Before(o.bannedUntil) {
+		return false
+	}
+
+	// Each ban doubles the duration of the previous one, up to the max
+	duration := time.Duration(b.config.BanSeconds) * time.Second
+	for i := 0; i < o.banCount && duration < time.Duration(b.config.MaxBanSeconds)*time.Second; i++ {
+		duration *= 2
+	}
+	if maxDuration := time.Duration(b.config.MaxBanSeconds) * time.Second; duration > maxDuration {
+		duration = maxDuration
+	}
+	o.banCount += 1
+	o.bannedUntil = now.Add(duration)
+	o.failures = nil
+	log.Println("BAN", key.kind, key.key, "for", duration, "ban count:", o.banCount)
+	return true
+}
+
+func (b *banManager) SourceBan(sourceIP net.IP) (Ban, bool) {
+	return b.activeBan(banKey{BanSourceIP, sourceIP.String()})
+}
+
+func (b *banManager) ClientBan(clientId string) (Ban, bool) {
+	return b.activeBan(banKey{BanClientID, clientId})
+}
+
+func (b *banManager) activeBan(key banKey) (Ban, bool) {
+	b.Lock()
+	defer b.Unlock()
+	o, found := b.offenders[key]
+	if !found || !b.now().Before(o.bannedUntil) {
+		return Ban{}, false
+	}
+	return Ban{Kind: key.kind, Key: key.key, Until: o.bannedUntil, BanCount: o.banCount}, true
+}
+
+func (b *banManager) ListBans() []Ban {
+	b.Lock()
+	defer b.Unlock()
+	now := b.now()
+	bans := []Ban{}
+	for key, o := range b.offenders {
+		if now.Before(o.bannedUntil) {
+			bans = append(bans, Ban{Kind: key.kind, Key: key.key, Until: o.bannedUntil, BanCount: o.banCount})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if bans[i].Kind != bans[j].Kind {
+			return bans[i].Kind < bans[j].Kind
+		}
+		return bans[i].Key < bans[j].Key
+	})
+	return bans
+}
+
+func (b *banManager) ClearBan(kind BanKind, key string) bool {
+	b.Lock()
+	defer b.Unlock()
+	if _, found := b.offenders[banKey{kind, key}]; !found {
+		return false
+	}
+	delete(b.offenders, banKey{kind, key})
+	log.Println("BAN CLEARED", kind, key)
+	return true
+}
+
+func (b *banManager) ClearAll() {
+	b.Lock()
+	defer b.Unlock()
+	b.offenders = map[banKey]*offender{}
+	log.Println("BAN CLEARED ALL")
+}
+
+// sweep forgets offenders with no recent failures and no recent bans, at most once per failure window,
+// so that scanning many source IPs does not grow memory indefinitely
+func (b *banManager) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < b.window() {
+		return
+	}
+	b.lastSweep = now
+	failuresStart := now.Add(-b.window())
+	forgetBefore := now.Add(-time.Duration(b.config.ForgetAfterSeconds) * time.Second)
+	for key, o := range b.offenders {
+		o.failures = trimFailures(o.failures, failuresStart)
+		if len(o.failures) == 0 && o.bannedUntil.Before(forgetBefore) {
+			delete(b.offenders, key)
+		}
+	}
+}
+
+func (b *banManager) window() time.Duration {
+	return time.Duration(b.config.FailureWindowSeconds) * time.Second
+}
+
+// trimFailures removes failures older than windowStart; failures are appended by current time, so they are sorted
+func trimFailures(failures []time.Time, windowStart time.Time) []time.Time {
+	newStart := sort.Search(len(failures), func(i int) bool { return !failures[i].Before(windowStart) })
+	return failures[newStart:]
+}
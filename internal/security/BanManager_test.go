@@ -0,0 +1,125 @@
+package security
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBanManagerEscalation(t *testing.T) {
+	bans, now := newTestBanManager(t, BanConfig{
+		MaxFailures:          3,
+		FailureWindowSeconds: 10,
+		BanSeconds:           60,
+		MaxBanSeconds:        200,
+		ForgetAfterSeconds:   1000,
+	})
+	ip := net.ParseIP("10.0.0.1")
+
+	// Each round of failures bans for twice as long as the previous one, up to the max
+	for _, want := range []time.Duration{60 * time.Second, 120 * time.Second, 200 * time.Second, 200 * time.Second} {
+		for i := 1; i <= 3; i++ {
+			if banned := bans.RecordFailure(ip, ""); banned != (i == 3) {
+				t.Fatalf("RecordFailure() #%d banned = %v", i, banned)
+			}
+		}
+		ban, banned := bans.SourceBan(ip)
+		if !banned || ban.Until.Sub(*now) != want {
+			t.Errorf("SourceBan() = %v, %v, want ban for %v", ban, banned, want)
+		}
+		*now = ban.Until
+		if _, banned = bans.SourceBan(ip); banned {
+			t.Errorf("SourceBan() still banned after expiry")
+		}
+	}
+}
+
+func TestBanManagerFailureWindow(t *testing.T) {
+	bans, now := newTestBanManager(t, BanConfig{
+		MaxFailures:          2,
+		FailureWindowSeconds: 10,
+		BanSeconds:           60,
+		MaxBanSeconds:        60,
+	})
+	ip := net.ParseIP("10.0.0.1")
+
+	// Failures spread over more than the window never cause a ban
+	for i := 0; i < 5; i++ {
+		if bans.RecordFailure(ip, "") {
+			t.Fatalf("RecordFailure() banned with failures outside window")
+		}
+		*now = now.Add(11 * time.Second)
+	}
+}
+
+func TestBanManagerClientAndClear(t *testing.T) {
+	bans, _ := newTestBanManager(t, BanConfig{
+		MaxFailures:          1,
+		FailureWindowSeconds: 10,
+		BanSeconds:           60,
+		MaxBanSeconds:        60,
+	})
+	bans.RecordFailure(net.ParseIP("10.0.0.1"), "one.com")
+	bans.RecordFailure(net.ParseIP("2001:db8::1"), "")
+
+	got := bans.ListBans()
+	if len(got) != 3 || got[0].Kind != BanClientID || got[0].Key != "one.com" ||
+		got[1].Key != "10.0.0.1" || got[2].Key != "2001:db8::1" {
+		t.Fatalf("ListBans() = %v", got)
+	}
+
+	if !bans.ClearBan(BanClientID, "one.com") {
+		t.Errorf("ClearBan() found no ban")
+	}
+	if _, banned := bans.ClientBan("one.com"); banned {
+		t.Errorf("ClientBan() still banned after clear")
+	}
+	if bans.ClearBan(BanClientID, "one.com") {
+		t.Errorf("ClearBan() cleared twice")
+	}
+
+	bans.ClearAll()
+	if got = bans.ListBans(); len(got) != 0 {
+		t.Errorf("ListBans() after ClearAll = %v", got)
+	}
+}
+
+func TestNewBanManagerValidation(t *testing.T) {
+	valid := BanConfig{MaxFailures: 3, FailureWindowSeconds: 60, BanSeconds: 10, MaxBanSeconds: 100, ForgetAfterSeconds: 600}
+	if _, err := NewBanManager(valid); err != nil {
+		t.Fatalf("NewBanManager() error = %v for a valid config", err)
+	}
+	tests := []struct {
+		name   string
+		modify func(config *BanConfig)
+	}{
+		{name: "no failures", modify: func(c *BanConfig) { c.MaxFailures = 0 }},
+		{name: "no window", modify: func(c *BanConfig) { c.FailureWindowSeconds = 0 }},
+		{name: "negative window", modify: func(c *BanConfig) { c.FailureWindowSeconds = -1 }},
+		{name: "no ban", modify: func(c *BanConfig) { c.BanSeconds = 0 }},
+		{name: "cap below ban", modify: func(c *BanConfig) { c.MaxBanSeconds = 5 }},
+		{name: "negative forget", modify: func(c *BanConfig) { c.ForgetAfterSeconds = -1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := valid
+			tt.modify(&config)
+			if _, err := NewBanManager(config); err == nil {
+				t.Errorf("NewBanManager(%+v) succeeded, want error", config)
+			}
+		})
+	}
+}
+
+func newTestBanManager(t *testing.T, config BanConfig) (BanManager, *time.Time) {
+	now := time.Unix(1000, 0)
+	created, err := NewBanManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bans := created.(*banManager)
+	bans.now = func() time.Time {
+		return now
+	}
+	return bans, &now
+}
@@ -0,0 +1,132 @@
+package security
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ClientVerification sets how client certificates are trusted
+type ClientVerification string
+
+const (
+	// VerifyPinnedClients trusts exactly the client certificates found under ClientsCertPath; the default
+	VerifyPinnedClients ClientVerification = "pinned"
+	// VerifyClientCA trusts any client certificate chaining to ClientCaBundle, so that adding a client only needs
+	// a permissions entry; the issuer can be further restricted with ClientIssuerCN and ClientIssuerSKI.
+	// The bundle must be set explicitly, as the CA of the server may also issue server and peer certificates
+	VerifyClientCA ClientVerification = "ca"
+)
+
+func validateClientVerification(config ServerSecurityConfig) error {
+	switch config.ClientVerification {
+	case "", VerifyPinnedClients:
+		if config.ClientIssuerCN != "" || config.ClientIssuerSKI != "" {
+			return fmt.Errorf("client issuer checks require %q client verification", VerifyClientCA)
+		}
+	case VerifyClientCA:
+		if config.ClientCaBundle == "" {
+			return fmt.Errorf("%q client verification requires a client CA bundle", VerifyClientCA)
+		}
+	default:
+		return fmt.Errorf("unknown client verification %q", config.ClientVerification)
+	}
+	_, err := parseSKI(config.ClientIssuerSKI)
+	return err
+}
+
+// clientCertPaths lists the files loadClientCAs reads, so that they can be watched for changes
+func clientCertPaths(config ServerSecurityConfig) ([]string, error) {
+	if config.ClientVerification == VerifyClientCA {
+		return []string{config.ClientCaBundle}, nil
+	}
+	entries, err := os.ReadDir(config.ClientsCertPath)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		if e.IsDir() {
+			paths = append(paths, filepath.Join(config.ClientsCertPath, e.Name(), e.Name()+config.ClientCertFileExt))
+		}
+	}
+	return paths, nil
+}
+
+// loadClientCAs loads the pool client certificates are verified against: the client CA bundle in CA mode,
+// or else each client certificate, so that only those exact certificates are trusted
+func loadClientCAs(config ServerSecurityConfig) (*x509.CertPool, error) {
+	clientCertPool := x509.NewCertPool()
+	if config.ClientVerification == VerifyClientCA {
+		bundle, err := os.ReadFile(config.ClientCaBundle)
+		if err != nil {
+			return nil, err
+		}
+		if ok := clientCertPool.AppendCertsFromPEM(bundle); !ok {
+			return nil, fmt.Errorf("could not append client CA bundle %s to pool", config.ClientCaBundle)
+		}
+		return clientCertPool, nil
+	}
+
+	paths, err := clientCertPaths(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, clientCertPath := range paths {
+		clientCert, err := os.ReadFile(clientCertPath)
+		if err != nil {
+			// In this case, we can just log and continue
+			log.Println("Could not load client cert", clientCertPath, "ERROR:", err)
+		} else {
+			if ok := clientCertPool.AppendCertsFromPEM(clientCert); !ok {
+				log.Println("Could not append client cert", clientCertPath, "to pool.", "ERROR:", err)
+			}
+		}
+	}
+	return clientCertPool, nil
+}
+
+// verifyClientIssuer returns a check that the client certificate was issued by the configured issuer,
+// or nil if the issuer is not restricted. The chain was already verified by the handshake, so only the
+// certificate directly above the client's in a verified chain is considered
+func verifyClientIssuer(config ServerSecurityConfig) func(tls.ConnectionState) error {
+	if config.ClientIssuerCN == "" && config.ClientIssuerSKI == "" {
+		return nil
+	}
+	ski, _ := parseSKI(config.ClientIssuerSKI) // Validated on creation
+	return func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			if len(chain) < 2 {
+				continue
+			}
+			issuer := chain[1]
+			if config.ClientIssuerCN != "" && !strings.EqualFold(issuer.Subject.CommonName, config.ClientIssuerCN) {
+				continue
+			}
+			if ski != nil && !bytes.Equal(issuer.SubjectKeyId, ski) {
+				continue
+			}
+			return nil
+		}
+		return fmt.Errorf("client certificate is not issued by the required issuer (CN %q, SKI %q)",
+			config.ClientIssuerCN, config.ClientIssuerSKI)
+	}
+}
+
+// parseSKI decodes a subject key identifier written in hex, optionally with colons, e.g. "a1:b2:..."
+func parseSKI(ski string) ([]byte, error) {
+	if ski == "" {
+		return nil, nil
+	}
+	decoded, err := hex.DecodeString(strings.ReplaceAll(ski, ":", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid client issuer SKI %q. %w", ski, err)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,39 @@
+package security
+
+import "errors"
+
+// UnavailableError reports that a security check could not be completed, e.g. because a responder could not be
+// reached or the client went away, rather than that the client failed it
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// InactiveGrantError reports that a client has a grant to an app, but not at the time it connected,
+// e.g. a contractor outside its access schedule
+type InactiveGrantError struct {
+	Reason string
+}
+
+func (e *InactiveGrantError) Error() string {
+	return e.Reason
+}
+
+// IsSecurityFailure returns true if err means that the client failed a security check, so that it can count
+// towards a ban; checks that could not be completed do not, as the client may well have passed them,
+// and neither do grants that are not active yet or anymore, as the client is allowed at other times
+func IsSecurityFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var unavailable *UnavailableError
+	var inactive *InactiveGrantError
+	return !errors.As(err, &unavailable) && !errors.As(err, &inactive)
+}
@@ -0,0 +1,145 @@
+package security
+
+import (
+	"fmt"
+	"time"
+)
+
+// AccessWindow is a recurring time range during which a grant is active, e.g. office hours
+type AccessWindow struct {
+	Days     []time.Weekday // Days on which the window starts; empty for every day
+	Start    string         // Time of day at which the window starts, as "15:04"
+	End      string         // Time of day at which the window ends (excluded), other than Start; before Start to span midnight
+	Location string         // IANA time zone of Start and End, e.g. "Europe/Rome"; empty for UTC
+}
+
+// maxScheduleDays bounds how far ahead ActiveUntil follows back-to-back windows, e.g. of a schedule that never ends
+const maxScheduleDays = 7
+
+// CheckActive returns an error if the grant is not active at t
+func (g AppGrant) CheckActive(t time.Time) error {
+	if !g.NotBefore.IsZero() && t.Before(g.NotBefore) {
+		return &InactiveGrantError{fmt.Sprintf("grant is not active before %v", g.NotBefore)}
+	}
+	if !g.NotAfter.IsZero() && !t.Before(g.NotAfter) {
+		return &InactiveGrantError{fmt.Sprintf("grant expired at %v", g.NotAfter)}
+	}
+	if len(g.Schedule) > 0 && windowEnd(g.accessWindows(), t).IsZero() {
+		return &InactiveGrantError{"grant is outside its access schedule"}
+	}
+	return nil
+}
+
+// ActiveUntil returns when a grant active at t stops being active, following back-to-back windows;
+// zero if the grant never expires
+func (g AppGrant) ActiveUntil(t time.Time) time.Time {
+	until := g.NotAfter
+	if len(g.Schedule) > 0 {
+		schedule := g.accessWindows()
+		end := windowEnd(schedule, t)
+		for !end.IsZero() && end.Sub(t) < maxScheduleDays*24*time.Hour {
+			next := windowEnd(schedule, end)
+			if next.IsZero() {
+				break
+			}
+			end = next
+		}
+		if until.IsZero() || (!end.IsZero() && end.Before(until)) {
+			until = end
+		}
+	}
+	return until
+}
+
+// parsedAccessWindow is a parsed AccessWindow
+type parsedAccessWindow struct {
+	AccessWindow
+	start, end int // Minutes after midnight
+	location   *time.Location
+}
+
+func parseAccessWindow(w AccessWindow) (parsedAccessWindow, error) {
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return parsedAccessWindow{}, err
+	}
+	end, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return parsedAccessWindow{}, err
+	}
+	if start.Equal(end) {
+		return parsedAccessWindow{}, fmt.Errorf("window starts and ends at %s, so it is never active", w.Start)
+	}
+	location, err := time.LoadLocation(w.Location)
+	if err != nil {
+		return parsedAccessWindow{}, err
+	}
+	return parsedAccessWindow{
+		AccessWindow: w,
+		start:        start.Hour()*60 + start.Minute(),
+		end:          end.Hour()*60 + end.Minute(),
+		location:     location,
+	}, nil
+}
+
+// accessWindows returns the parsed Schedule of the grant
+func (g AppGrant) accessWindows() []parsedAccessWindow {
+	if g.schedule != nil || len(g.Schedule) == 0 {
+		return g.schedule
+	}
+	// Grants that were not prepared by an Authorizer are parsed on every check; invalid windows are never active
+	windows := make([]parsedAccessWindow, 0, len(g.Schedule))
+	for _, w := range g.Schedule {
+		if pw, err := parseAccessWindow(w); err == nil {
+			windows = append(windows, pw)
+		}
+	}
+	return windows
+}
+
+// windowEnd returns the latest end of the windows of schedule active at t, or zero if none is
+func windowEnd(schedule []parsedAccessWindow, t time.Time) time.Time {
+	var latest time.Time
+	for _, w := range schedule {
+		if end := w.endIfActive(t); end.After(latest) {
+			latest = end
+		}
+	}
+	return latest
+}
+
+// endIfActive returns when the occurrence of the window active at t ends, or zero if the window is not active at t
+// Occurrences are computed from the calendar date, so that days with a DST change end at the wall-clock End
+func (w parsedAccessWindow) endIfActive(t time.Time) time.Time {
+	local := t.In(w.location)
+	minute := local.Hour()*60 + local.Minute()
+	year, month, day := local.Date()
+	switch {
+	case w.start < w.end && minute >= w.start && minute < w.end:
+	case w.start > w.end && minute >= w.start:
+	case w.start > w.end && minute < w.end:
+		// Started the day before, and spans midnight
+		day--
+	default:
+		return time.Time{}
+	}
+	if !w.startsOn(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Weekday()) {
+		return time.Time{}
+	}
+	if w.start > w.end {
+		day++
+	}
+	return time.Date(year, month, day, w.end/60, w.end%60, 0, 0, w.location)
+}
+
+func (w parsedAccessWindow) startsOn(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
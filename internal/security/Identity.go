@@ -0,0 +1,63 @@
+package security
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// IdentitySource sets which field of a client certificate holds the client id
+type IdentitySource string
+
+const (
+	IdentityCommonName IdentitySource = "cn"        // Subject common name; deprecated for identity by RFC 6125, but the default
+	IdentityDNSName    IdentitySource = "dns-san"   // First DNS name SAN
+	IdentitySpiffeID   IdentitySource = "spiffe"    // URI SAN of the form spiffe://<SpiffeTrustDomain>/<path>
+	IdentityEmail      IdentitySource = "email-san" // First email address SAN
+)
+
+// validateIdentitySource checks that the identity settings of config are consistent
+func validateIdentitySource(config ServerSecurityConfig) error {
+	switch config.IdentitySource {
+	case "", IdentityCommonName, IdentityDNSName, IdentityEmail:
+		return nil
+	case IdentitySpiffeID:
+		if config.SpiffeTrustDomain == "" {
+			return fmt.Errorf("SpiffeTrustDomain is required to identify clients by SPIFFE ID")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown identity source %q", config.IdentitySource)
+	}
+}
+
+// clientIdentity extracts the client id from cert, according to the identity source of config
+func clientIdentity(cert *x509.Certificate, config ServerSecurityConfig) (string, error) {
+	switch config.IdentitySource {
+	case "", IdentityCommonName:
+		if cert.Subject.CommonName == "" {
+			return "", fmt.Errorf("certificate with serial %v has no common name", cert.SerialNumber)
+		}
+		return strings.ToLower(cert.Subject.CommonName), nil
+	case IdentityDNSName:
+		if len(cert.DNSNames) == 0 {
+			return "", fmt.Errorf("certificate of %s has no DNS name SAN", cert.Subject.CommonName)
+		}
+		return strings.ToLower(cert.DNSNames[0]), nil
+	case IdentityEmail:
+		if len(cert.EmailAddresses) == 0 {
+			return "", fmt.Errorf("certificate of %s has no email SAN", cert.Subject.CommonName)
+		}
+		return strings.ToLower(cert.EmailAddresses[0]), nil
+	case IdentitySpiffeID:
+		// SPIFFE allows a single URI SAN, but other URIs may be present in non-SPIFFE certificates
+		for _, uri := range cert.URIs {
+			if uri.Scheme == "spiffe" && strings.EqualFold(uri.Host, config.SpiffeTrustDomain) && uri.Path != "" {
+				return uri.String(), nil
+			}
+		}
+		return "", fmt.Errorf("certificate of %s has no SPIFFE ID in trust domain %s", cert.Subject.CommonName, config.SpiffeTrustDomain)
+	default:
+		return "", fmt.Errorf("unknown identity source %q", config.IdentitySource)
+	}
+}
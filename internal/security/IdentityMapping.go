@@ -0,0 +1,155 @@
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// CertField names a field of a client certificate that identity rules can match
+type CertField string
+
+const (
+	FieldClientId           CertField = "id"        // Client id chosen by ServerSecurityConfig.IdentitySource
+	FieldCommonName         CertField = "cn"        // Subject common name
+	FieldOrganization       CertField = "o"         // Each subject organization
+	FieldOrganizationalUnit CertField = "ou"        // Each subject organizational unit
+	FieldDNSName            CertField = "dns-san"   // Each DNS name SAN
+	FieldURI                CertField = "uri-san"   // Each URI SAN, e.g. SPIFFE IDs
+	FieldEmail              CertField = "email-san" // Each email address SAN
+)
+
+// ClientIdentity is who a client is to the Authorizer, once certificate fields are mapped to logical ids
+type ClientIdentity struct {
+	ClientId    string            // Logical client id, which permissions, limits and quotas are configured for
+	Groups      []string          // Groups the client belongs to, sorted
+	Certificate *x509.Certificate // Certificate the client authenticated with, for authorizers deciding on its attributes
+	SourceIP    net.IP            // Address the client connects from; nil if unknown
+}
+
+// IdentityRule derives the client id and groups from a certificate field, e.g. with Field "ou",
+// Match "team-(?P<team>.+)" and Groups ["${team}"], a client with OU=team-billing joins group "billing"
+type IdentityRule struct {
+	Field    CertField
+	Match    string   // Regular expression that must match the whole value of Field, ignoring case
+	ClientId string   // Template of the client id, with $1 or ${name} for capture groups; empty to not change it
+	Groups   []string // Templates of the groups the client joins
+}
+
+// IdentityMapper applies identity rules in order: the first matching rule with a ClientId template sets the
+// client id, while the groups of all matching rules add up. Clients matching no rule keep their authenticated id,
+// unless the mapper is strict, in which case they are rejected, so that their id cannot collide with a logical one
+type IdentityMapper struct {
+	rules  []identityRule
+	strict bool
+}
+
+type identityRule struct {
+	IdentityRule
+	match *regexp.Regexp
+}
+
+func NewIdentityMapper(rules []IdentityRule, strict bool) (*IdentityMapper, error) {
+	if strict && len(rules) == 0 {
+		return nil, fmt.Errorf("strict identity mapping without rules would reject every client")
+	}
+	m := &IdentityMapper{strict: strict}
+	for i, rule := range rules {
+		switch rule.Field {
+		case FieldClientId, FieldCommonName, FieldOrganization, FieldOrganizationalUnit, FieldDNSName, FieldURI, FieldEmail:
+		default:
+			return nil, fmt.Errorf("identity rule %d: unknown certificate field %q", i, rule.Field)
+		}
+		// Anchor the expression, so that rules cannot accidentally match part of a value,
+		// and ignore case, as client ids are not case-sensitive
+		match, err := regexp.Compile("(?i)^(?:" + rule.Match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("identity rule %d: invalid expression. %w", i, err)
+		}
+		m.rules = append(m.rules, identityRule{IdentityRule: rule, match: match})
+	}
+	return m, nil
+}
+
+// MapIdentity derives the identity of a client authenticated as clientId with cert
+func (m *IdentityMapper) MapIdentity(clientId string, cert *x509.Certificate) (ClientIdentity, error) {
+	identity := ClientIdentity{ClientId: clientId}
+	mapped := false
+	groups := map[string]struct{}{}
+	for _, rule := range m.rules {
+		for _, value := range certFieldValues(rule.Field, clientId, cert) {
+			submatches := rule.match.FindStringSubmatchIndex(value)
+			if submatches == nil {
+				continue
+			}
+			if rule.ClientId != "" && !mapped {
+				identity.ClientId = expandIdentity(rule.match, rule.ClientId, value, submatches)
+				mapped = true
+			}
+			for _, group := range rule.Groups {
+				if g := expandIdentity(rule.match, group, value, submatches); g != "" {
+					groups[g] = struct{}{}
+				}
+			}
+		}
+	}
+	if !mapped && m.strict {
+		return ClientIdentity{}, fmt.Errorf("no identity rule maps client %s to a client id", clientId)
+	}
+	if identity.ClientId == "" {
+		return ClientIdentity{}, fmt.Errorf("identity rules mapped client %s to an empty client id", clientId)
+	}
+	for group := range groups {
+		identity.Groups = append(identity.Groups, group)
+	}
+	sort.Strings(identity.Groups)
+	return identity, nil
+}
+
+// IdentifyClient maps the client authenticated as clientId by a completed handshake; without a mapper,
+// the client keeps its authenticated id and belongs to no groups
+func IdentifyClient(mapper *IdentityMapper, clientId string, state tls.ConnectionState) (ClientIdentity, error) {
+	if len(state.PeerCertificates) == 0 {
+		return ClientIdentity{}, fmt.Errorf("no peer certificates present to identify client %s", clientId)
+	}
+	cert := state.PeerCertificates[0]
+	if mapper == nil {
+		return ClientIdentity{ClientId: clientId, Certificate: cert}, nil
+	}
+	identity, err := mapper.MapIdentity(clientId, cert)
+	identity.Certificate = cert
+	return identity, err
+}
+
+// expandIdentity fills in a template with the capture groups of a match; ids are not case-sensitive
+func expandIdentity(match *regexp.Regexp, template string, value string, submatches []int) string {
+	return strings.ToLower(string(match.ExpandString(nil, template, value, submatches)))
+}
+
+func certFieldValues(field CertField, clientId string, cert *x509.Certificate) []string {
+	switch field {
+	case FieldClientId:
+		return []string{clientId}
+	case FieldCommonName:
+		return []string{cert.Subject.CommonName}
+	case FieldOrganization:
+		return cert.Subject.Organization
+	case FieldOrganizationalUnit:
+		return cert.Subject.OrganizationalUnit
+	case FieldDNSName:
+		return cert.DNSNames
+	case FieldURI:
+		uris := make([]string, 0, len(cert.URIs))
+		for _, uri := range cert.URIs {
+			uris = append(uris, uri.String())
+		}
+		return uris
+	case FieldEmail:
+		return cert.EmailAddresses
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package security
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"reflect"
+	"testing"
+)
+
+func TestIdentityMapper(t *testing.T) {
+	mapper, err := NewIdentityMapper([]IdentityRule{
+		{
+			Field:    FieldDNSName,
+			Match:    `(?P<svc>[a-z]+)\.(?P<env>[a-z]+)\.example\.org`,
+			ClientId: "${svc}-${env}",
+			Groups:   []string{"env-${env}"},
+		},
+		{Field: FieldOrganizationalUnit, Match: `team-(.+)`, Groups: []string{"team-$1"}},
+		// Not applied when an earlier rule already set the client id
+		{Field: FieldClientId, Match: `.*`, ClientId: "fallback", Groups: []string{"everyone"}},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want ClientIdentity
+	}{
+		{
+			name: "mapped",
+			cert: &x509.Certificate{
+				Subject:  pkix.Name{CommonName: "billing-7f9c", OrganizationalUnit: []string{"Team-Payments", "other"}},
+				DNSNames: []string{"not-matching.example.com", "billing.prod.example.org"},
+			},
+			want: ClientIdentity{ClientId: "billing-prod", Groups: []string{"env-prod", "everyone", "team-payments"}},
+		},
+		{
+			name: "only matching the last rule",
+			cert: &x509.Certificate{Subject: pkix.Name{CommonName: "legacy"}},
+			want: ClientIdentity{ClientId: "fallback", Groups: []string{"everyone"}},
+		},
+		{
+			name: "partial matches are ignored",
+			cert: &x509.Certificate{DNSNames: []string{"billing.prod.example.org.evil.com"}},
+			want: ClientIdentity{ClientId: "fallback", Groups: []string{"everyone"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mapper.MapIdentity(tt.cert.Subject.CommonName, tt.cert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MapIdentity() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// Without rules matching, clients keep their authenticated id
+	empty, err := NewIdentityMapper(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := empty.MapIdentity("localhost", &x509.Certificate{}); got.ClientId != "localhost" || len(got.Groups) != 0 {
+		t.Errorf("MapIdentity() without rules = %+v, want the authenticated id", got)
+	}
+
+	if _, err = NewIdentityMapper([]IdentityRule{{Field: "serial", Match: ".*"}}, false); err == nil {
+		t.Errorf("NewIdentityMapper() with an unknown field succeeded, want error")
+	}
+	if _, err = NewIdentityMapper([]IdentityRule{{Field: FieldCommonName, Match: "("}}, false); err == nil {
+		t.Errorf("NewIdentityMapper() with an invalid expression succeeded, want error")
+	}
+	if _, err = NewIdentityMapper(nil, true); err == nil {
+		t.Errorf("NewIdentityMapper() strict without rules succeeded, want error")
+	}
+}
+
+func TestIdentityMapperStrict(t *testing.T) {
+	rules := []IdentityRule{
+		{Field: FieldOrganizationalUnit, Match: `svc-(.+)`, ClientId: "$1"},
+		{Field: FieldOrganization, Match: `.+`, Groups: []string{"$0"}},
+	}
+	strict, err := NewIdentityMapper(rules, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped := &x509.Certificate{Subject: pkix.Name{OrganizationalUnit: []string{"svc-billing"}}}
+	if got, err := strict.MapIdentity("billing-7f9c", mapped); err != nil || got.ClientId != "billing" {
+		t.Errorf("MapIdentity() of a mapped client = %+v, %v, want billing", got, err)
+	}
+	// A client named like a logical id, but matching no rule setting the client id, must not pass for it
+	impostor := &x509.Certificate{Subject: pkix.Name{CommonName: "billing", Organization: []string{"acme"}}}
+	if got, err := strict.MapIdentity("billing", impostor); err == nil {
+		t.Errorf("MapIdentity() of an unmapped client = %+v, want error", got)
+	}
+}
@@ -0,0 +1,54 @@
+package security
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/url"
+	"testing"
+)
+
+func TestClientIdentity(t *testing.T) {
+	spiffeID, _ := url.Parse("spiffe://example.org/ns/prod/sa/Billing")
+	otherDomain, _ := url.Parse("spiffe://other.org/ns/prod/sa/billing")
+	website, _ := url.Parse("https://example.org/billing")
+	cert := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: "Billing"},
+		DNSNames:       []string{"Billing.example.org", "billing.internal"},
+		EmailAddresses: []string{"Billing@example.org"},
+		URIs:           []*url.URL{website, otherDomain, spiffeID},
+	}
+	tests := []struct {
+		source      IdentitySource
+		trustDomain string
+		want        string
+		wantErr     bool
+	}{
+		{source: "", want: "billing"},
+		{source: IdentityCommonName, want: "billing"},
+		{source: IdentityDNSName, want: "billing.example.org"},
+		{source: IdentityEmail, want: "billing@example.org"},
+		{source: IdentitySpiffeID, trustDomain: "example.org", want: "spiffe://example.org/ns/prod/sa/Billing"},
+		{source: IdentitySpiffeID, trustDomain: "missing.org", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.source)+tt.trustDomain, func(t *testing.T) {
+			config := ServerSecurityConfig{IdentitySource: tt.source, SpiffeTrustDomain: tt.trustDomain}
+			got, err := clientIdentity(cert, config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("clientIdentity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("clientIdentity() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := clientIdentity(&x509.Certificate{SerialNumber: big.NewInt(2)}, ServerSecurityConfig{IdentitySource: IdentityDNSName}); err == nil {
+		t.Errorf("clientIdentity() of a certificate without DNS SANs succeeded, want error")
+	}
+	if err := validateIdentitySource(ServerSecurityConfig{IdentitySource: IdentitySpiffeID}); err == nil {
+		t.Errorf("validateIdentitySource() of SPIFFE IDs without a trust domain succeeded, want error")
+	}
+}
@@ -2,10 +2,25 @@ package security
 
 // ServerSecurityConfig makes some assumptions on how we store certificates, and lets you change some values
 type ServerSecurityConfig struct {
-	ClientsCertPath   string // Base path of client certificates
-	ClientCertFileExt string // Extension of client cert files, including dot, e.g. ".crt"
-	ClientCertKeyExt  string // Extension of client key files, including dot, e.g. ".key"
-	CaCert            string // path to CA cert file
-	ServerCert        string // path to server cert file
-	ServerKey         string // path to server cert key
+	ClientsCertPath    string             // Base path of client certificates; only read with pinned client verification
+	ClientCertFileExt  string             // Extension of client cert files, including dot, e.g. ".crt"
+	ClientCertKeyExt   string             // Extension of client key files, including dot, e.g. ".key"
+	CaCert             string             // path to CA cert file
+	ServerCert         string             // path to server cert file
+	ServerKey          string             // path to server cert key
+	PeerCert           string             // path to the cert identifying this instance to its cluster peers; ServerCert if empty
+	PeerKey            string             // path to peer cert key; required with PeerCert
+	CrlFile            string             // path to a CRL signed by the CA, PEM or DER; empty to not check revocations
+	TerminateRevoked   bool               // Close live connections of certificates revoked by a new CRL
+	ReloadSeconds      int64              // How often the files above are checked for changes, and reloaded; 0 to never reload
+	OcspPolicy         OcspPolicy         // Whether client certificates are checked with an OCSP responder, and what to do if it cannot answer
+	OcspResponder      string             // URL of the OCSP responder; empty to use the one named in each client certificate
+	OcspCacheSeconds   int64              // How long OCSP responses are reused at most; they are never used past their next update
+	OcspTimeoutMillis  int64              // How long to wait for the OCSP responder
+	IdentitySource     IdentitySource     // Which certificate field holds the client id; common name if empty
+	SpiffeTrustDomain  string             // Trust domain of SPIFFE IDs, e.g. "example.org"; required for IdentitySpiffeID
+	ClientVerification ClientVerification // How client certificates are trusted; pinned if empty
+	ClientCaBundle     string             // path to the CAs issuing client certificates, required for CA verification
+	ClientIssuerCN     string             // Common name the issuer of client certificates must have; empty for any
+	ClientIssuerSKI    string             // Subject key identifier, in hex, the issuer of client certificates must have; empty for any
 }
@@ -0,0 +1,159 @@
+package security
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// OcspPolicy sets what happens to a client certificate whose status cannot be checked with OCSP
+type OcspPolicy string
+
+const (
+	OcspOff      OcspPolicy = ""          // Certificates are not checked with OCSP
+	OcspSoftFail OcspPolicy = "soft-fail" // Certificates are accepted when the responder cannot answer, and rejected if revoked
+	OcspHardFail OcspPolicy = "hard-fail" // Certificates are rejected unless the responder says they are good
+)
+
+// Default OCSP settings, used when the config leaves them at 0
+const (
+	defaultOcspCacheSeconds  = 300
+	defaultOcspTimeoutMillis = 2000
+	maxOcspResponseBytes     = 1 << 20
+)
+
+// ocspChecker asks an OCSP responder for the status of client certificates, caching responses by serial number
+type ocspChecker struct {
+	policy    OcspPolicy
+	responder string
+	cacheTTL  time.Duration
+	client    *http.Client
+	lock      sync.Mutex
+	cache     map[string]ocspCacheEntry
+}
+
+type ocspCacheEntry struct {
+	status  int // ocsp.Good, ocsp.Revoked or ocsp.Unknown
+	expires time.Time
+}
+
+func newOcspChecker(config ServerSecurityConfig) (*ocspChecker, error) {
+	switch config.OcspPolicy {
+	case OcspOff:
+		return nil, nil
+	case OcspSoftFail, OcspHardFail:
+	default:
+		return nil, fmt.Errorf("unknown OCSP policy %q", config.OcspPolicy)
+	}
+	cacheSeconds := config.OcspCacheSeconds
+	if cacheSeconds <= 0 {
+		cacheSeconds = defaultOcspCacheSeconds
+	}
+	timeoutMillis := config.OcspTimeoutMillis
+	if timeoutMillis <= 0 {
+		timeoutMillis = defaultOcspTimeoutMillis
+	}
+	return &ocspChecker{
+		policy:    config.OcspPolicy,
+		responder: config.OcspResponder,
+		cacheTTL:  time.Duration(cacheSeconds) * time.Second,
+		client:    &http.Client{Timeout: time.Duration(timeoutMillis) * time.Millisecond},
+		cache:     map[string]ocspCacheEntry{},
+	}, nil
+}
+
+// check returns an error if cert must be rejected according to its OCSP status and the policy
+func (o *ocspChecker) check(cert, issuer *x509.Certificate) error {
+	status, err := o.status(cert, issuer)
+	if err != nil {
+		if o.policy == OcspHardFail {
+			return &UnavailableError{fmt.Errorf("could not check OCSP status of %s. %w", cert.Subject.CommonName, err)}
+		}
+		log.Println("WARNING: could not check OCSP status of", cert.Subject.CommonName, "accepting it", "ERROR:", err)
+		return nil
+	}
+	switch status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("certificate of %s with serial %v is revoked by OCSP", cert.Subject.CommonName, cert.SerialNumber)
+	default:
+		if o.policy == OcspHardFail {
+			return &UnavailableError{fmt.Errorf("OCSP status of %s with serial %v is unknown", cert.Subject.CommonName, cert.SerialNumber)}
+		}
+		return nil
+	}
+}
+
+// status returns the OCSP status of cert, from the cache if possible; failures are not cached,
+// so that the responder is asked again on the next connection
+func (o *ocspChecker) status(cert, issuer *x509.Certificate) (int, error) {
+	serial := cert.SerialNumber.String()
+	now := time.Now()
+	o.lock.Lock()
+	entry, found := o.cache[serial]
+	o.lock.Unlock()
+	if found && now.Before(entry.expires) {
+		return entry.status, nil
+	}
+
+	response, err := o.query(cert, issuer)
+	if err != nil {
+		return ocsp.Unknown, err
+	}
+	expires := now.Add(o.cacheTTL)
+	if !response.NextUpdate.IsZero() && response.NextUpdate.Before(expires) {
+		expires = response.NextUpdate
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	// Drop expired entries, so that the cache does not grow with certificates that are no longer used
+	for s, e := range o.cache {
+		if !now.Before(e.expires) {
+			delete(o.cache, s)
+		}
+	}
+	o.cache[serial] = ocspCacheEntry{status: response.Status, expires: expires}
+	return response.Status, nil
+}
+
+// query asks the responder for the status of cert, and checks the response is signed by issuer (or a delegate)
+func (o *ocspChecker) query(cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	responder := o.responder
+	if responder == "" {
+		if len(cert.OCSPServer) == 0 {
+			return nil, fmt.Errorf("no OCSP responder configured or named in the certificate")
+		}
+		responder = cert.OCSPServer[0]
+	}
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpResponse, err := o.client.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s returned %s", responder, httpResponse.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResponse.Body, maxOcspResponseBytes))
+	if err != nil {
+		return nil, err
+	}
+	response, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if !response.NextUpdate.IsZero() && response.NextUpdate.Before(time.Now()) {
+		return nil, fmt.Errorf("OCSP response from %s is past its next update %v", responder, response.NextUpdate)
+	}
+	return response, nil
+}
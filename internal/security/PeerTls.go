@@ -0,0 +1,115 @@
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// PeerURIScheme is the scheme of the URI SAN that identifies a proxy instance, e.g. lb-peer://proxy1
+// The CA must never issue it to clients, so that a client certificate cannot pass for a peer
+const PeerURIScheme = "lb-peer"
+
+// NewPeerTLSConfigs creates the mTLS configurations used between proxy instances, as server and as client
+// Each instance presents its peer certificate, or its server certificate if no peer certificate is configured,
+// which must chain to the CA, and carry the node id of the instance as a PeerURIScheme URI SAN;
+// only node ids in allowedPeerIds are accepted
+// Both configurations use the current material of authn, so that peers pick up rotated certificates as well
+func NewPeerTLSConfigs(authn Authenticator, allowedPeerIds []string) (*tls.Config, *tls.Config, error) {
+	if len(allowedPeerIds) == 0 {
+		return nil, nil, fmt.Errorf("at least one allowed peer id is required")
+	}
+	a, ok := authn.(*fileAuthN)
+	if !ok {
+		return nil, nil, fmt.Errorf("peer mTLS requires certificates loaded from files")
+	}
+	verifyPeer := func(state tls.ConnectionState) error {
+		return checkPeerId(state, allowedPeerIds)
+	}
+
+	serverConfig := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			current := a.current.Load()
+			return &tls.Config{
+				Certificates:     []tls.Certificate{*current.peer},
+				ClientAuth:       tls.RequireAndVerifyClientCert,
+				ClientCAs:        current.config.RootCAs,
+				MinVersion:       tls.VersionTLS13,
+				VerifyConnection: verifyPeer,
+			}, nil
+		},
+		// Not used for handshakes, as GetConfigForClient takes over, but marks the config as having a certificate
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return a.current.Load().peer, nil
+		},
+	}
+	clientConfig := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return a.current.Load().peer, nil
+		},
+		// Peers are addressed by IP or internal names that their certificates may not carry,
+		// so the chain is verified against the CA and the node id against allowedPeerIds instead
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if err := verifyChain(state, a.current.Load().config.RootCAs); err != nil {
+				return err
+			}
+			return verifyPeer(state)
+		},
+	}
+	return serverConfig, clientConfig, nil
+}
+
+func verifyChain(state tls.ConnectionState, roots *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("no peer certificates present")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+func checkPeerId(state tls.ConnectionState, allowedPeerIds []string) error {
+	nodeId, err := PeerNodeId(state)
+	if err != nil {
+		return err
+	}
+	for _, allowed := range allowedPeerIds {
+		if nodeId == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer %s is not an allowed peer", nodeId)
+}
+
+// PeerNodeId returns the node id carried by the certificate of a peer, after its chain has been verified
+// Peer certificates are presented in both directions, and must allow server authentication,
+// so pure client certificates are never peers
+func PeerNodeId(state tls.ConnectionState) (string, error) {
+	if len(state.PeerCertificates) == 0 {
+		return "", fmt.Errorf("no peer certificates present")
+	}
+	cert := state.PeerCertificates[0]
+	serverAuth := false
+	for _, usage := range cert.ExtKeyUsage {
+		serverAuth = serverAuth || usage == x509.ExtKeyUsageServerAuth
+	}
+	if !serverAuth {
+		return "", fmt.Errorf("peer certificate %s is not a server certificate", cert.Subject.CommonName)
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == PeerURIScheme && uri.Host != "" {
+			return uri.Host, nil
+		}
+	}
+	return "", fmt.Errorf("peer certificate %s has no %s URI", cert.Subject.CommonName, PeerURIScheme)
+}
@@ -0,0 +1,127 @@
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewPeerTLSConfigs(t *testing.T) {
+	pki := newTestPKI(t)
+	pki.serverPEM, pki.serverKey = pki.issuePeer(t, "node-a", x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth)
+	config := pki.write(t, t.TempDir(), "one.com")
+	authn, err := NewAuthenticator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTLS, clientTLS, err := NewPeerTLSConfigs(authn, []string{"node-a", "node-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance presents its own certificate with the config of the peer
+	peerConfig := func(certPEM []byte, keyPEM []byte) *tls.Config {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := clientTLS.Clone()
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}
+		return config
+	}
+	tests := []struct {
+		name    string
+		config  *tls.Config
+		wantId  string
+		wantErr bool
+	}{
+		{name: "same instance", config: clientTLS, wantId: "node-a"},
+		{name: "allowed peer", config: peerConfig(pki.issuePeer(t, "node-b", x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth)), wantId: "node-b"},
+		{name: "peer not allowed", config: peerConfig(pki.issuePeer(t, "node-c", x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth)), wantErr: true},
+		{name: "client named as a peer", config: peerConfig(pki.issue(t, "node-b", x509.ExtKeyUsageClientAuth)), wantErr: true},
+		{name: "client with a peer URI", config: peerConfig(pki.issuePeer(t, "node-b", x509.ExtKeyUsageClientAuth)), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotId, err := peerHandshake(serverTLS, tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("peer handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotId != tt.wantId {
+				t.Errorf("peer node id = %q, want %q", gotId, tt.wantId)
+			}
+		})
+	}
+
+	// Both configs follow the rotated certificate of the instance
+	certPEM, keyPEM := pki.issuePeer(t, "node-b", x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth)
+	writeTestFile(t, config.ServerCert, certPEM)
+	writeTestFile(t, config.ServerKey, keyPEM)
+	if err = authn.(*fileAuthN).reload(); err != nil {
+		t.Fatal(err)
+	}
+	if gotId, err := peerHandshake(serverTLS, clientTLS); err != nil || gotId != "node-b" {
+		t.Errorf("peer handshake after rotation = %q, %v, want node-b", gotId, err)
+	}
+
+	// A dedicated peer certificate takes the place of the server certificate
+	config.PeerCert = filepath.Join(filepath.Dir(config.ServerCert), "peer.crt")
+	if _, err = NewAuthenticator(config); err == nil {
+		t.Errorf("NewAuthenticator() with a peer certificate without key succeeded, want error")
+	}
+	config.PeerKey = filepath.Join(filepath.Dir(config.ServerCert), "peer.key")
+	certPEM, keyPEM = pki.issuePeer(t, "node-c", x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth)
+	writeTestFile(t, config.PeerCert, certPEM)
+	writeTestFile(t, config.PeerKey, keyPEM)
+	if authn, err = NewAuthenticator(config); err != nil {
+		t.Fatal(err)
+	}
+	if serverTLS, clientTLS, err = NewPeerTLSConfigs(authn, []string{"node-c"}); err != nil {
+		t.Fatal(err)
+	}
+	if gotId, err := peerHandshake(serverTLS, clientTLS); err != nil || gotId != "node-c" {
+		t.Errorf("peer handshake with a peer certificate = %q, %v, want node-c", gotId, err)
+	}
+}
+
+// issuePeer creates a certificate identifying a proxy instance, signed by the CA
+func (p *testPKI) issuePeer(t *testing.T, nodeId string, usages ...x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	return p.sign(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: nodeId},
+		URIs:        []*url.URL{{Scheme: PeerURIScheme, Host: nodeId}},
+		ExtKeyUsage: usages,
+	})
+}
+
+// peerHandshake connects a peer to serverTLS, and returns the node id the server authenticated
+func peerHandshake(serverTLS *tls.Config, clientTLS *tls.Config) (string, error) {
+	serverSide, clientSide, err := connectedPair()
+	if err != nil {
+		return "", err
+	}
+	defer serverSide.Close()
+	defer clientSide.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	_ = serverSide.SetDeadline(deadline)
+	_ = clientSide.SetDeadline(deadline)
+
+	go func() {
+		client := tls.Client(clientSide, clientTLS)
+		if client.Handshake() == nil {
+			// With TLS 1.3, the server verifies the client certificate after the client completes its handshake
+			_, _ = client.Read(make([]byte, 1))
+		}
+	}()
+	server := tls.Server(serverSide, serverTLS)
+	if err = server.Handshake(); err != nil {
+		return "", err
+	}
+	return PeerNodeId(server.ConnectionState())
+}
@@ -0,0 +1,67 @@
+package security
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// revokedSerials is the set of certificate serial numbers revoked by a CRL, as decimal strings
+type revokedSerials map[string]struct{}
+
+func (r revokedSerials) contains(cert *x509.Certificate) bool {
+	_, revoked := r[cert.SerialNumber.String()]
+	return revoked
+}
+
+// loadRevocations reads the CRL in config, which must be signed by the CA; without a CRL nothing is revoked
+func loadRevocations(config ServerSecurityConfig) (revokedSerials, error) {
+	if config.CrlFile == "" {
+		return revokedSerials{}, nil
+	}
+	caCert, err := loadCACertificate(config.CaCert)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(config.CrlFile)
+	if err != nil {
+		return nil, err
+	}
+	// Accept both PEM and DER encodings, as both are common for CRLs
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse CRL %s. %w", config.CrlFile, err)
+	}
+	if err = crl.CheckSignatureFrom(caCert); err != nil {
+		return nil, fmt.Errorf("CRL %s is not signed by the CA. %w", config.CrlFile, err)
+	}
+	if !crl.NextUpdate.IsZero() && crl.NextUpdate.Before(time.Now()) {
+		// Still better than no CRL at all, as revocations are never undone
+		log.Println("WARNING: CRL", config.CrlFile, "is past its next update", crl.NextUpdate)
+	}
+
+	revoked := revokedSerials{}
+	for _, entry := range crl.RevokedCertificates {
+		revoked[entry.SerialNumber.String()] = struct{}{}
+	}
+	return revoked, nil
+}
+
+// loadCACertificate parses the first certificate of the CA file
+func loadCACertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,49 @@
+package security
+
+import (
+	"fmt"
+	"net"
+)
+
+// ParseNetworks parses the CIDRs of IPv4 or IPv6 networks, e.g. "10.0.0.0/8" or "2001:db8::/32"
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source network %q. %w", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// NetworksContain returns true if ip belongs to any of networks, or if networks is empty, i.e. unrestricted
+// IPv4 addresses are matched whether or not they are IPv4-mapped IPv6 addresses
+func NetworksContain(networks []*net.IPNet, ip net.IP) bool {
+	if len(networks) == 0 {
+		return true
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSource returns an error if ip is outside the source networks of the grant, or if they cannot be parsed
+func (g AppGrant) CheckSource(ip net.IP) error {
+	networks := g.sourceNetworks
+	if networks == nil {
+		// Grants that were not prepared by an Authorizer are parsed on every check
+		var err error
+		if networks, err = ParseNetworks(g.SourceNetworks); err != nil {
+			return err
+		}
+	}
+	if !NetworksContain(networks, ip) {
+		return fmt.Errorf("source %v is outside the source networks %v of the grant", ip, g.SourceNetworks)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package security
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default webhook settings, used when the config leaves them at 0
+const (
+	defaultWebhookTimeoutMillis = 2000
+	maxWebhookResponseBytes     = 1 << 20
+	maxWebhookLimits            = 10000 // Clients whose last limits are kept; the least recently allowed are dropped first
+)
+
+// WebhookConfig sets up an Authorizer that defers decisions to an external policy service
+type WebhookConfig struct {
+	URL               string // Endpoint receiving a POST of a WebhookRequest, answering with a WebhookResponse
+	TimeoutMillis     int64  // How long to wait for the endpoint
+	AllowCacheSeconds int64  // How long allow decisions are reused; 0 to always ask the endpoint
+	DenyCacheSeconds  int64  // How long deny decisions are reused; 0 to always ask the endpoint
+	FailOpen          bool   // Allow clients, with their last limits, when the endpoint cannot be reached or fails; otherwise deny them
+}
+
+// WebhookRequest is what the webhook endpoint receives for each decision
+type WebhookRequest struct {
+	ClientId    string
+	Groups      []string `json:",omitempty"`
+	AppId       string
+	SourceIP    string              `json:",omitempty"`
+	Certificate *WebhookCertificate `json:",omitempty"`
+}
+
+// WebhookCertificate holds the attributes of a client certificate sent to the webhook endpoint
+type WebhookCertificate struct {
+	SerialNumber       string
+	Subject            string
+	Issuer             string
+	CommonName         string
+	Organization       []string `json:",omitempty"`
+	OrganizationalUnit []string `json:",omitempty"`
+	DNSNames           []string `json:",omitempty"`
+	URIs               []string `json:",omitempty"`
+	EmailAddresses     []string `json:",omitempty"`
+	NotAfter           time.Time
+}
+
+// WebhookResponse is the decision of the webhook endpoint; Allow is false unless set
+type WebhookResponse struct {
+	Allow            bool
+	Reason           string                          // Why access was denied, for logs
+	ConnectionLimits *lbproxy.ConnectionLimits       // Replaces the connection limits of the app; nil to keep them
+	RateLimits       *lbproxy.RateLimitManagerConfig // Replaces the client rate limits of the app; nil to keep them
+}
+
+func NewWebhookAuthorizer(config WebhookConfig) (Authorizer, error) {
+	endpoint, err := url.Parse(config.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid authorization webhook URL %q", config.URL)
+	}
+	timeoutMillis := config.TimeoutMillis
+	if timeoutMillis <= 0 {
+		timeoutMillis = defaultWebhookTimeoutMillis
+	}
+	return &webhookAuthZ{
+		WebhookConfig: config,
+		client:        &http.Client{Timeout: time.Duration(timeoutMillis) * time.Millisecond},
+		cache:         map[string]webhookDecision{},
+		limits:        map[string]webhookLimits{},
+	}, nil
+}
+
+type webhookAuthZ struct {
+	WebhookConfig
+	client *http.Client
+	lock   sync.Mutex
+	cache  map[string]webhookDecision // By webhookCacheKey
+	// Limits last returned for each client to each app, by webhookLimitsKey: the limits of a client are shared by all
+	// its connections, so that they do not flip between decisions made for different addresses or certificates
+	limits map[string]webhookLimits
+}
+
+type webhookDecision struct {
+	err     error // Set if access was denied
+	expires time.Time
+}
+
+type webhookLimits struct {
+	grant   AppGrant
+	allowed time.Time // When the endpoint last returned these limits
+}
+
+func (a *webhookAuthZ) AuthorizeClient(identity ClientIdentity, appId string) (AppGrant, error) {
+	request := webhookRequest(identity, appId)
+	key := webhookCacheKey(request)
+	limitsKey := webhookLimitsKey(request)
+	now := time.Now()
+	a.lock.Lock()
+	decision, found := a.cache[key]
+	a.lock.Unlock()
+	if found && now.Before(decision.expires) {
+		return a.lastLimits(limitsKey, decision.err)
+	}
+
+	response, err := a.query(request)
+	var grant AppGrant
+	if err == nil && response.Allow {
+		// Limits that cannot be applied are a failure of the endpoint, like a response that cannot be read
+		if grant, err = prepareGrant(AppGrant{ConnectionLimits: response.ConnectionLimits, RateLimits: response.RateLimits}); err != nil {
+			err = fmt.Errorf("authorization webhook returned invalid limits. %w", err)
+		}
+	}
+	if err != nil {
+		// Failures are not cached, so that the endpoint is asked again on the next connection
+		if a.FailOpen {
+			// The client keeps the limits last returned by the endpoint, rather than losing them during an outage
+			log.Println("WARNING: authorization webhook failed, allowing client", identity.ClientId, "to", appId, "ERROR:", err)
+			return a.lastLimits(limitsKey, nil)
+		}
+		// The endpoint did not deny the client, so this must not count against it
+		return AppGrant{}, &UnavailableError{fmt.Errorf("client %s not allowed to access appId %s: authorization webhook failed. %w",
+			identity.ClientId, appId, err)}
+	}
+
+	decision = webhookDecision{}
+	cacheSeconds := a.AllowCacheSeconds
+	a.lock.Lock()
+	if !response.Allow {
+		decision.err = fmt.Errorf("client %s denied access to appId %s by authorization webhook: %s",
+			identity.ClientId, appId, response.Reason)
+		cacheSeconds = a.DenyCacheSeconds
+		delete(a.limits, limitsKey)
+	} else {
+		a.keepLimits(limitsKey, grant, now)
+	}
+	if cacheSeconds > 0 {
+		decision.expires = now.Add(time.Duration(cacheSeconds) * time.Second)
+		// Drop expired decisions, so that the cache does not grow with clients that are no longer connecting
+		for k, d := range a.cache {
+			if !now.Before(d.expires) {
+				delete(a.cache, k)
+			}
+		}
+		a.cache[key] = decision
+	}
+	a.lock.Unlock()
+	return a.lastLimits(limitsKey, decision.err)
+}
+
+// keepLimits records the limits last returned for a client to an app; when too many clients are kept, the one
+// allowed least recently is dropped, as it is the least likely to connect again during an outage
+// Must be called holding the lock
+func (a *webhookAuthZ) keepLimits(limitsKey string, grant AppGrant, now time.Time) {
+	if _, found := a.limits[limitsKey]; !found && len(a.limits) >= maxWebhookLimits {
+		oldestKey, oldest := "", now
+		for k, l := range a.limits {
+			if !l.allowed.After(oldest) {
+				oldestKey, oldest = k, l.allowed
+			}
+		}
+		delete(a.limits, oldestKey)
+	}
+	a.limits[limitsKey] = webhookLimits{grant: grant, allowed: now}
+}
+
+// lastLimits returns the grant with the limits last returned for a client to an app, unless access was denied with err
+func (a *webhookAuthZ) lastLimits(limitsKey string, err error) (AppGrant, error) {
+	if err != nil {
+		return AppGrant{}, err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.limits[limitsKey].grant, nil
+}
+
+// query posts request to the endpoint, and decodes its decision
+func (a *webhookAuthZ) query(request WebhookRequest) (WebhookResponse, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return WebhookResponse{}, err
+	}
+	httpResponse, err := a.client.Post(a.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return WebhookResponse{}, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return WebhookResponse{}, fmt.Errorf("authorization webhook returned %s", httpResponse.Status)
+	}
+	var response WebhookResponse
+	if err = json.NewDecoder(io.LimitReader(httpResponse.Body, maxWebhookResponseBytes)).Decode(&response); err != nil {
+		return WebhookResponse{}, fmt.Errorf("could not decode authorization webhook response. %w", err)
+	}
+	return response, nil
+}
+
+func webhookRequest(identity ClientIdentity, appId string) WebhookRequest {
+	request := WebhookRequest{
+		ClientId: strings.ToLower(identity.ClientId),
+		Groups:   identity.Groups,
+		AppId:    strings.ToLower(appId),
+	}
+	if identity.SourceIP != nil {
+		request.SourceIP = identity.SourceIP.String()
+	}
+	if cert := identity.Certificate; cert != nil {
+		request.Certificate = &WebhookCertificate{
+			SerialNumber:       cert.SerialNumber.String(),
+			Subject:            cert.Subject.String(),
+			Issuer:             cert.Issuer.String(),
+			CommonName:         cert.Subject.CommonName,
+			Organization:       cert.Subject.Organization,
+			OrganizationalUnit: cert.Subject.OrganizationalUnit,
+			DNSNames:           cert.DNSNames,
+			EmailAddresses:     cert.EmailAddresses,
+			NotAfter:           cert.NotAfter,
+		}
+		for _, uri := range cert.URIs {
+			request.Certificate.URIs = append(request.Certificate.URIs, uri.String())
+		}
+	}
+	return request
+}
+
+// webhookLimitsKey identifies the client and app whose connections share the limits returned by the endpoint
+func webhookLimitsKey(request WebhookRequest) string {
+	return request.ClientId + "|" + request.AppId
+}
+
+// webhookCacheKey identifies requests that get the same decision: the same client, from the same certificate
+// and address, to the same app
+func webhookCacheKey(request WebhookRequest) string {
+	serial := ""
+	if request.Certificate != nil {
+		serial = request.Certificate.SerialNumber
+	}
+	return strings.Join([]string{request.ClientId, request.AppId, request.SourceIP, serial}, "|")
+}
@@ -0,0 +1,165 @@
+package security
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"github.com/danielepagano/teleport-int-load-balancer/lib/lbproxy"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookAuthorizer(t *testing.T) {
+	var queries atomic.Int32
+	var lastRequest atomic.Pointer[WebhookRequest]
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		var request WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lastRequest.Store(&request)
+		switch request.ClientId {
+		case "one.com":
+			_ = json.NewEncoder(w).Encode(WebhookResponse{
+				Allow:      true,
+				RateLimits: &lbproxy.RateLimitManagerConfig{MaxOpenConnections: 1, MaxRateAmount: -1},
+			})
+		case "slow.com":
+			time.Sleep(500 * time.Millisecond)
+			_ = json.NewEncoder(w).Encode(WebhookResponse{Allow: true})
+		case "broken.com":
+			http.Error(w, "policy store unavailable", http.StatusServiceUnavailable)
+		case "invalid.com":
+			_ = json.NewEncoder(w).Encode(WebhookResponse{
+				Allow:      true,
+				RateLimits: &lbproxy.RateLimitManagerConfig{MaxOpenConnections: 0, MaxRateAmount: -1},
+			})
+		default:
+			_ = json.NewEncoder(w).Encode(WebhookResponse{Reason: "not on the list"})
+		}
+	}))
+	t.Cleanup(endpoint.Close)
+
+	authz, err := NewWebhookAuthorizer(WebhookConfig{
+		URL:               endpoint.URL,
+		TimeoutMillis:     100,
+		AllowCacheSeconds: 60,
+		DenyCacheSeconds:  60,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := ClientIdentity{
+		ClientId: "One.com",
+		Groups:   []string{"team-payments"},
+		Certificate: &x509.Certificate{
+			SerialNumber: big.NewInt(42),
+			Subject:      pkix.Name{CommonName: "one.com", OrganizationalUnit: []string{"team-payments"}},
+			DNSNames:     []string{"one.com"},
+			NotAfter:     time.Now().Add(time.Hour),
+		},
+		SourceIP: net.ParseIP("10.1.2.3"),
+	}
+
+	grant, err := authz.AuthorizeClient(identity, "Echo")
+	if err != nil {
+		t.Fatalf("AuthorizeClient() error = %v, want allowed", err)
+	}
+	if grant.RateLimits == nil || grant.RateLimits.MaxOpenConnections != 1 {
+		t.Errorf("AuthorizeClient() rate limits = %+v, want those of the webhook", grant.RateLimits)
+	}
+	request := lastRequest.Load()
+	if request.ClientId != "one.com" || request.AppId != "echo" || request.SourceIP != "10.1.2.3" ||
+		request.Certificate == nil || request.Certificate.SerialNumber != "42" ||
+		len(request.Certificate.OrganizationalUnit) != 1 || len(request.Groups) != 1 {
+		t.Errorf("webhook request = %+v, want the client, app, source IP and certificate attributes", request)
+	}
+
+	// Decisions are cached, whether allowed or denied
+	denied := ClientIdentity{ClientId: "two.com"}
+	for i := 0; i < 2; i++ {
+		if _, err = authz.AuthorizeClient(identity, "echo"); err != nil {
+			t.Errorf("cached AuthorizeClient() error = %v, want allowed", err)
+		}
+		if _, err = authz.AuthorizeClient(denied, "echo"); err == nil || !strings.Contains(err.Error(), "not on the list") {
+			t.Errorf("AuthorizeClient() error = %v, want denied with the webhook reason", err)
+		}
+		if !IsSecurityFailure(err) {
+			t.Errorf("AuthorizeClient() denied by the webhook: error = %v, want a security failure", err)
+		}
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("webhook queried %d times, want 2 as decisions are cached", n)
+	}
+	// Another source address gets its own decision
+	moved := identity
+	moved.SourceIP = net.ParseIP("192.168.1.1")
+	if _, err = authz.AuthorizeClient(moved, "echo"); err != nil || queries.Load() != 3 {
+		t.Errorf("AuthorizeClient() from another address error = %v, queries = %d, want a new allowed query", err, queries.Load())
+	}
+	// Limits that cannot be applied are a failure of the endpoint, so they are not cached
+	for i := 0; i < 2; i++ {
+		if _, err = authz.AuthorizeClient(ClientIdentity{ClientId: "invalid.com"}, "echo"); err == nil || IsSecurityFailure(err) {
+			t.Errorf("AuthorizeClient() with invalid limits: error = %v, want the webhook failed", err)
+		}
+	}
+	if n := queries.Load(); n != 5 {
+		t.Errorf("webhook queried %d times, want 5 as invalid limits are not cached", n)
+	}
+
+	for _, failOpen := range []bool{false, true} {
+		authz, err = NewWebhookAuthorizer(WebhookConfig{URL: endpoint.URL, TimeoutMillis: 100, FailOpen: failOpen})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, clientId := range []string{"slow.com", "broken.com"} {
+			_, err = authz.AuthorizeClient(ClientIdentity{ClientId: clientId}, "echo")
+			if (err == nil) != failOpen {
+				t.Errorf("AuthorizeClient(%s) with FailOpen %v: error = %v", clientId, failOpen, err)
+			}
+			// The endpoint did not deny the client, so it must not be banned for it
+			if IsSecurityFailure(err) {
+				t.Errorf("AuthorizeClient(%s) with FailOpen %v: error = %v is a security failure", clientId, failOpen, err)
+			}
+		}
+	}
+
+	if _, err = NewWebhookAuthorizer(WebhookConfig{URL: "policy.internal:8080"}); err == nil {
+		t.Errorf("NewWebhookAuthorizer() without a scheme succeeded, want error")
+	}
+}
+
+func TestWebhookAuthorizerLimitsBound(t *testing.T) {
+	authz := &webhookAuthZ{limits: map[string]webhookLimits{}}
+	start := time.Now()
+	for i := 0; i < maxWebhookLimits; i++ {
+		authz.keepLimits(fmt.Sprintf("client%d|echo", i), AppGrant{}, start.Add(time.Duration(i)*time.Second))
+	}
+	// Refreshing the limits of a client already kept does not drop anyone
+	authz.keepLimits("client0|echo", AppGrant{}, start.Add(maxWebhookLimits*time.Second))
+	if len(authz.limits) != maxWebhookLimits {
+		t.Fatalf("limits kept = %d, want %d", len(authz.limits), maxWebhookLimits)
+	}
+
+	authz.keepLimits("new|echo", AppGrant{}, start.Add((maxWebhookLimits+1)*time.Second))
+	if len(authz.limits) != maxWebhookLimits {
+		t.Errorf("limits kept = %d, want at most %d", len(authz.limits), maxWebhookLimits)
+	}
+	if _, found := authz.limits["client1|echo"]; found {
+		t.Errorf("limits of the client allowed least recently were kept")
+	}
+	for _, key := range []string{"client0|echo", "new|echo"} {
+		if _, found := authz.limits[key]; !found {
+			t.Errorf("limits of %s were dropped, want kept as they were allowed recently", key)
+		}
+	}
+}
@@ -12,13 +12,31 @@ type Application interface {
 	// SubmitConnection hands off a client connection to load-balance it against one of the upstream servers
 	// After the connection is submitted, the Application instance will decide whether it will be connected
 	// or not, and otherwise close it and manage any errors.
-	SubmitConnection(clientConnection net.Conn, rateLimitManager RateLimitManager)
+	// The connection is closed once it reaches any of the caps in limits
+	SubmitConnection(clientConnection net.Conn, rateLimitManager RateLimitManager, limits ConnectionLimits)
+}
+
+// ConnectionLimits cap what a single proxied connection can do, e.g. to only allow short-lived transfers
+type ConnectionLimits struct {
+	MaxBytesPerDirection int64 // Bytes proxied in each direction before the connection is closed; 0 for no cap
+	MaxDurationSeconds   int64 // How long the connection is proxied before it is closed; 0 for no cap
 }
 
 // ApplicationConfig initializes an Application instance
 type ApplicationConfig struct {
-	Name      string           // Used for diagnostic logging
-	Upstreams []UpstreamServer // Upstream servers to use
+	Name      string            // Used for diagnostic logging, and to identify the application in LoadStore
+	Upstreams []UpstreamServer  // Upstream servers to use
+	LoadStore UpstreamLoadStore // Cluster mode: balance together with other instances; nil to only count local connections
+}
+
+// UpstreamLoadStore shares the open connections per upstream between instances proxying the same application,
+// so that least-connections balancing takes the whole cluster into account
+type UpstreamLoadStore interface {
+	// PeerLoads returns the open connections per upstream address of an application, summed over all other instances
+	PeerLoads(appName string) map[string]int
+
+	// PublishLoads records the open connections per upstream address of an application on this instance
+	PublishLoads(appName string, loads map[string]int)
 }
 
 // UpstreamServer describes a server being load-balanced
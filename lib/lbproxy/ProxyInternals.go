@@ -6,11 +6,16 @@ import (
 	"log"
 	"math"
 	"net"
+	"os"
 	"sync"
+	"time"
 )
 
 const LogClosedConnErrors = false
 
+// MaxDelayedAttempts caps how many times a connection is re-submitted to a RateLimitManager that keeps delaying it
+const MaxDelayedAttempts = 3
+
 func InitApplication(config ApplicationConfig) Application {
 	app := &application{
 		config:       config,
@@ -29,22 +34,31 @@ type application struct {
 	upstreamConn map[string]int
 }
 
-func (a *application) SubmitConnection(client net.Conn, rlm RateLimitManager) {
-	// Rate-limit exceeded; close client connection
+func (a *application) SubmitConnection(client net.Conn, rlm RateLimitManager, limits ConnectionLimits) {
 	appId := a.config.Name
-	if !rlm.AddConnection() {
-		log.Println("Rate limit exceeded for app", appId)
+	decision := rlm.AddConnection()
+
+	// A delayed decision means the scope is throttling rather than rejecting; wait as instructed and ask again
+	for attempt := 1; decision.Outcome == RateLimitDelayed && attempt <= MaxDelayedAttempts; attempt++ {
+		log.Println("Rate limit delayed connection for app", appId, "from", client.RemoteAddr(), decision)
+		time.Sleep(decision.RetryAfter)
+		decision = rlm.AddConnection()
+	}
+
+	// Rate-limit exceeded; close client connection
+	if !decision.Allowed() {
+		log.Println("Rate limit exceeded for app", appId, "from", client.RemoteAddr(), decision)
 		// Close connection; it was never added to count of open connections in rlm;
 		// No further clean-up necessary
 		a.closeConnection(client)
 	} else {
 		// Release the connection from RLM after proxying is completed
 		defer rlm.ReleaseConnection()
-		a.proxyConnection(client)
+		a.proxyConnection(client, rlm, limits)
 	}
 }
 
-func (a *application) proxyConnection(clientConn net.Conn) {
+func (a *application) proxyConnection(clientConn net.Conn, rlm RateLimitManager, limits ConnectionLimits) {
 	// Use an upstream connection within this scope
 	upStream := a.acquireUpstream()
 	defer a.releaseUpstream(upStream)
@@ -69,10 +83,24 @@ func (a *application) proxyConnection(clientConn net.Conn) {
 
 	defer a.closeConnection(upstreamConn)
 
+	// Reads and writes fail past the deadline, which ends both pipes
+	if limits.MaxDurationSeconds > 0 {
+		deadline := time.Now().Add(time.Duration(limits.MaxDurationSeconds) * time.Second)
+		if err = clientConn.SetDeadline(deadline); err == nil {
+			err = upstreamConn.SetDeadline(deadline)
+		}
+		if err != nil {
+			log.Println(a.config.Name, ": could not set max duration of connection from", clientConn.RemoteAddr(), "ERR:", err)
+			return
+		}
+	}
+
 	aSourceClosed := make(chan struct{}, 1)
+	// Both pipes hit the same deadline, but it is one reason to close the connection
+	durationLogged := &sync.Once{}
 
-	go a.pipe(clientConn, upstreamConn, aSourceClosed)
-	go a.pipe(upstreamConn, clientConn, aSourceClosed)
+	go a.pipe(&transferCounter{clientConn, rlm}, upstreamConn, aSourceClosed, limits.MaxBytesPerDirection, durationLogged)
+	go a.pipe(&transferCounter{upstreamConn, rlm}, clientConn, aSourceClosed, limits.MaxBytesPerDirection, durationLogged)
 
 	// Wait until one side sends EOF or has error, at which point we'll exit this,
 	// which will hit the deferred closes and wrap up everything
@@ -82,18 +110,57 @@ func (a *application) proxyConnection(clientConn net.Conn) {
 	// We could avoid this with some more complex coordination, at the risk of more concurrency issues
 }
 
-func (a *application) pipe(dest, source net.Conn, srcClosed chan struct{}) {
+func (a *application) pipe(dest io.Writer, source net.Conn, srcClosed chan struct{}, maxBytes int64, durationLogged *sync.Once) {
 	// If we wanted to implement bandwidth rate-limiting/throttling, we would need to
 	// manually copy the data between the connections, as io.Copy continues until error or EOF
-	_, err := io.Copy(dest, source)
+	n, limitReached, err := copyLimited(dest, source, maxBytes)
 
-	if err != nil && (LogClosedConnErrors || !errors.Is(err, net.ErrClosed)) {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		durationLogged.Do(func() {
+			log.Println(a.config.Name, ": closing connection with", source.RemoteAddr(), "REASON: max duration reached")
+		})
+	} else if err != nil && (LogClosedConnErrors || !errors.Is(err, net.ErrClosed)) {
 		log.Println("Network IO error", err)
+	} else if limitReached {
+		log.Println(a.config.Name, ": closing connection with", source.RemoteAddr(), "REASON: max bytes reached", n)
 	}
 
 	srcClosed <- struct{}{}
 }
 
+// copyLimited copies up to maxBytes from source to dest, or everything if maxBytes is not positive, and
+// reports whether source had more to send than the limit allows; a stream ending at exactly the limit did not
+func copyLimited(dest io.Writer, source io.Reader, maxBytes int64) (int64, bool, error) {
+	if maxBytes <= 0 {
+		n, err := io.Copy(dest, source)
+		return n, false, err
+	}
+	n, err := io.Copy(dest, io.LimitReader(source, maxBytes))
+	if err != nil || n < maxBytes {
+		return n, false, err
+	}
+	// Only one more byte tells the limit apart from EOF; it is never forwarded, as the connection is closed
+	_, err = io.ReadFull(source, make([]byte, 1))
+	if errors.Is(err, io.EOF) {
+		return n, false, nil
+	}
+	return n, err == nil, err
+}
+
+// transferCounter reports the bytes written to a connection to the RateLimitManager of the client, e.g. for quotas
+type transferCounter struct {
+	io.Writer
+	rlm RateLimitManager
+}
+
+func (t *transferCounter) Write(p []byte) (int, error) {
+	n, err := t.Writer.Write(p)
+	if n > 0 {
+		t.rlm.RecordTransfer(int64(n))
+	}
+	return n, err
+}
+
 func (a *application) closeConnection(c net.Conn) {
 	err := c.Close()
 	if err != nil && (LogClosedConnErrors || !errors.Is(err, net.ErrClosed)) {
@@ -104,18 +171,26 @@ func (a *application) closeConnection(c net.Conn) {
 func (a *application) acquireUpstream() string {
 	// Thread-safe map operation to find and increase active connections per upstream
 	// Follow with defer acquireUpstream()
+	// In cluster mode, connections of other instances count too; we fetch them before locking, as they
+	// are eventually consistent anyway
+	var peerLoads map[string]int
+	if a.config.LoadStore != nil {
+		peerLoads = a.config.LoadStore.PeerLoads(a.config.Name)
+	}
+
 	a.routingLock.Lock()
 	defer a.routingLock.Unlock()
 	minConn := math.MaxInt
 	var upstream string
 	for k, v := range a.upstreamConn {
-		if v < minConn {
+		if v+peerLoads[k] < minConn {
 			upstream = k
-			minConn = v
+			minConn = v + peerLoads[k]
 		}
 	}
 	a.upstreamConn[upstream] += 1
-	log.Println("Acquired upstream", upstream, "LOAD:", a.upstreamConn)
+	a.publishLoads()
+	log.Println("Acquired upstream", upstream, "LOAD:", a.upstreamConn, "PEER LOAD:", peerLoads)
 	return upstream
 }
 
@@ -126,6 +201,20 @@ func (a *application) releaseUpstream(upstream string) {
 	if a.upstreamConn[upstream] > 0 {
 		a.upstreamConn[upstream] -= 1
 	}
+	a.publishLoads()
 	log.Println("Released upstream", upstream, "LOAD:", a.upstreamConn)
 	return
 }
+
+// publishLoads shares a copy of the local connections per upstream in cluster mode
+// Must be called holding routingLock
+func (a *application) publishLoads() {
+	if a.config.LoadStore == nil {
+		return
+	}
+	loads := make(map[string]int, len(a.upstreamConn))
+	for k, v := range a.upstreamConn {
+		loads[k] = v
+	}
+	a.config.LoadStore.PublishLoads(a.config.Name, loads)
+}
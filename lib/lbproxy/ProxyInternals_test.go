@@ -1,16 +1,19 @@
 package lbproxy
 
 import (
+	"bytes"
+	"io"
 	"log"
 	"net"
-	"sync"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_application_SubmitConnection(t *testing.T) {
 	type fields struct {
 		config       ApplicationConfig
-		routingLock  sync.RWMutex
 		upstreamConn map[string]int
 	}
 	type args struct {
@@ -82,7 +85,6 @@ func Test_application_SubmitConnection(t *testing.T) {
 						{Address: upstreamAddress},
 					},
 				},
-				routingLock:  sync.RWMutex{},
 				upstreamConn: map[string]int{upstreamAddress: 0},
 			},
 			args: args{
@@ -95,10 +97,131 @@ func Test_application_SubmitConnection(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			a := &application{
 				config:       tt.fields.config,
-				routingLock:  tt.fields.routingLock,
 				upstreamConn: tt.fields.upstreamConn,
 			}
-			a.SubmitConnection(tt.args.client, tt.args.rlm)
+			a.SubmitConnection(tt.args.client, tt.args.rlm, ConnectionLimits{})
 		})
 	}
 }
+
+func Test_application_SubmitConnectionLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		limits    ConnectionLimits
+		wantBytes int
+	}{
+		{name: "maxBytes", limits: ConnectionLimits{MaxBytesPerDirection: 10}, wantBytes: 10},
+		{name: "maxDuration", limits: ConnectionLimits{MaxDurationSeconds: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The upstream streams data until the connection is closed
+			upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer upstreamListener.Close()
+			go func() {
+				conn, err := upstreamListener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				chunk := []byte("0123456789")
+				for {
+					if _, err := conn.Write(chunk); err != nil {
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}()
+
+			upstreamAddress := upstreamListener.Addr().String()
+			a := InitApplication(ApplicationConfig{Name: "ut", Upstreams: []UpstreamServer{{Address: upstreamAddress}}})
+			client, proxySide := net.Pipe()
+			rlm := CreateRateLimitManager("ut", RateLimitManagerConfig{MaxOpenConnections: -1, MaxRateAmount: -1})
+			go a.SubmitConnection(proxySide, rlm, tt.limits)
+
+			// Reading ends once the proxy closes the connection
+			_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+			received, err := io.ReadAll(client)
+			if err != nil {
+				t.Fatalf("connection was not closed by the proxy: %v", err)
+			}
+			if tt.wantBytes > 0 && len(received) != tt.wantBytes {
+				t.Errorf("received %d bytes, want %d", len(received), tt.wantBytes)
+			}
+		})
+	}
+}
+
+func Test_copyLimited(t *testing.T) {
+	tests := []struct {
+		name             string
+		source           string
+		maxBytes         int64
+		wantCopied       string
+		wantLimitReached bool
+	}{
+		{name: "noLimit", source: "0123456789", maxBytes: 0, wantCopied: "0123456789"},
+		{name: "belowLimit", source: "01234", maxBytes: 10, wantCopied: "01234"},
+		{name: "endsAtLimit", source: "0123456789", maxBytes: 10, wantCopied: "0123456789"},
+		{name: "overLimit", source: "0123456789A", maxBytes: 10, wantCopied: "0123456789", wantLimitReached: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dest bytes.Buffer
+			n, limitReached, err := copyLimited(&dest, strings.NewReader(tt.source), tt.maxBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dest.String() != tt.wantCopied || n != int64(len(tt.wantCopied)) {
+				t.Errorf("copied %d bytes %q, want %q", n, dest.String(), tt.wantCopied)
+			}
+			if limitReached != tt.wantLimitReached {
+				t.Errorf("limitReached = %v, want %v", limitReached, tt.wantLimitReached)
+			}
+		})
+	}
+}
+
+// fakeLoadStore reports fixed loads for other instances, and records the published ones
+type fakeLoadStore struct {
+	peerLoads map[string]int
+	published map[string]int
+}
+
+func (f *fakeLoadStore) PeerLoads(appName string) map[string]int {
+	return f.peerLoads
+}
+
+func (f *fakeLoadStore) PublishLoads(appName string, loads map[string]int) {
+	f.published = loads
+}
+
+func Test_application_acquireUpstreamClusterMode(t *testing.T) {
+	store := &fakeLoadStore{peerLoads: map[string]int{"a:1": 3, "b:1": 1}}
+	app := InitApplication(ApplicationConfig{
+		Name:      "ut",
+		Upstreams: []UpstreamServer{{Address: "a:1"}, {Address: "b:1"}, {Address: "c:1"}},
+		LoadStore: store,
+	}).(*application)
+
+	// Combined loads are a=3, b=1, c=0, so c is picked first, then b and c once each, in either order
+	picked := map[string]int{}
+	for i := 0; i < 3; i++ {
+		picked[app.acquireUpstream()]++
+	}
+	want := map[string]int{"b:1": 1, "c:1": 2}
+	if !reflect.DeepEqual(picked, want) {
+		t.Errorf("acquireUpstream() picked = %v, want %v", picked, want)
+	}
+	if !reflect.DeepEqual(store.published, map[string]int{"a:1": 0, "b:1": 1, "c:1": 2}) {
+		t.Errorf("published loads = %v", store.published)
+	}
+
+	app.releaseUpstream("c:1")
+	if store.published["c:1"] != 1 {
+		t.Errorf("published loads after release = %v", store.published)
+	}
+}
@@ -0,0 +1,207 @@
+package lbproxy
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// QuotaPeriod is the calendar period over which a quota is counted
+type QuotaPeriod string
+
+const (
+	QuotaDaily   QuotaPeriod = "daily"   // Resets at midnight
+	QuotaMonthly QuotaPeriod = "monthly" // Resets at midnight of the first day of the month
+)
+
+// QuotaConfig captures quota manager configuration parameters
+type QuotaConfig struct {
+	Period               QuotaPeriod
+	Location             string // IANA time zone in which periods start, e.g. "UTC"; empty for UTC
+	MaxConnections       int64  // How many connections can be opened per period; -1 to remove checks
+	MaxBytes             int64  // How many bytes can be proxied per period, in both directions; -1 to remove checks
+	WarnThresholdPercent int    // Usage percentage of either quota at which the warning fires; 0 to disable
+}
+
+// QuotaUsage is the usage of a quota scope within one period
+type QuotaUsage struct {
+	PeriodStart       int64 // Unix time at which the period started
+	Connections       int64
+	Bytes             int64
+	WarnedConnections bool // The warning already fired for connections in this period
+	WarnedBytes       bool // The warning already fired for bytes in this period
+}
+
+// QuotaWarningHandler is called, once per quota and period, when usage crosses the warning threshold
+// It is called holding the lock of the quota manager, so it must not call back into it
+type QuotaWarningHandler func(tag string, trigger RateLimitTrigger, usage QuotaUsage, config QuotaConfig)
+
+// CreateQuotaManager creates a RateLimitManager that caps total connections and bytes over calendar periods,
+// e.g. for billing; connections already open when the byte quota runs out are not interrupted
+// Quotas only count; they are meant to be stacked with other managers in a composite, after any manager that
+// may deny, so that connections denied by the others are not counted in the first place
+func CreateQuotaManager(tag string, config QuotaConfig, onWarning QuotaWarningHandler) (*quotaManager, error) {
+	if config.Period != QuotaDaily && config.Period != QuotaMonthly {
+		return nil, fmt.Errorf("unknown quota period %q", config.Period)
+	}
+	if config.WarnThresholdPercent < 0 || config.WarnThresholdPercent > 100 {
+		return nil, fmt.Errorf("quota warning threshold must be between 0 and 100, got %d", config.WarnThresholdPercent)
+	}
+	location, err := time.LoadLocation(config.Location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid quota location %q. %w", config.Location, err)
+	}
+	return &quotaManager{
+		tag:       tag,
+		config:    config,
+		location:  location,
+		onWarning: onWarning,
+		currentTime: func() int64 {
+			return time.Now().Unix()
+		},
+	}, nil
+}
+
+type quotaManager struct {
+	sync.Mutex
+	tag         string
+	config      QuotaConfig
+	location    *time.Location
+	onWarning   QuotaWarningHandler // nil to only log warnings
+	currentTime unixTimeSupplier
+	usage       QuotaUsage
+}
+
+func (q *quotaManager) AddConnection() RateLimitDecision {
+	q.Lock()
+	defer q.Unlock()
+	now := q.currentTime()
+	q.rollPeriod(now)
+
+	decision := RateLimitDecision{WindowCount: int(q.usage.Connections)}
+	if q.config.MaxConnections >= 0 && q.usage.Connections >= q.config.MaxConnections {
+		decision.Trigger = TriggerQuotaConnections
+		decision.Limit = int(q.config.MaxConnections)
+	} else if q.config.MaxBytes >= 0 && q.usage.Bytes >= q.config.MaxBytes {
+		decision.Trigger = TriggerQuotaBytes
+		decision.Limit = int(q.config.MaxBytes)
+	}
+	if decision.Trigger != TriggerNone {
+		decision.Outcome = RateLimitDenied
+		decision.RetryAfter = time.Duration(q.nextPeriodStart()-now) * time.Second
+		return decision
+	}
+
+	q.usage.Connections += 1
+	decision.Outcome = RateLimitAllowed
+	decision.WindowCount += 1
+	q.checkWarning(TriggerQuotaConnections, q.usage.Connections, q.config.MaxConnections, &q.usage.WarnedConnections)
+	return decision
+}
+
+// ReleaseConnection is a no-op, as quotas count connections opened, not open
+func (q *quotaManager) ReleaseConnection() {}
+
+// CancelConnection gives back the connection counted by AddConnection, unless the quota period rolled since
+func (q *quotaManager) CancelConnection(RateLimitDecision) {
+	q.Lock()
+	defer q.Unlock()
+	q.rollPeriod(q.currentTime())
+	if q.usage.Connections > 0 {
+		q.usage.Connections -= 1
+	}
+}
+
+func (q *quotaManager) RecordTransfer(bytes int64) {
+	q.Lock()
+	defer q.Unlock()
+	q.rollPeriod(q.currentTime())
+	q.usage.Bytes += bytes
+	q.checkWarning(TriggerQuotaBytes, q.usage.Bytes, q.config.MaxBytes, &q.usage.WarnedBytes)
+}
+
+// Usage returns the usage of the current period
+func (q *quotaManager) Usage() QuotaUsage {
+	q.Lock()
+	defer q.Unlock()
+	q.rollPeriod(q.currentTime())
+	return q.usage
+}
+
+func (q *quotaManager) Snapshot() RateLimitSnapshot {
+	usage := q.Usage()
+	return RateLimitSnapshot{Tag: q.tag, Quota: &usage}
+}
+
+func (q *quotaManager) scopeTag() string {
+	return q.tag
+}
+
+// Restore replaces the usage with a snapshot of the current period; usage of past periods no longer counts
+// The snapshot holds the whole usage of the scope, so restoring it twice must not count it twice
+func (q *quotaManager) Restore(snapshot RateLimitSnapshot) {
+	if snapshot.Quota == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.rollPeriod(q.currentTime())
+	if snapshot.Quota.PeriodStart == q.usage.PeriodStart {
+		q.usage = *snapshot.Quota
+	}
+}
+
+// rollPeriod resets usage when a new period has started
+// Must be called holding the lock
+func (q *quotaManager) rollPeriod(now int64) {
+	start := q.periodStart(now)
+	if start != q.usage.PeriodStart {
+		if q.usage.PeriodStart != 0 {
+			log.Println("QUOTA", q.tag, "period ended with usage", q.usage)
+		}
+		q.usage = QuotaUsage{PeriodStart: start}
+	}
+}
+
+// periodStart returns the start of the calendar period that includes now
+func (q *quotaManager) periodStart(now int64) int64 {
+	t := time.Unix(now, 0).In(q.location)
+	year, month, day := t.Date()
+	if q.config.Period == QuotaMonthly {
+		day = 1
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, q.location).Unix()
+}
+
+// nextPeriodStart returns the start of the period after the current one
+// Must be called holding the lock
+func (q *quotaManager) nextPeriodStart() int64 {
+	start := time.Unix(q.usage.PeriodStart, 0).In(q.location)
+	if q.config.Period == QuotaMonthly {
+		return start.AddDate(0, 1, 0).Unix()
+	}
+	return start.AddDate(0, 0, 1).Unix()
+}
+
+// checkWarning fires the warning once per period, when used crosses the threshold of limit
+// Must be called holding the lock
+func (q *quotaManager) checkWarning(trigger RateLimitTrigger, used, limit int64, warned *bool) {
+	if *warned || limit < 0 || q.config.WarnThresholdPercent == 0 {
+		return
+	}
+	if used*100 < limit*int64(q.config.WarnThresholdPercent) {
+		return
+	}
+	*warned = true
+	log.Println("QUOTA WARNING", q.tag, trigger, "usage:", used, "of", limit, "in period starting",
+		time.Unix(q.usage.PeriodStart, 0).In(q.location))
+	if q.onWarning != nil {
+		q.onWarning(q.tag, trigger, q.usage, q.config)
+	}
+}
+
+// overrideTimeSupplier is an internal method to supply a function to mock the passage of time for testing
+func (q *quotaManager) overrideTimeSupplier(supplier unixTimeSupplier) {
+	q.currentTime = supplier
+}
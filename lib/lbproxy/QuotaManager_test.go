@@ -0,0 +1,114 @@
+package lbproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_QuotaManager(t *testing.T) {
+	// 10am on the 15th; the daily period started at midnight, the monthly one on the 1st
+	morning := time.Date(2023, time.May, 15, 10, 0, 0, 0, time.UTC).Unix()
+
+	t.Run("connections", func(t *testing.T) {
+		qm, now := newTestQuotaManager(t, QuotaConfig{Period: QuotaDaily, MaxConnections: 2, MaxBytes: -1}, morning, nil)
+		for i := 0; i < 2; i++ {
+			if d := qm.AddConnection(); !d.Allowed() {
+				t.Fatalf("connection %d denied: %v", i, d)
+			}
+		}
+		d := qm.AddConnection()
+		if d.Allowed() || d.Trigger != TriggerQuotaConnections || d.Limit != 2 {
+			t.Errorf("connection over quota = %v, want denied by %v", d, TriggerQuotaConnections)
+		}
+		if d.RetryAfter != 14*time.Hour {
+			t.Errorf("RetryAfter = %v, want time until midnight", d.RetryAfter)
+		}
+		// Quotas count connections opened, so releasing does not give any back
+		qm.ReleaseConnection()
+		if qm.AddConnection().Allowed() {
+			t.Errorf("connection allowed after release, want denied")
+		}
+		// Cancelling does, since the connection never went ahead
+		qm.CancelConnection(RateLimitDecision{})
+		if d := qm.AddConnection(); !d.Allowed() {
+			t.Errorf("connection after cancel = %v, want allowed", d)
+		}
+		// A new day resets the quota
+		now = now + int64(14*time.Hour/time.Second)
+		qm.overrideTimeSupplier(func() int64 { return now })
+		if d = qm.AddConnection(); !d.Allowed() {
+			t.Errorf("connection on the next day = %v, want allowed", d)
+		}
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		qm, _ := newTestQuotaManager(t, QuotaConfig{Period: QuotaMonthly, MaxConnections: -1, MaxBytes: 100}, morning, nil)
+		if !qm.AddConnection().Allowed() {
+			t.Fatalf("first connection denied")
+		}
+		qm.RecordTransfer(60)
+		qm.RecordTransfer(40)
+		d := qm.AddConnection()
+		if d.Allowed() || d.Trigger != TriggerQuotaBytes {
+			t.Errorf("connection over byte quota = %v, want denied by %v", d, TriggerQuotaBytes)
+		}
+		if d.RetryAfter != 17*24*time.Hour-10*time.Hour {
+			t.Errorf("RetryAfter = %v, want time until the first of June", d.RetryAfter)
+		}
+	})
+
+	t.Run("warning", func(t *testing.T) {
+		var warnings []RateLimitTrigger
+		onWarning := func(_ string, trigger RateLimitTrigger, _ QuotaUsage, _ QuotaConfig) {
+			warnings = append(warnings, trigger)
+		}
+		config := QuotaConfig{Period: QuotaDaily, MaxConnections: 10, MaxBytes: 1000, WarnThresholdPercent: 80}
+		qm, _ := newTestQuotaManager(t, config, morning, onWarning)
+		for i := 0; i < 10; i++ {
+			qm.AddConnection()
+		}
+		qm.RecordTransfer(799)
+		qm.RecordTransfer(1)
+		qm.RecordTransfer(100)
+		want := []RateLimitTrigger{TriggerQuotaConnections, TriggerQuotaBytes}
+		if len(warnings) != len(want) || warnings[0] != want[0] || warnings[1] != want[1] {
+			t.Errorf("warnings = %v, want %v once each", warnings, want)
+		}
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		config := QuotaConfig{Period: QuotaDaily, MaxConnections: 3, MaxBytes: -1}
+		qm, _ := newTestQuotaManager(t, config, morning, nil)
+		qm.AddConnection()
+		qm.AddConnection()
+		qm.RecordTransfer(5)
+		snapshot := qm.Snapshot()
+
+		restored, _ := newTestQuotaManager(t, config, morning+60, nil)
+		restored.Restore(snapshot)
+		if usage := restored.Usage(); usage.Connections != 2 || usage.Bytes != 5 {
+			t.Errorf("restored usage = %+v, want 2 connections and 5 bytes", usage)
+		}
+		// Restoring again replaces the usage, rather than adding to it
+		restored.Restore(snapshot)
+		if usage := restored.Usage(); usage.Connections != 2 || usage.Bytes != 5 {
+			t.Errorf("usage restored twice = %+v, want 2 connections and 5 bytes", usage)
+		}
+
+		// Usage of a past period no longer counts
+		tomorrow, _ := newTestQuotaManager(t, config, morning+24*60*60, nil)
+		tomorrow.Restore(snapshot)
+		if usage := tomorrow.Usage(); usage.Connections != 0 || usage.Bytes != 0 {
+			t.Errorf("usage restored on the next day = %+v, want none", usage)
+		}
+	})
+}
+
+func newTestQuotaManager(t *testing.T, config QuotaConfig, now int64, onWarning QuotaWarningHandler) (*quotaManager, int64) {
+	qm, err := CreateQuotaManager("test", config, onWarning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qm.overrideTimeSupplier(func() int64 { return now })
+	return qm, now
+}
@@ -1,24 +1,202 @@
 package lbproxy
 
+import (
+	"fmt"
+	"time"
+)
+
 // RateLimitManager tracks rate limits in an arbitrary scope
 // Each method is a request for an action against that scope,
-// and most will return true if the request is allowed, false if denied
+// and most will return a RateLimitDecision describing whether the request is allowed, denied or delayed
 //
-// In a more complex system, the response could be struct that allows for
-// in-between states, for example data transfers may be delayed to maintain a
+// The decision allows for in-between states, for example data transfers may be delayed to maintain a
 // goal data rate across the entire scope (e.g. bandwidth limit across all connections of one client)
 type RateLimitManager interface {
 	// AddConnection checks that the quantity and timing of a connection request matches the policy for this
-	// scope, and returns true if so, and false otherwise
-	AddConnection() bool
+	// scope, and returns a decision describing the outcome, which limit triggered and the current usage
+	// When the scope has a wait queue, a request that would be denied may block until a slot opens
+	AddConnection() RateLimitDecision
 
 	// ReleaseConnection decreases the count of active connections to support max open connections capping
 	ReleaseConnection()
+
+	// RecordTransfer accounts for bytes proxied by a connection of this scope, in either direction
+	RecordTransfer(bytes int64)
+}
+
+// PersistentRateLimitManager is implemented by managers whose state can be saved and restored, e.g. across restarts
+type PersistentRateLimitManager interface {
+	RateLimitManager
+
+	// Snapshot returns the state of the scope that should survive a restart
+	Snapshot() RateLimitSnapshot
+
+	// Restore merges a snapshot into the state of the scope, normally right after creation
+	Restore(snapshot RateLimitSnapshot)
+}
+
+// ConfigurableRateLimitManager is implemented by managers whose limits can be changed while they are in use
+type ConfigurableRateLimitManager interface {
+	RateLimitManager
+
+	// UpdateConfig replaces the limits of the scope, keeping its windows and open connections;
+	// the new limits apply from the next AddConnection
+	UpdateConfig(config RateLimitManagerConfig)
+}
+
+// CancelableRateLimitManager is implemented by managers that can take back a connection they allowed,
+// e.g. because another policy stacked over the same scope denied it, as if it had never been requested
+type CancelableRateLimitManager interface {
+	RateLimitManager
+
+	// CancelConnection undoes the AddConnection that returned decision, which must have been allowed
+	CancelConnection(decision RateLimitDecision)
+}
+
+// IdleRateLimitManager is implemented by managers that can tell when their scope holds no state,
+// so that a manager created on demand can be dropped without losing track of any limit
+type IdleRateLimitManager interface {
+	RateLimitManager
+
+	// Idle returns true if the scope has no open or queued connections, and nothing left in its window
+	Idle() bool
+}
+
+// RateLimitSnapshot is the persistent state of a RateLimitManager
+// Open connections are not included, since they do not survive a restart
+type RateLimitSnapshot struct {
+	Tag        string              `json:",omitempty"` // Tag of the manager, to match the snapshots of stacked managers
+	Timestamps []int64             // Times at which connections were added within the sliding window
+	Nested     []RateLimitSnapshot `json:",omitempty"` // Snapshots of stacked managers, each restored by tag
+	Quota      *QuotaUsage         `json:",omitempty"` // Usage of a quota manager in its current period
+}
+
+// RateLimitStore holds the state of rate-limit scopes on behalf of RateLimitManager instances
+// Implementations may share state between proxy instances, so that together they enforce one combined limit;
+// in that case the state of other instances is eventually consistent
+type RateLimitStore interface {
+	// Usage returns the open connections of a scope, and the (sorted) timestamps of connections added at or after
+	// windowStart, across all instances sharing the store. Callers must not modify the returned timestamps
+	Usage(scope string, windowStart int64) RateLimitUsage
+
+	// AddConnection records a connection opened by this instance at ts; if countTimestamp is false,
+	// the connection is counted as open, but does not count towards the connection rate
+	AddConnection(scope string, ts int64, countTimestamp bool)
+
+	// ReleaseConnection records a connection closed by this instance
+	ReleaseConnection(scope string)
+
+	// CancelConnection undoes AddConnection: it releases the connection and, unless ts is 0,
+	// forgets one timestamp ts recorded by this instance
+	CancelConnection(scope string, ts int64)
+
+	// LocalTimestamps returns a copy of the timestamps recorded by this instance at or after windowStart
+	LocalTimestamps(scope string, windowStart int64) []int64
+
+	// RestoreTimestamps merges previously recorded timestamps into the state of this instance
+	RestoreTimestamps(scope string, timestamps []int64)
+}
+
+// RateLimitUsage is the state of a rate-limit scope
+type RateLimitUsage struct {
+	OpenConnections int
+	Timestamps      []int64 // Sorted times at which connections were added
 }
 
 // RateLimitManagerConfig captures RateLimitManager instance configuration parameters
 type RateLimitManagerConfig struct {
-	MaxOpenConnections   int   // How many concurrent OPEN connections are allowed; -1 to remove checks
-	MaxRateAmount        int   // How many connections can be opened per time period; -1 to remove checks
-	MaxRatePeriodSeconds int64 // The size of the sliding window for MaxRateAmount
+	MaxOpenConnections   int               // How many concurrent OPEN connections are allowed; -1 to remove checks
+	MaxRateAmount        int               // How many connections can be opened per time period; -1 to remove checks
+	MaxRatePeriodSeconds int64             // The size of the sliding window for MaxRateAmount
+	MaxQueueDepth        int               // How many denied connections can wait for a slot; 0 to deny right away
+	MaxQueueWaitMillis   int64             // How long a queued connection waits for a slot before being denied
+	Shadow               bool              // Dry-run: denials are logged and counted, but the connection is allowed anyway
+	Schedule             []RateLimitWindow // Limits replacing the ones above at times of day; the first active one wins
+}
+
+// RateLimitOutcome is the overall result of a rate-limit request
+type RateLimitOutcome int
+
+const (
+	RateLimitUnknown RateLimitOutcome = iota // Zero value, e.g. of a decision that was never made; never allowed
+	RateLimitAllowed                         // Request can proceed right away
+	RateLimitDenied                          // Request must be rejected
+	RateLimitDelayed                         // Request can proceed once RetryAfter has elapsed
+)
+
+func (o RateLimitOutcome) String() string {
+	switch o {
+	case RateLimitUnknown:
+		return "unknown"
+	case RateLimitAllowed:
+		return "allowed"
+	case RateLimitDenied:
+		return "denied"
+	case RateLimitDelayed:
+		return "delayed"
+	}
+	return fmt.Sprintf("outcome(%d)", int(o))
+}
+
+// RateLimitTrigger identifies the limit that caused a request to be denied or delayed
+type RateLimitTrigger int
+
+const (
+	TriggerNone             RateLimitTrigger = iota // No limit was hit
+	TriggerMaxOpen                                  // MaxOpenConnections was reached
+	TriggerMaxRate                                  // MaxRateAmount was reached within the sliding window
+	TriggerQueueFull                                // The request would have waited, but MaxQueueDepth was reached
+	TriggerQueueTimeout                             // The request waited MaxQueueWaitMillis without a slot opening
+	TriggerQuotaConnections                         // The connection quota of the current period was used up
+	TriggerQuotaBytes                               // The byte quota of the current period was used up
+)
+
+func (t RateLimitTrigger) String() string {
+	switch t {
+	case TriggerNone:
+		return "none"
+	case TriggerMaxOpen:
+		return "max-open"
+	case TriggerMaxRate:
+		return "max-rate"
+	case TriggerQueueFull:
+		return "queue-full"
+	case TriggerQueueTimeout:
+		return "queue-timeout"
+	case TriggerQuotaConnections:
+		return "quota-connections"
+	case TriggerQuotaBytes:
+		return "quota-bytes"
+	}
+	return fmt.Sprintf("trigger(%d)", int(t))
+}
+
+// RateLimitDecision is the response of a RateLimitManager to a request
+type RateLimitDecision struct {
+	Outcome         RateLimitOutcome
+	Trigger         RateLimitTrigger // Which limit was hit, TriggerNone when allowed
+	OpenConnections int              // Open connections in scope when the decision was made
+	WindowCount     int              // Connections added within the current sliding window
+	Limit           int              // Value of the limit that triggered, 0 when allowed
+	RetryAfter      time.Duration    // When not allowed, how long until the request may succeed; 0 if unknown
+	Waited          time.Duration    // How long the request was held in the wait queue of the scope
+	ShadowDenied    bool             // Allowed only because the policy is in shadow mode; Trigger and Limit say why
+	windowTs        int64            // Timestamp the connection added to the sliding window, 0 if none; to cancel it
+}
+
+// Allowed returns true if the request can proceed right away
+func (d RateLimitDecision) Allowed() bool {
+	return d.Outcome == RateLimitAllowed
+}
+
+func (d RateLimitDecision) String() string {
+	if d.Allowed() && d.ShadowDenied {
+		return fmt.Sprintf("%v in shadow mode, denied by %v (open: %d, window: %d, limit: %d)",
+			d.Outcome, d.Trigger, d.OpenConnections, d.WindowCount, d.Limit)
+	}
+	if d.Allowed() {
+		return fmt.Sprintf("%v (open: %d, window: %d)", d.Outcome, d.OpenConnections, d.WindowCount)
+	}
+	return fmt.Sprintf("%v by %v (open: %d, window: %d, limit: %d, retry after: %v, waited: %v)",
+		d.Outcome, d.Trigger, d.OpenConnections, d.WindowCount, d.Limit, d.RetryAfter, d.Waited)
 }
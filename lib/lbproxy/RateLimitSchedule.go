@@ -0,0 +1,127 @@
+package lbproxy
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// RateLimitWindow replaces the limits of a RateLimitManagerConfig during a daily time range, e.g. to allow
+// batch clients more connections at night. The sliding window period is not affected, so that switching
+// limits does not reset the connections already counted
+type RateLimitWindow struct {
+	Start              string // Time of day at which the window starts, as "15:04"
+	End                string // Time of day at which the window ends (excluded); before Start to span midnight
+	Location           string // IANA time zone of Start and End, e.g. "Europe/Rome"; empty for UTC
+	MaxOpenConnections int    // Replaces MaxOpenConnections within the window; -1 to remove checks
+	MaxRateAmount      int    // Replaces MaxRateAmount within the window; -1 to remove checks
+}
+
+// ValidateSchedule checks that all windows of a schedule can be parsed, and that none denies every connection
+func ValidateSchedule(schedule []RateLimitWindow) error {
+	for i, w := range schedule {
+		if _, err := parseRateLimitWindow(w); err != nil {
+			return fmt.Errorf("invalid rate-limit window %d. %w", i, err)
+		}
+		if w.MaxOpenConnections == 0 || w.MaxRateAmount == 0 {
+			return fmt.Errorf("rate-limit window %d has zero allowed rate", i)
+		}
+	}
+	return nil
+}
+
+// ValidateLimits checks the schedule of a configuration, and that the connection rate, if limited at any time
+// of the day, is counted over a positive period; without one, the sliding window would always be empty
+func ValidateLimits(config RateLimitManagerConfig) error {
+	if err := ValidateSchedule(config.Schedule); err != nil {
+		return err
+	}
+	limitsRate := config.MaxRateAmount >= 0
+	for _, w := range config.Schedule {
+		limitsRate = limitsRate || w.MaxRateAmount >= 0
+	}
+	if limitsRate && config.MaxRatePeriodSeconds <= 0 {
+		return fmt.Errorf("rate limit requires a positive period, got %d seconds", config.MaxRatePeriodSeconds)
+	}
+	return nil
+}
+
+// scheduledWindow is a parsed RateLimitWindow
+type scheduledWindow struct {
+	RateLimitWindow
+	start, end int // Minutes after midnight
+	location   *time.Location
+}
+
+func parseRateLimitWindow(w RateLimitWindow) (scheduledWindow, error) {
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return scheduledWindow{}, err
+	}
+	end, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return scheduledWindow{}, err
+	}
+	location, err := time.LoadLocation(w.Location)
+	if err != nil {
+		return scheduledWindow{}, err
+	}
+	return scheduledWindow{
+		RateLimitWindow: w,
+		start:           start.Hour()*60 + start.Minute(),
+		end:             end.Hour()*60 + end.Minute(),
+		location:        location,
+	}, nil
+}
+
+// parseSchedule parses the schedule of a config; windows that cannot be parsed are logged and skipped,
+// callers should use ValidateSchedule to reject them up front
+func parseSchedule(tag string, schedule []RateLimitWindow) []scheduledWindow {
+	parsed := make([]scheduledWindow, 0, len(schedule))
+	for _, w := range schedule {
+		sw, err := parseRateLimitWindow(w)
+		if err != nil {
+			log.Println("RLM", tag, "ignoring invalid rate-limit window", w, "ERROR:", err)
+			continue
+		}
+		parsed = append(parsed, sw)
+	}
+	return parsed
+}
+
+// contains returns true if the window is active at ts
+func (w scheduledWindow) contains(ts int64) bool {
+	t := time.Unix(ts, 0).In(w.location)
+	minute := t.Hour()*60 + t.Minute()
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	// Spans midnight
+	return minute >= w.start || minute < w.end
+}
+
+// activeLimits returns config with the limits of the first window active at ts, if any
+func activeLimits(config RateLimitManagerConfig, schedule []scheduledWindow, ts int64) RateLimitManagerConfig {
+	for _, w := range schedule {
+		if w.contains(ts) {
+			config.MaxOpenConnections = w.MaxOpenConnections
+			config.MaxRateAmount = w.MaxRateAmount
+			break
+		}
+	}
+	return config
+}
+
+// tracksRate returns true if the connection rate is limited at any time of the day,
+// in which case timestamps must always be recorded, so they are there when a window starts
+func tracksRate(config RateLimitManagerConfig, schedule []scheduledWindow) bool {
+	if config.MaxRateAmount >= 0 {
+		return true
+	}
+	for _, w := range schedule {
+		if w.MaxRateAmount >= 0 {
+			return true
+		}
+	}
+	return false
+}
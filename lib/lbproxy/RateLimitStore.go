@@ -0,0 +1,122 @@
+package lbproxy
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryRateLimitStore is a RateLimitStore that keeps state in memory, for a single proxy instance
+type MemoryRateLimitStore struct {
+	sync.Mutex
+	scopes map[string]*RateLimitUsage
+}
+
+func CreateMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{scopes: map[string]*RateLimitUsage{}}
+}
+
+func (s *MemoryRateLimitStore) Usage(scope string, windowStart int64) RateLimitUsage {
+	s.Lock()
+	defer s.Unlock()
+	usage, found := s.scopes[scope]
+	if !found {
+		return RateLimitUsage{Timestamps: []int64{}}
+	}
+	usage.Timestamps = trimTimestamps(usage.Timestamps, windowStart)
+	return *usage
+}
+
+func (s *MemoryRateLimitStore) AddConnection(scope string, ts int64, countTimestamp bool) {
+	s.Lock()
+	defer s.Unlock()
+	usage := s.getOrCreate(scope)
+	usage.OpenConnections += 1
+	if countTimestamp {
+		usage.Timestamps = append(usage.Timestamps, ts)
+	}
+}
+
+func (s *MemoryRateLimitStore) ReleaseConnection(scope string) {
+	s.Lock()
+	defer s.Unlock()
+	if usage, found := s.scopes[scope]; found && usage.OpenConnections > 0 {
+		usage.OpenConnections -= 1
+	}
+}
+
+func (s *MemoryRateLimitStore) CancelConnection(scope string, ts int64) {
+	s.Lock()
+	defer s.Unlock()
+	usage, found := s.scopes[scope]
+	if !found {
+		return
+	}
+	if usage.OpenConnections > 0 {
+		usage.OpenConnections -= 1
+	}
+	if ts == 0 {
+		return
+	}
+	// Timestamps are sorted, and equal ones are interchangeable, so drop the last one matching
+	for i := len(usage.Timestamps) - 1; i >= 0 && usage.Timestamps[i] >= ts; i-- {
+		if usage.Timestamps[i] == ts {
+			usage.Timestamps = append(usage.Timestamps[:i:i], usage.Timestamps[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *MemoryRateLimitStore) LocalTimestamps(scope string, windowStart int64) []int64 {
+	return copyTimestamps(s.Usage(scope, windowStart).Timestamps)
+}
+
+func (s *MemoryRateLimitStore) RestoreTimestamps(scope string, timestamps []int64) {
+	s.Lock()
+	defer s.Unlock()
+	usage := s.getOrCreate(scope)
+	usage.Timestamps = mergeTimestamps(usage.Timestamps, timestamps)
+}
+
+// Scopes returns a copy of the usage of all scopes, with timestamps at or after oldest,
+// and forgets scopes that have no open connections or timestamps left
+func (s *MemoryRateLimitStore) Scopes(oldest int64) map[string]RateLimitUsage {
+	s.Lock()
+	defer s.Unlock()
+	scopes := map[string]RateLimitUsage{}
+	for scope, usage := range s.scopes {
+		usage.Timestamps = trimTimestamps(usage.Timestamps, oldest)
+		if usage.OpenConnections == 0 && len(usage.Timestamps) == 0 {
+			delete(s.scopes, scope)
+			continue
+		}
+		scopes[scope] = RateLimitUsage{
+			OpenConnections: usage.OpenConnections,
+			Timestamps:      copyTimestamps(usage.Timestamps),
+		}
+	}
+	return scopes
+}
+
+func (s *MemoryRateLimitStore) getOrCreate(scope string) *RateLimitUsage {
+	usage, found := s.scopes[scope]
+	if !found {
+		usage = &RateLimitUsage{Timestamps: []int64{}}
+		s.scopes[scope] = usage
+	}
+	return usage
+}
+
+func copyTimestamps(ts []int64) []int64 {
+	copied := make([]int64, len(ts))
+	copy(copied, ts)
+	return copied
+}
+
+// mergeTimestamps returns a new sorted list with the elements of both lists
+func mergeTimestamps(a []int64, b []int64) []int64 {
+	merged := make([]int64, 0, len(a)+len(b))
+	merged = append(merged, a...)
+	merged = append(merged, b...)
+	sort.Slice(merged, func(i, j int) bool { return merged[i] < merged[j] })
+	return merged
+}
@@ -0,0 +1,95 @@
+package lbproxy
+
+// CreateCompositeRateLimitManager stacks several policies over the same scope, so that a connection is only allowed
+// if every one of them allows it. This is also how a shadow policy runs next to the enforced one:
+// since a shadow policy always allows, it is evaluated and counted without changing the outcome.
+// Composites stacked in a composite are flattened, so that each manager is snapshotted under its own tag.
+func CreateCompositeRateLimitManager(managers ...RateLimitManager) RateLimitManager {
+	flattened := make([]RateLimitManager, 0, len(managers))
+	for _, m := range managers {
+		if composite, ok := m.(*compositeRLM); ok {
+			flattened = append(flattened, composite.managers...)
+		} else {
+			flattened = append(flattened, m)
+		}
+	}
+	return &compositeRLM{managers: flattened}
+}
+
+type compositeRLM struct {
+	managers []RateLimitManager
+}
+
+// taggedRateLimitManager is a persistent manager whose snapshots are matched to it by the tag of its scope
+type taggedRateLimitManager interface {
+	PersistentRateLimitManager
+	scopeTag() string
+}
+
+// AddConnection asks each manager in order, and returns the first denial, or the decision of the first manager
+func (c *compositeRLM) AddConnection() RateLimitDecision {
+	decisions := make([]RateLimitDecision, 0, len(c.managers))
+	for _, m := range c.managers {
+		decision := m.AddConnection()
+		if !decision.Allowed() {
+			c.cancel(decisions)
+			return decision
+		}
+		decisions = append(decisions, decision)
+	}
+	if len(decisions) == 0 {
+		return RateLimitDecision{Outcome: RateLimitAllowed}
+	}
+	return decisions[0]
+}
+
+// cancel makes the first managers forget a connection they allowed, as it will never be released;
+// managers that cannot cancel only release it, so e.g. its timestamp stays in their window
+func (c *compositeRLM) cancel(decisions []RateLimitDecision) {
+	for i, decision := range decisions {
+		if cancelable, ok := c.managers[i].(CancelableRateLimitManager); ok {
+			cancelable.CancelConnection(decision)
+		} else {
+			c.managers[i].ReleaseConnection()
+		}
+	}
+}
+
+func (c *compositeRLM) ReleaseConnection() {
+	for _, m := range c.managers {
+		m.ReleaseConnection()
+	}
+}
+
+func (c *compositeRLM) RecordTransfer(bytes int64) {
+	for _, m := range c.managers {
+		m.RecordTransfer(bytes)
+	}
+}
+
+// Snapshot nests the snapshots of the stacked managers that can be persisted
+func (c *compositeRLM) Snapshot() RateLimitSnapshot {
+	var snapshot RateLimitSnapshot
+	for _, m := range c.managers {
+		if tagged, ok := m.(taggedRateLimitManager); ok {
+			snapshot.Nested = append(snapshot.Nested, tagged.Snapshot())
+		}
+	}
+	return snapshot
+}
+
+// Restore gives each stacked manager the nested snapshot with its tag, so that managers added or removed
+// since the snapshot was taken, e.g. a shadow policy, do not shift the others
+func (c *compositeRLM) Restore(snapshot RateLimitSnapshot) {
+	byTag := make(map[string]RateLimitSnapshot, len(snapshot.Nested))
+	for _, nested := range snapshot.Nested {
+		byTag[nested.Tag] = nested
+	}
+	for _, m := range c.managers {
+		if tagged, ok := m.(taggedRateLimitManager); ok {
+			if nested, found := byTag[tagged.scopeTag()]; found {
+				tagged.Restore(nested)
+			}
+		}
+	}
+}
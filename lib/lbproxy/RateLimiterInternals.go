@@ -1,30 +1,48 @@
 package lbproxy
 
 import (
+	"container/list"
+	"expvar"
 	"log"
 	"sort"
 	"sync"
 	"time"
 )
 
+// shadowDenials counts, by scope tag, the connections that shadow policies would have denied
+var shadowDenials = expvar.NewMap("lbproxy_shadow_denials")
+
 // unixTimeSupplier abstract retrieval of current time for testing harness
 type unixTimeSupplier func() int64
 
 type rlManager struct {
 	sync.RWMutex
-	tag                    string // for diagnostics
-	config                 RateLimitManagerConfig
-	currentOpenConnections int
-	addedTimestamps        []int64
-	currentTime            unixTimeSupplier
+	tag         string // for diagnostics, and the key of the scope in the store
+	config      RateLimitManagerConfig
+	schedule    []scheduledWindow // Parsed config.Schedule
+	store       RateLimitStore
+	currentTime unixTimeSupplier
+	waiters     *list.List // FIFO of *rlWaiter, only used when wait mode is enabled
+}
+
+// rlWaiter is a connection request held in the queue of a scope, waiting for a slot to open
+type rlWaiter struct {
+	wake chan struct{} // Signalled when the waiter reaches the head of the queue, or a slot may have opened
 }
 
 func CreateRateLimitManager(tag string, config RateLimitManagerConfig) *rlManager {
+	return CreateSharedRateLimitManager(tag, config, CreateMemoryRateLimitStore())
+}
+
+// CreateSharedRateLimitManager creates a RateLimitManager whose state is kept in a store, which may be shared
+// with other instances; tag must be the same on every instance that enforces the same scope
+func CreateSharedRateLimitManager(tag string, config RateLimitManagerConfig, store RateLimitStore) *rlManager {
 	rlm := &rlManager{
-		tag:                    tag,
-		config:                 config,
-		currentOpenConnections: 0,
-		addedTimestamps:        []int64{},
+		tag:      tag,
+		config:   config,
+		schedule: parseSchedule(tag, config.Schedule),
+		store:    store,
+		waiters:  list.New(),
 	}
 	// Current time is normally wall time, but can be changed for testing
 	rlm.currentTime = func() int64 {
@@ -38,50 +56,244 @@ func (m *rlManager) overrideTimeSupplier(supplier unixTimeSupplier) {
 	m.currentTime = supplier
 }
 
-func (m *rlManager) AddConnection() bool {
+func (m *rlManager) AddConnection() RateLimitDecision {
 	// Since most of the time we'll make writes, we'll just take one write lock
 	m.Lock()
 	defer m.Unlock()
 
-	// If you have too many connections already open, deny
-	if m.config.MaxOpenConnections >= 0 && m.currentOpenConnections >= m.config.MaxOpenConnections {
-		log.Println("RLM", m.tag, "DENIED open:", m.currentOpenConnections, "max:", m.config.MaxOpenConnections)
-		return false
+	// Requests already waiting go first, so only try right away when nobody is queued
+	if m.waiters.Len() == 0 {
+		decision := m.tryAddConnection()
+		if decision.Allowed() || m.config.MaxQueueDepth <= 0 {
+			return decision
+		}
 	}
 
-	// Only check added connection if we could possibly fail
-	currentTs := m.currentTime()
-	if m.config.MaxRateAmount >= 0 && len(m.addedTimestamps) >= m.config.MaxRateAmount {
-		// +1 because if e.g. if we allow 1 event/sec, window will start at current time, because this timestamp has been already used
-		windowStart := currentTs - m.config.MaxRatePeriodSeconds + 1
-
-		// trim items outside of window
-		m.addedTimestamps = trimTimestamps(m.addedTimestamps, windowStart)
-		if len(m.addedTimestamps) >= m.config.MaxRateAmount {
-			log.Println("RLM", m.tag, "DENIED @", currentTs, "ts:", m.addedTimestamps, "max:", m.config.MaxRateAmount)
-			return false
+	if m.waiters.Len() >= m.config.MaxQueueDepth {
+		usage := m.currentUsage()
+		decision := RateLimitDecision{
+			Outcome:         RateLimitDenied,
+			Trigger:         TriggerQueueFull,
+			OpenConnections: usage.OpenConnections,
+			WindowCount:     len(usage.Timestamps),
+			Limit:           m.config.MaxQueueDepth,
 		}
+		log.Println("RLM", m.tag, "DENIED", decision)
+		return decision
 	}
+	return m.waitForConnection()
+}
 
-	// If we got here, we're allowing the connection
-	m.currentOpenConnections += 1
+// waitForConnection queues a connection request until it reaches the head of the queue and a slot opens,
+// or until the max wait elapses. Must be called holding the write lock, which is released while waiting
+func (m *rlManager) waitForConnection() RateLimitDecision {
+	waiter := &rlWaiter{wake: make(chan struct{}, 1)}
+	element := m.waiters.PushBack(waiter)
+	started := time.Now()
+	deadline := time.NewTimer(time.Duration(m.config.MaxQueueWaitMillis) * time.Millisecond)
+	defer deadline.Stop()
+
+	var decision RateLimitDecision
+	for {
+		// Only the head of the queue may take a slot, which keeps waiters in fair order
+		var windowSlide *time.Timer
+		var windowSlideC <-chan time.Time
+		if m.waiters.Front() == element {
+			decision = m.tryAddConnection()
+			if decision.Allowed() {
+				m.waiters.Remove(element)
+				m.wakeHead()
+				decision.Waited = time.Since(started)
+				return decision
+			}
+			// When the rate limit triggered, we know when the window slides enough to try again
+			if decision.RetryAfter > 0 {
+				windowSlide = time.NewTimer(decision.RetryAfter)
+				windowSlideC = windowSlide.C
+			}
+		}
 
+		m.Unlock()
+		timedOut := false
+		select {
+		case <-waiter.wake:
+		case <-windowSlideC:
+		case <-deadline.C:
+			timedOut = true
+		}
+		if windowSlide != nil {
+			windowSlide.Stop()
+		}
+		m.Lock()
+
+		if timedOut {
+			wasHead := m.waiters.Front() == element
+			m.waiters.Remove(element)
+			if wasHead {
+				m.wakeHead()
+			}
+			usage := m.currentUsage()
+			decision.Outcome = RateLimitDenied
+			decision.Trigger = TriggerQueueTimeout
+			decision.OpenConnections = usage.OpenConnections
+			decision.WindowCount = len(usage.Timestamps)
+			decision.Limit = 0
+			decision.Waited = time.Since(started)
+			log.Println("RLM", m.tag, "DENIED", decision)
+			return decision
+		}
+	}
+}
+
+// wakeHead signals the waiter at the head of the queue, if any, that it may try to take a slot
+func (m *rlManager) wakeHead() {
+	if head := m.waiters.Front(); head != nil {
+		select {
+		case head.Value.(*rlWaiter).wake <- struct{}{}:
+		default: // Already signalled
+		}
+	}
+}
+
+// tryAddConnection applies the limits of the scope and adds the connection if they allow it
+// Must be called holding the write lock
+func (m *rlManager) tryAddConnection() RateLimitDecision {
+	currentTs := m.currentTime()
+	// Limits may change with the time of day, but the counters do not, so they carry over when they do
+	config := activeLimits(m.config, m.schedule, currentTs)
+	// +1 because if e.g. if we allow 1 event/sec, window will start at current time, because this timestamp has been already used
+	usage := m.store.Usage(m.tag, currentTs-m.config.MaxRatePeriodSeconds+1)
+	decision := RateLimitDecision{
+		OpenConnections: usage.OpenConnections,
+		WindowCount:     len(usage.Timestamps),
+	}
+
+	// If you have too many connections already open, deny
+	if config.MaxOpenConnections >= 0 && usage.OpenConnections >= config.MaxOpenConnections {
+		decision.Outcome = RateLimitDenied
+		decision.Trigger = TriggerMaxOpen
+		decision.Limit = config.MaxOpenConnections
+		// Retry time depends on when another connection is released, so it is unknown
+		return m.deny(decision, currentTs)
+	}
+
+	// The store only returns timestamps within the window, so we can check the count right away
+	if config.MaxRateAmount >= 0 && len(usage.Timestamps) >= config.MaxRateAmount {
+		decision.Outcome = RateLimitDenied
+		decision.Trigger = TriggerMaxRate
+		decision.Limit = config.MaxRateAmount
+		decision.RetryAfter = retryAfter(usage.Timestamps, config, currentTs)
+		log.Println("RLM", m.tag, "window @", currentTs, "ts:", usage.Timestamps)
+		return m.deny(decision, currentTs)
+	}
+
+	// If we got here, we're allowing the connection
 	// Only track added timestamps if connection rate-limiting is enabled, as the code above will limit inserts.
 	// Without this check, we'll simply keep adding timestamps to the list when rate limiting is not enabled
-	if m.config.MaxRateAmount >= 0 {
-		m.addedTimestamps = append(m.addedTimestamps, currentTs)
+	trackRate := tracksRate(m.config, m.schedule)
+	m.store.AddConnection(m.tag, currentTs, trackRate)
+	decision.Outcome = RateLimitAllowed
+	decision.OpenConnections += 1
+	if trackRate {
+		decision.WindowCount += 1
+		decision.windowTs = currentTs
 	}
-	log.Println("RLM+", m.tag, "open:", m.currentOpenConnections, "ts:", m.addedTimestamps)
-	return true
+	log.Println("RLM+", m.tag, decision)
+	return decision
+}
+
+// deny finalizes a denied decision; in shadow mode the denial is only logged and counted, and the connection allowed
+// Must be called holding the write lock
+func (m *rlManager) deny(decision RateLimitDecision, currentTs int64) RateLimitDecision {
+	if !m.config.Shadow {
+		log.Println("RLM", m.tag, "DENIED", decision)
+		return decision
+	}
+
+	shadowDenials.Add(m.tag, 1)
+	// The connection goes ahead and will be released, so it counts as open; its timestamp is not recorded,
+	// so the sliding window only holds connections the policy would have allowed if enforced
+	m.store.AddConnection(m.tag, currentTs, false)
+	decision.Outcome = RateLimitAllowed
+	decision.ShadowDenied = true
+	decision.OpenConnections += 1
+	log.Println("RLM", m.tag, "SHADOW DENIED", decision)
+	return decision
 }
 
 func (m *rlManager) ReleaseConnection() {
 	m.Lock()
 	defer m.Unlock()
-	if m.currentOpenConnections > 0 {
-		m.currentOpenConnections -= 1
+	m.store.ReleaseConnection(m.tag)
+	// A slot has opened, so the head of the queue can try to take it
+	m.wakeHead()
+	log.Println("RLM-", m.tag, "usage:", m.currentUsage())
+}
+
+func (m *rlManager) CancelConnection(decision RateLimitDecision) {
+	m.Lock()
+	defer m.Unlock()
+	m.store.CancelConnection(m.tag, decision.windowTs)
+	m.wakeHead()
+	log.Println("RLM-", m.tag, "cancelled, usage:", m.currentUsage())
+}
+
+func (m *rlManager) UpdateConfig(config RateLimitManagerConfig) {
+	m.Lock()
+	defer m.Unlock()
+	m.config = config
+	m.schedule = parseSchedule(m.tag, config.Schedule)
+	// Looser limits may let the head of the queue through right away
+	m.wakeHead()
+	log.Println("RLM", m.tag, "updated config:", config, "usage:", m.currentUsage())
+}
+
+func (m *rlManager) Idle() bool {
+	m.Lock()
+	defer m.Unlock()
+	usage := m.currentUsage()
+	return usage.OpenConnections == 0 && len(usage.Timestamps) == 0 && m.waiters.Len() == 0
+}
+
+// RecordTransfer is a no-op, as sliding windows only limit connections
+func (m *rlManager) RecordTransfer(int64) {}
+
+func (m *rlManager) Snapshot() RateLimitSnapshot {
+	m.Lock()
+	defer m.Unlock()
+	// Timestamps outside the window will never count again, so there is no point in saving them
+	return RateLimitSnapshot{Tag: m.tag, Timestamps: m.store.LocalTimestamps(m.tag, m.windowStart())}
+}
+
+func (m *rlManager) scopeTag() string {
+	return m.tag
+}
+
+func (m *rlManager) Restore(snapshot RateLimitSnapshot) {
+	m.Lock()
+	defer m.Unlock()
+	if !tracksRate(m.config, m.schedule) {
+		return
+	}
+	windowStart := m.windowStart()
+	restored := make([]int64, 0, len(snapshot.Timestamps))
+	for _, ts := range snapshot.Timestamps {
+		if ts >= windowStart {
+			restored = append(restored, ts)
+		}
 	}
-	log.Println("RLM-", m.tag, "open:", m.currentOpenConnections, "ts:", m.addedTimestamps)
+	m.store.RestoreTimestamps(m.tag, restored)
+	log.Println("RLM", m.tag, "restored ts:", restored)
+}
+
+// windowStart returns the start of the sliding window at the current time
+func (m *rlManager) windowStart() int64 {
+	return m.currentTime() - m.config.MaxRatePeriodSeconds + 1
+}
+
+// currentUsage returns the usage of the scope in the current window
+func (m *rlManager) currentUsage() RateLimitUsage {
+	return m.store.Usage(m.tag, m.windowStart())
 }
 
 // trimTimestamps removed timestamps from ts that are older than windowStart
@@ -99,3 +311,18 @@ func trimTimestamps(ts []int64, windowStart int64) []int64 {
 	// Purge elements before windowStart
 	return ts[newStart:]
 }
+
+// retryAfter computes how long until enough timestamps leave the sliding window to allow one more connection
+// ts must be already trimmed to the current window, and hold at least config.MaxRateAmount elements
+func retryAfter(ts []int64, config RateLimitManagerConfig, currentTs int64) time.Duration {
+	if config.MaxRateAmount <= 0 || len(ts) < config.MaxRateAmount {
+		return 0
+	}
+	// The window must drop len(ts) - MaxRateAmount + 1 timestamps, so the last one to go is at this index
+	leaving := ts[len(ts)-config.MaxRateAmount]
+	seconds := leaving + config.MaxRatePeriodSeconds - currentTs
+	if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // How many times to repeat parallel tests, to ensure results are stable
@@ -23,7 +24,7 @@ func Test_RateLimitManagerConnectRates(t *testing.T) {
 		rate := 3
 
 		for i := 1; i <= iterations; i++ { // Start at 1 so %0 doesn't hit right away
-			if rlm.AddConnection() {
+			if rlm.AddConnection().Allowed() {
 				allowedCount++
 			}
 			// Increment every third item; i.e. rate 3 per sec
@@ -48,7 +49,7 @@ func Test_RateLimitManagerConnectRates(t *testing.T) {
 		actualRate := 10
 
 		for i := 1; i <= iterations; i++ { // Start at 1 so %0 doesn't hit right away
-			if rlm.AddConnection() {
+			if rlm.AddConnection().Allowed() {
 				allowedCount++
 			}
 
@@ -73,7 +74,7 @@ func Test_RateLimitManagerConnectRates(t *testing.T) {
 		iterations := 60
 
 		for i := 1; i <= iterations; i++ { // Start at 1 so %0 doesn't hit right away
-			if rlm.AddConnection() {
+			if rlm.AddConnection().Allowed() {
 				allowedCount++
 			}
 			now.Add(1)
@@ -102,7 +103,7 @@ func Test_RateLimitManagerMaxOpen(t *testing.T) {
 			wg.Add(iterations)
 			for i := 0; i < iterations; i++ {
 				go func() {
-					if rlm.AddConnection() {
+					if rlm.AddConnection().Allowed() {
 						allowedCount.Add(1)
 					}
 					wg.Done()
@@ -128,7 +129,7 @@ func Test_RateLimitManagerMaxOpen(t *testing.T) {
 			for i := 0; i < iterations; i++ {
 				go func(i int) {
 					// If allowed, release
-					if rlm.AddConnection() {
+					if rlm.AddConnection().Allowed() {
 						allowedCount.Add(1)
 						rlm.ReleaseConnection()
 					}
@@ -143,7 +144,362 @@ func Test_RateLimitManagerMaxOpen(t *testing.T) {
 	})
 }
 
-func newTestRLM(maxOpen int, maxRate int, ratePeriodSec int) (RateLimitManager, *atomic.Int64) {
+func Test_RateLimitManagerDecision(t *testing.T) {
+	t.Run("maxOpenTrigger", func(t *testing.T) {
+		rlm, _ := newTestRLM(1, -1, 0)
+		if d := rlm.AddConnection(); !d.Allowed() || d.OpenConnections != 1 {
+			t.Fatalf("maxOpenTrigger first decision = %v, want allowed with 1 open", d)
+		}
+		d := rlm.AddConnection()
+		want := RateLimitDecision{Outcome: RateLimitDenied, Trigger: TriggerMaxOpen, OpenConnections: 1, Limit: 1}
+		if d != want {
+			t.Errorf("maxOpenTrigger decision = %v, want %v", d, want)
+		}
+	})
+
+	t.Run("maxRateTrigger", func(t *testing.T) {
+		rlm, now := newTestRLM(-1, 2, 10)
+		rlm.AddConnection()
+		now.Add(3)
+		rlm.AddConnection()
+		now.Add(2)
+
+		// Window holds timestamps 1 and 4; the first leaves the window at 11, i.e. 5 seconds from now
+		d := rlm.AddConnection()
+		want := RateLimitDecision{
+			Outcome:         RateLimitDenied,
+			Trigger:         TriggerMaxRate,
+			OpenConnections: 2,
+			WindowCount:     2,
+			Limit:           2,
+			RetryAfter:      5 * time.Second,
+		}
+		if d != want {
+			t.Errorf("maxRateTrigger decision = %v, want %v", d, want)
+		}
+
+		now.Add(5)
+		if d = rlm.AddConnection(); !d.Allowed() {
+			t.Errorf("maxRateTrigger decision after retry = %v, want allowed", d)
+		}
+	})
+	t.Run("zeroValue", func(t *testing.T) {
+		// A decision that was never made, e.g. a missing return, must not let a connection through
+		var d RateLimitDecision
+		if d.Allowed() || d.Outcome != RateLimitUnknown {
+			t.Errorf("zero decision = %v, want unknown and not allowed", d)
+		}
+	})
+}
+
+func Test_RateLimitManagerWaitQueue(t *testing.T) {
+	// Queued requests are served in arrival order as connections are released
+	t.Run("fairOrder", func(t *testing.T) {
+		rlm := newTestQueuedRLM(1, 3, 5000)
+		if !rlm.AddConnection().Allowed() {
+			t.Fatalf("fairOrder first connection denied")
+		}
+
+		served := make(chan int, 3)
+		for i := 0; i < 3; i++ {
+			go func(i int) {
+				if rlm.AddConnection().Allowed() {
+					served <- i
+				}
+			}(i)
+			// Wait for the request to be queued, so arrival order is deterministic
+			waitForQueueLength(t, rlm, i+1)
+		}
+
+		for want := 0; want < 3; want++ {
+			rlm.ReleaseConnection()
+			if got := <-served; got != want {
+				t.Errorf("fairOrder served = %v, want %v", got, want)
+			}
+		}
+	})
+
+	t.Run("queueFull", func(t *testing.T) {
+		rlm := newTestQueuedRLM(1, 1, 5000)
+		rlm.AddConnection()
+		go rlm.AddConnection()
+		waitForQueueLength(t, rlm, 1)
+
+		if d := rlm.AddConnection(); d.Outcome != RateLimitDenied || d.Trigger != TriggerQueueFull {
+			t.Errorf("queueFull decision = %v, want denied by %v", d, TriggerQueueFull)
+		}
+		rlm.ReleaseConnection()
+	})
+
+	t.Run("queueTimeout", func(t *testing.T) {
+		rlm := newTestQueuedRLM(1, 1, 20)
+		rlm.AddConnection()
+
+		d := rlm.AddConnection()
+		if d.Outcome != RateLimitDenied || d.Trigger != TriggerQueueTimeout {
+			t.Errorf("queueTimeout decision = %v, want denied by %v", d, TriggerQueueTimeout)
+		}
+		if d.Waited < 20*time.Millisecond {
+			t.Errorf("queueTimeout waited = %v, want at least 20ms", d.Waited)
+		}
+		if waiting := queueLength(rlm); waiting != 0 {
+			t.Errorf("queueTimeout queue length = %v, want 0", waiting)
+		}
+	})
+}
+
+func Test_RateLimitManagerShadow(t *testing.T) {
+	// A shadow policy allows everything, but counts what it would have denied
+	t.Run("shadowAllows", func(t *testing.T) {
+		shadow := CreateRateLimitManager("ut-shadow-allows", RateLimitManagerConfig{
+			MaxOpenConnections: 2,
+			MaxRateAmount:      -1,
+			Shadow:             true,
+		})
+		shadowDenied := 0
+		for i := 0; i < 5; i++ {
+			d := shadow.AddConnection()
+			if !d.Allowed() {
+				t.Fatalf("shadowAllows decision = %v, want allowed", d)
+			}
+			if d.ShadowDenied {
+				shadowDenied++
+			}
+		}
+		if shadowDenied != 3 {
+			t.Errorf("shadowAllows shadow denied = %v, want 3", shadowDenied)
+		}
+		if got := shadowDenials.Get("ut-shadow-allows").String(); got != "3" {
+			t.Errorf("shadowAllows counter = %v, want 3", got)
+		}
+	})
+
+	// Next to an enforced policy, the shadow policy never changes the outcome
+	t.Run("shadowNextToEnforced", func(t *testing.T) {
+		enforced, _ := newTestRLM(3, -1, 0)
+		shadow := CreateRateLimitManager("ut-shadow-composite", RateLimitManagerConfig{
+			MaxOpenConnections: 1,
+			MaxRateAmount:      -1,
+			Shadow:             true,
+		})
+		rlm := CreateCompositeRateLimitManager(enforced, shadow)
+
+		allowedCount := 0
+		for i := 0; i < 5; i++ {
+			if rlm.AddConnection().Allowed() {
+				allowedCount++
+			}
+		}
+		if allowedCount != 3 {
+			t.Errorf("shadowNextToEnforced total allowed = %v, want 3", allowedCount)
+		}
+		if got := shadowDenials.Get("ut-shadow-composite").String(); got != "2" {
+			t.Errorf("shadowNextToEnforced counter = %v, want 2", got)
+		}
+	})
+}
+
+func Test_CompositeRateLimitManager(t *testing.T) {
+	// A denial by a later manager must not leave the connection counted in earlier ones
+	first, _ := newTestRLM(2, -1, 0)
+	second, _ := newTestRLM(1, -1, 0)
+	rlm := CreateCompositeRateLimitManager(first, second)
+
+	if !rlm.AddConnection().Allowed() {
+		t.Fatalf("composite first connection denied")
+	}
+	if d := rlm.AddConnection(); d.Allowed() || d.Limit != 1 {
+		t.Errorf("composite second decision = %v, want denied with limit 1", d)
+	}
+	if d := first.AddConnection(); !d.Allowed() || d.OpenConnections != 2 {
+		t.Errorf("first manager decision = %v, want allowed with 2 open", d)
+	}
+
+	// Nor in the sliding window of earlier managers
+	rated, _ := newTestRLM(-1, 2, 10)
+	capped, _ := newTestRLM(1, -1, 0)
+	rlm = CreateCompositeRateLimitManager(rated, capped)
+	if !rlm.AddConnection().Allowed() {
+		t.Fatalf("composite first rated connection denied")
+	}
+	if d := rlm.AddConnection(); d.Allowed() || d.Limit != 1 {
+		t.Errorf("composite second rated decision = %v, want denied with limit 1", d)
+	}
+	rlm.ReleaseConnection()
+	if d := rlm.AddConnection(); !d.Allowed() || d.WindowCount != 2 {
+		t.Errorf("composite third rated decision = %v, want allowed with 2 in window", d)
+	}
+	if snapshot := rated.Snapshot(); len(snapshot.Timestamps) != 2 {
+		t.Errorf("rated manager window = %v, want the 2 connections that went ahead", snapshot.Timestamps)
+	}
+}
+
+func Test_CompositeRateLimitManagerSnapshot(t *testing.T) {
+	clientConfig := RateLimitManagerConfig{MaxOpenConnections: -1, MaxRateAmount: 1, MaxRatePeriodSeconds: 60}
+	otherConfig := RateLimitManagerConfig{MaxOpenConnections: -1, MaxRateAmount: 5, MaxRatePeriodSeconds: 60}
+	shadow := otherConfig
+	shadow.Shadow = true
+	rlm := CreateCompositeRateLimitManager(
+		CreateCompositeRateLimitManager(CreateRateLimitManager("one@echo", clientConfig), CreateRateLimitManager("one@echo/shadow", shadow)))
+	if !rlm.AddConnection().Allowed() {
+		t.Fatalf("composite first connection denied")
+	}
+	snapshot := rlm.(PersistentRateLimitManager).Snapshot()
+
+	// Without the shadow policy, and with another manager in front, each manager still gets its own snapshot
+	client := CreateRateLimitManager("one@echo", clientConfig)
+	other := CreateRateLimitManager("one@echo/source", otherConfig)
+	CreateCompositeRateLimitManager(other, client).(PersistentRateLimitManager).Restore(snapshot)
+	if d := client.AddConnection(); d.Trigger != TriggerMaxRate {
+		t.Errorf("restored client decision = %v, want denied by %v", d, TriggerMaxRate)
+	}
+	if restored := other.Snapshot(); len(restored.Timestamps) != 0 {
+		t.Errorf("manager missing from the snapshot restored %v, want nothing", restored.Timestamps)
+	}
+}
+
+func Test_RateLimitManagerSnapshot(t *testing.T) {
+	rlm, now := newTestRLM(1, 2, 10)
+	rlm.AddConnection()
+	now.Add(5)
+
+	// Restoring into a new instance keeps the window, but not the open connection
+	restored, restoredNow := newTestRLM(1, 2, 10)
+	restoredNow.Store(now.Load())
+	restored.Restore(rlm.Snapshot())
+	if d := restored.AddConnection(); !d.Allowed() || d.WindowCount != 2 {
+		t.Errorf("restored first decision = %v, want allowed with 2 in window", d)
+	}
+	restored.ReleaseConnection()
+	if d := restored.AddConnection(); d.Trigger != TriggerMaxRate {
+		t.Errorf("restored second decision = %v, want denied by %v", d, TriggerMaxRate)
+	}
+
+	// Timestamps that left the window are not saved
+	now.Add(10)
+	if snapshot := rlm.Snapshot(); len(snapshot.Timestamps) != 0 {
+		t.Errorf("Snapshot() after window = %v, want no timestamps", snapshot)
+	}
+}
+
+func Test_RateLimitManagerSchedule(t *testing.T) {
+	rome, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skip("time zone database not available", err)
+	}
+	// 21:59 in Rome, one minute before the night window starts
+	evening := time.Date(2023, time.May, 15, 21, 59, 0, 0, rome).Unix()
+	rlm := CreateRateLimitManager("ut", RateLimitManagerConfig{
+		MaxOpenConnections:   -1,
+		MaxRateAmount:        2,
+		MaxRatePeriodSeconds: 3600,
+		Schedule: []RateLimitWindow{
+			{Start: "22:00", End: "06:00", Location: "Europe/Rome", MaxOpenConnections: -1, MaxRateAmount: 4},
+		},
+	})
+	currentTime := atomic.Int64{}
+	currentTime.Store(evening)
+	rlm.overrideTimeSupplier(currentTime.Load)
+
+	rlm.AddConnection()
+	rlm.AddConnection()
+	if d := rlm.AddConnection(); d.Trigger != TriggerMaxRate || d.Limit != 2 {
+		t.Errorf("day decision = %v, want denied by %v with limit 2", d, TriggerMaxRate)
+	}
+
+	// Connections made during the day still count once the night limits apply
+	currentTime.Add(60)
+	for i := 3; i <= 4; i++ {
+		if d := rlm.AddConnection(); !d.Allowed() || d.WindowCount != i {
+			t.Errorf("night decision = %v, want allowed with %d in window", d, i)
+		}
+	}
+	if d := rlm.AddConnection(); d.Trigger != TriggerMaxRate || d.Limit != 4 {
+		t.Errorf("night decision = %v, want denied by %v with limit 4", d, TriggerMaxRate)
+	}
+
+	// The window spans midnight
+	currentTime.Add(4 * 3600)
+	if d := rlm.AddConnection(); !d.Allowed() {
+		t.Errorf("decision after midnight = %v, want allowed", d)
+	}
+
+	if err = ValidateSchedule([]RateLimitWindow{{Start: "25:00", End: "06:00"}}); err == nil {
+		t.Errorf("ValidateSchedule() with invalid start = nil, want error")
+	}
+	if err = ValidateSchedule([]RateLimitWindow{{Start: "22:00", End: "06:00", MaxOpenConnections: 0, MaxRateAmount: -1}}); err == nil {
+		t.Errorf("ValidateSchedule() with zero open connections = nil, want error")
+	}
+	if err = ValidateSchedule([]RateLimitWindow{{Start: "22:00", End: "06:00", MaxOpenConnections: -1, MaxRateAmount: 0}}); err == nil {
+		t.Errorf("ValidateSchedule() with zero rate = nil, want error")
+	}
+	// A window limiting the rate needs a period, even if the base config does not limit it
+	night := []RateLimitWindow{{Start: "22:00", End: "06:00", MaxOpenConnections: -1, MaxRateAmount: 4}}
+	if err = ValidateLimits(RateLimitManagerConfig{MaxOpenConnections: -1, MaxRateAmount: -1, Schedule: night}); err == nil {
+		t.Errorf("ValidateLimits() with rate window and no period = nil, want error")
+	}
+	if err = ValidateLimits(RateLimitManagerConfig{MaxOpenConnections: -1, MaxRateAmount: -1, MaxRatePeriodSeconds: 60, Schedule: night}); err != nil {
+		t.Errorf("ValidateLimits() with rate window and period = %v, want nil", err)
+	}
+	if err = ValidateLimits(RateLimitManagerConfig{MaxOpenConnections: 1, MaxRateAmount: -1}); err != nil {
+		t.Errorf("ValidateLimits() without rate limits = %v, want nil", err)
+	}
+}
+
+func Test_RateLimitManagerUpdateConfig(t *testing.T) {
+	rlm := CreateRateLimitManager("ut", RateLimitManagerConfig{MaxOpenConnections: 1, MaxRateAmount: 2, MaxRatePeriodSeconds: 10})
+	currentTime := atomic.Int64{}
+	currentTime.Store(1)
+	rlm.overrideTimeSupplier(currentTime.Load)
+	rlm.AddConnection()
+	if d := rlm.AddConnection(); d.Trigger != TriggerMaxOpen {
+		t.Fatalf("decision before update = %v, want denied by %v", d, TriggerMaxOpen)
+	}
+
+	// The open connection and the window carry over to the new limits
+	rlm.UpdateConfig(RateLimitManagerConfig{MaxOpenConnections: 3, MaxRateAmount: 2, MaxRatePeriodSeconds: 10})
+	if d := rlm.AddConnection(); !d.Allowed() || d.OpenConnections != 2 || d.WindowCount != 2 {
+		t.Errorf("decision after update = %v, want allowed with 2 open and 2 in window", d)
+	}
+	if d := rlm.AddConnection(); d.Trigger != TriggerMaxRate {
+		t.Errorf("decision over rate after update = %v, want denied by %v", d, TriggerMaxRate)
+	}
+
+	// Tighter limits apply to the current usage right away
+	rlm.UpdateConfig(RateLimitManagerConfig{MaxOpenConnections: 1, MaxRateAmount: -1})
+	rlm.ReleaseConnection()
+	if d := rlm.AddConnection(); d.Trigger != TriggerMaxOpen || d.OpenConnections != 1 {
+		t.Errorf("decision after tightening = %v, want denied by %v with 1 open", d, TriggerMaxOpen)
+	}
+}
+
+func newTestQueuedRLM(maxOpen int, maxQueue int, maxWaitMillis int64) *rlManager {
+	return CreateRateLimitManager("ut", RateLimitManagerConfig{
+		MaxOpenConnections: maxOpen,
+		MaxRateAmount:      -1,
+		MaxQueueDepth:      maxQueue,
+		MaxQueueWaitMillis: maxWaitMillis,
+	})
+}
+
+func queueLength(rlm *rlManager) int {
+	rlm.Lock()
+	defer rlm.Unlock()
+	return rlm.waiters.Len()
+}
+
+func waitForQueueLength(t *testing.T, rlm *rlManager, length int) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		if queueLength(rlm) == length {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("queue length did not reach %v", length)
+}
+
+func newTestRLM(maxOpen int, maxRate int, ratePeriodSec int) (PersistentRateLimitManager, *atomic.Int64) {
 	rlm := CreateRateLimitManager("ut", RateLimitManagerConfig{
 		MaxOpenConnections:   maxOpen,
 		MaxRateAmount:        maxRate,